@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// adminAuth requires the admin key on the admin API, which is separate from
+// the virtual keys clients use.
+func adminAuth(c *gin.Context) {
+	key := azure.ClientKey(c.Request.Header)
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		// Browsers opening the dashboard send the admin key as the password.
+		key = password
+	}
+	if key == "" || !azure.IsAdminKey(key) {
+		if strings.HasPrefix(c.Request.URL.Path, "/dashboard") {
+			c.Header("WWW-Authenticate", `Basic realm="azure-oai-proxy dashboard"`)
+		}
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Incorrect admin key provided.",
+			Type:       "invalid_request_error",
+			Code:       "invalid_api_key",
+		})
+		return
+	}
+	c.Next()
+}
+
+// isAdminRequest reports whether the request targets the admin API, the
+// management service, the profiling endpoints or the dashboard, which all
+// use the admin key.
+func isAdminRequest(c *gin.Context) bool {
+	for _, prefix := range []string{"/admin/", managementServicePath, "/debug/pprof/", "/dashboard"} {
+		if strings.HasPrefix(c.Request.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleGetBudgets(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": azure.Budgets()})
+}
+
+func handleGetTenants(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": azure.TenantsUsage()})
+}
+
+func handleResetBudget(c *gin.Context) {
+	if err := azure.ResetBudget(c.Param("key"), c.Query("period")); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	for _, b := range azure.Budgets() {
+		if b.Key == c.Param("key") {
+			c.JSON(http.StatusOK, b)
+			return
+		}
+	}
+}
+
+func handleGetRateLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": azure.RateLimits()})
+}
+
+func handleBoostRateLimit(c *gin.Context) {
+	factor, err := strconv.ParseFloat(c.DefaultQuery("factor", "2"), 64)
+	if err != nil {
+		abortWithError(c, azure.NewInvalidRequestError("factor", "invalid_value", "Invalid factor, expected a number."))
+		return
+	}
+	duration, err := time.ParseDuration(c.DefaultQuery("duration", "1h"))
+	if err != nil {
+		abortWithError(c, azure.NewInvalidRequestError("duration", "invalid_value", "Invalid duration, expected a duration such as 1h."))
+		return
+	}
+	boost, err := azure.BoostRateLimit(c.Param("key"), factor, duration)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, boost)
+}
+
+func handleCancelRateLimitBoost(c *gin.Context) {
+	if !azure.CancelRateLimitBoost(c.Param("key")) {
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Key %s has no rate limit boost.", c.Param("key")),
+			Type:       "invalid_request_error",
+			Code:       "boost_not_found",
+		})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleGetSchema reports the fields clients sent and Azure returned in the
+// sampled requests, by route.
+func handleGetSchema(c *gin.Context) {
+	reports, since := azure.SchemaReports()
+	c.JSON(http.StatusOK, gin.H{"object": "list", "since": since, "data": reports})
+}
+
+func handleResetSchema(c *gin.Context) {
+	azure.ResetSchemaReports()
+	c.Status(http.StatusNoContent)
+}
+
+// handleExportCaptures exports the captured conversations as JSONL in the
+// fine-tuning chat format.
+func handleExportCaptures(c *gin.Context) {
+	filter := azure.CaptureFilter{Key: c.Query("key"), Metadata: c.Query("metadata") == "true"}
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			var err error
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				abortWithError(c, azure.NewInvalidRequestError(param, "invalid_value", "Invalid "+param+", expected an RFC 3339 timestamp."))
+				return
+			}
+		}
+	}
+	c.Header("Content-Type", "application/jsonl")
+	c.Status(http.StatusOK)
+	if err := azure.ExportCaptures(c.Writer, filter); err != nil {
+		log.Printf("error exporting captures: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+const (
+	// virtualKeyContextKey is the gin context key holding the name of the
+	// virtual key a request was authenticated with.
+	virtualKeyContextKey = "virtual_key"
+	// entraTokenContextKey is the gin context key holding a validated Entra
+	// ID token that is forwarded upstream.
+	entraTokenContextKey = "entra_token"
+)
+
+// authenticate requires a valid proxy virtual key when virtual keys are
+// configured. The Azure API token is then used upstream instead of whatever
+// the client sent. With Entra passthrough, Entra ID tokens are validated and
+// forwarded instead. The admin API has its own key.
+func authenticate(c *gin.Context) {
+	if c.Request.Method == http.MethodOptions || isAdminRequest(c) {
+		c.Next()
+		return
+	}
+
+	key := azure.ClientKey(c.Request.Header)
+	if azure.AzureOpenAIEntraPassthrough && azure.IsJWT(key) {
+		authenticateEntra(c, key)
+		return
+	}
+	if !azure.VirtualKeysEnabled() {
+		c.Next()
+		return
+	}
+
+	name, ok := azure.LookupVirtualKey(key)
+	if key == "" || !ok {
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Incorrect API key provided.",
+			Type:       "invalid_request_error",
+			Code:       "invalid_api_key",
+		})
+		return
+	}
+	c.Set(virtualKeyContextKey, name)
+	c.Next()
+}
+
+// authenticateEntra validates an Entra ID token and applies the policies of
+// the virtual key its identity is mapped to.
+func authenticateEntra(c *gin.Context, token string) {
+	claims, err := azure.ValidateEntraToken(token)
+	if err != nil {
+		log.Printf("rejecting entra token: %v", err)
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Invalid Microsoft Entra ID token: " + err.Error(),
+			Type:       "invalid_request_error",
+			Code:       "invalid_token",
+		})
+		return
+	}
+	name, ok := claims.KeyName()
+	if !ok && len(azure.AzureOpenAIEntraClaimMap) > 0 {
+		log.Printf("rejecting entra identity app %s, object %s: no claim mapping", claims.App(), claims.ObjectID)
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusForbidden,
+			Message:    "This identity is not allowed to use the proxy.",
+			Type:       "invalid_request_error",
+			Code:       "identity_not_allowed",
+		})
+		return
+	}
+	c.Set(virtualKeyContextKey, name)
+	c.Set(entraTokenContextKey, token)
+	c.Next()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+var (
+	// MaxBodySize limits JSON and other non-multipart request bodies.
+	MaxBodySize int64 = 50 << 20
+	// MaxMultipartBodySize limits multipart uploads such as audio and files.
+	MaxMultipartBodySize int64 = 512 << 20
+	// MaxInputAudioSize and MaxImageSize limit each base64 audio and image
+	// part of chat completions, decoded.
+	MaxInputAudioSize int64 = 20 << 20
+	MaxImageSize      int64 = 20 << 20
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_BODY_SIZE"); v != "" {
+		MaxBodySize = parseByteSize("AZURE_OPENAI_PROXY_MAX_BODY_SIZE", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_MULTIPART_BODY_SIZE"); v != "" {
+		MaxMultipartBodySize = parseByteSize("AZURE_OPENAI_PROXY_MAX_MULTIPART_BODY_SIZE", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_INPUT_AUDIO_SIZE"); v != "" {
+		MaxInputAudioSize = parseByteSize("AZURE_OPENAI_PROXY_MAX_INPUT_AUDIO_SIZE", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MAX_IMAGE_SIZE"); v != "" {
+		MaxImageSize = parseByteSize("AZURE_OPENAI_PROXY_MAX_IMAGE_SIZE", v)
+	}
+	log.Printf("loading azure openai proxy max body size: %d bytes, multipart: %d bytes", MaxBodySize, MaxMultipartBodySize)
+	log.Printf("loading azure openai proxy max input audio size: %d bytes, image: %d bytes", MaxInputAudioSize, MaxImageSize)
+}
+
+// parseByteSize parses sizes like "1048576", "512KB", "10MB" or "1GB".
+func parseByteSize(name, v string) int64 {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	s := strings.ToUpper(strings.TrimSpace(v))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("error parsing %s, invalid value %s", name, v)
+		os.Exit(1)
+	}
+	return n * multiplier
+}
+
+// limitBodySize rejects requests whose body exceeds the configured limit with
+// a 413, up front from Content-Length when it is known.
+func limitBodySize(c *gin.Context) {
+	limit := MaxBodySize
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		limit = MaxMultipartBodySize
+	}
+	if limit == 0 || c.Request.Body == nil {
+		c.Next()
+		return
+	}
+	if c.Request.ContentLength > limit {
+		abortWithError(c, azure.NewRequestTooLargeError(limit))
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	if limit == MaxMultipartBodySize {
+		// Uploads are streamed, the proxy error handler reports the overflow.
+		c.Next()
+		return
+	}
+	// JSON bodies are buffered anyway, read them now so that chunked requests
+	// over the limit are rejected before anything is sent upstream.
+	if _, err := readRequestBody(c); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.Next()
+}
+
+// isBodyTooLarge reports whether err was caused by limitBodySize.
+func isBodyTooLarge(err error) (int64, bool) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return maxBytesErr.Limit, true
+	}
+	return 0, false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+const usage = `Usage: azure-oai-proxy [command] [flags]
+
+Commands:
+  serve     serve the proxy (the default)
+  validate  check the configuration and list the backends and model mapping
+  probe     send a minimal chat completion for each model to each backend
+
+The configuration is read from the environment in every command.
+`
+
+// runValidate reports the problems of the configuration, after the checks
+// done while loading it, and returns the exit code.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Parse(args)
+
+	if ProxyMode != "azure" {
+		fmt.Printf("configuration is valid (%s mode)\n", ProxyMode)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tENDPOINT\tTYPE\tAPI KEY\tMODELS")
+	for _, b := range azure.Backends() {
+		models := "all"
+		if len(b.Models) > 0 {
+			models = strings.Join(azure.SortedKeys(b.Models), ",")
+		}
+		apiKey := "client's"
+		if b.HasAPIKey() {
+			apiKey = "configured"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Name, b.Endpoint, b.Type, apiKey, models)
+	}
+	w.Flush()
+
+	mapper := azure.ModelMapper()
+	if len(mapper) > 0 {
+		fmt.Println()
+		fmt.Fprintln(w, "MODEL\tDEPLOYMENT")
+		for _, model := range azure.SortedKeys(mapper) {
+			fmt.Fprintf(w, "%s\t%s\n", model, mapper[model])
+		}
+		w.Flush()
+	}
+
+	problems := azure.ValidateConfig()
+	fmt.Println()
+	for _, problem := range problems {
+		fmt.Printf("error: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("configuration has %d problems\n", len(problems))
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// runProbe probes every model of every backend and returns the exit code,
+// non-zero when any probe failed.
+func runProbe(args []string) int {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	models := flags.String("model", "", "comma separated models to probe, instead of the ones served or mapped")
+	backend := flags.String("backend", "", "only probe this backend")
+	key := flags.String("key", "", "API key for backends without one")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of each probe")
+	flags.Parse(args)
+
+	if ProxyMode != "azure" {
+		fmt.Fprintf(os.Stderr, "probe requires the azure mode\n")
+		return 2
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tMODEL\tDEPLOYMENT\tSTATUS\tLATENCY\tRESULT")
+	probed, failed := 0, 0
+	for _, b := range azure.Backends() {
+		if b.Type == azure.BackendMirror || (*backend != "" && b.Name != *backend) {
+			continue
+		}
+		list := azure.ProbeModels(b)
+		if *models != "" {
+			list = azure.SplitList(*models)
+		}
+		if len(list) == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\tfailed\t-\tno models to probe, pass -model\n", b.Name)
+			probed++
+			failed++
+			continue
+		}
+		for _, model := range list {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			result := azure.Probe(ctx, b, model, *key)
+			cancel()
+			probed++
+			status := "ok"
+			if !result.OK() {
+				failed++
+				status = "failed"
+				if result.Status != 0 {
+					status = fmt.Sprintf("failed (%d)", result.Status)
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", result.Backend, result.Model, result.Deployment, status,
+				result.Latency.Round(time.Millisecond), result.Detail)
+		}
+	}
+	w.Flush()
+	if *backend != "" && probed == 0 {
+		fmt.Fprintf(os.Stderr, "unknown backend %s\n", *backend)
+		return 2
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d of %d probes failed\n", failed, probed)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// DashboardEnabled serves a live dashboard of the proxy traffic at
+// /dashboard, behind the admin key.
+var DashboardEnabled = false
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_DASHBOARD"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_DASHBOARD, invalid value %s", v)
+			os.Exit(1)
+		}
+		DashboardEnabled = b
+	}
+	if !DashboardEnabled {
+		return
+	}
+	if !azure.AdminEnabled() {
+		log.Printf("error parsing AZURE_OPENAI_PROXY_DASHBOARD, the dashboard requires AZURE_OPENAI_PROXY_ADMIN_KEY")
+		os.Exit(1)
+	}
+	azure.EnableTrafficAccounting()
+	log.Printf("loading azure openai proxy dashboard: /dashboard")
+}
+
+type dashboardData struct {
+	azure.TrafficSnapshot
+	Backends []dashboardBackend `json:"backends"`
+}
+
+type dashboardBackend struct {
+	Name                string `json:"name"`
+	Type                string `json:"type"`
+	Available           bool   `json:"available"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Requests            uint64 `json:"requests"`
+	Errors              uint64 `json:"errors"`
+	Throttled           uint64 `json:"throttled"`
+	AvgLatencyMs        int64  `json:"avg_latency_ms"`
+	// Capacity is the quota left of each deployment, as Azure last
+	// reported it.
+	Capacity []azure.DeploymentCapacity `json:"capacity"`
+}
+
+// recordTraffic adds the request to the dashboard traffic, if enabled.
+func recordTraffic(c *gin.Context, info *azure.RequestInfo, latency time.Duration) {
+	if DashboardEnabled {
+		azure.RecordTraffic(info, c.Request.Method, c.Request.URL.Path, c.Writer.Status(), latency)
+	}
+}
+
+func handleDashboard(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardPage)
+}
+
+func handleDashboardData(c *gin.Context) {
+	data := dashboardData{TrafficSnapshot: azure.Traffic(), Backends: []dashboardBackend{}}
+	for _, stat := range azure.BackendStats() {
+		data.Backends = append(data.Backends, dashboardBackend{
+			Name:                stat.Name,
+			Type:                stat.Type,
+			Available:           stat.Available,
+			ConsecutiveFailures: stat.ConsecutiveFailures,
+			Requests:            stat.Requests,
+			Errors:              stat.Errors,
+			Throttled:           stat.Throttled,
+			AvgLatencyMs:        stat.AverageLatency.Milliseconds(),
+			Capacity:            append([]azure.DeploymentCapacity{}, stat.Capacity...),
+		})
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, data)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	inFlightRequests = metrics.NewGauge("azure_oai_proxy_in_flight_requests",
+		"Requests being served by the proxy, by route.", "route")
+	_ = metrics.NewGaugeFunc("azure_oai_proxy_goroutines",
+		"Number of goroutines of the proxy process.", func() float64 { return float64(runtime.NumGoroutine()) })
+)
+
+// trackInFlight counts the requests being served, including streams that
+// are still being relayed.
+func trackInFlight(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	inFlightRequests.Inc(route)
+	defer inFlightRequests.Dec(route)
+	c.Next()
+}
+
+// handlePprof serves the runtime profiles of net/http/pprof below
+// /debug/pprof/.
+func handlePprof(c *gin.Context) {
+	switch c.Param("name") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+var (
+	// StripResponseHeaders are the response headers removed before responses
+	// reach clients. A trailing * matches any header with that prefix.
+	StripResponseHeaders []string
+	// ResponseHeaders are set on every response, replacing the upstream ones.
+	ResponseHeaders http.Header
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_STRIP_RESPONSE_HEADERS"); v != "" {
+		StripResponseHeaders = azure.SplitList(v)
+		log.Printf("loading azure openai proxy stripped response headers: %s", strings.Join(StripResponseHeaders, ", "))
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_RESPONSE_HEADERS"); v != "" {
+		ResponseHeaders = parseHeaders("AZURE_OPENAI_PROXY_RESPONSE_HEADERS", v)
+		for name, values := range ResponseHeaders {
+			log.Printf("loading azure openai proxy response header: %s: %s", name, values[0])
+		}
+	}
+}
+
+// parseHeaders parses Name: value pairs separated by newlines, or by commas
+// when there is a single line.
+func parseHeaders(name, v string) http.Header {
+	separator := ","
+	if strings.Contains(v, "\n") {
+		separator = "\n"
+	}
+	headers := http.Header{}
+	for _, line := range strings.Split(v, separator) {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) == "" {
+			log.Printf("error parsing %s, invalid value %s", name, line)
+			os.Exit(1)
+		}
+		headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	return headers
+}
+
+// rewriteResponseHeaders strips and sets the configured headers on every
+// response, upstream or the proxy's own, just before they are sent.
+func rewriteResponseHeaders(c *gin.Context) {
+	w := &headerRewriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+	// Responses without a body have their headers written by gin afterwards.
+	w.apply()
+}
+
+// headerRewriter applies the header rules once, when the headers are
+// written.
+type headerRewriter struct {
+	gin.ResponseWriter
+	done bool
+}
+
+func (w *headerRewriter) apply() {
+	if w.done || w.ResponseWriter.Written() {
+		return
+	}
+	w.done = true
+	header := w.ResponseWriter.Header()
+	for name := range header {
+		if stripsHeader(name) {
+			header.Del(name)
+		}
+	}
+	for name, values := range ResponseHeaders {
+		header[name] = values
+	}
+}
+
+func (w *headerRewriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *headerRewriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *headerRewriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *headerRewriter) Flush() {
+	w.apply()
+	w.ResponseWriter.Flush()
+}
+
+func stripsHeader(name string) bool {
+	for _, pattern := range StripResponseHeaders {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+var (
+	TrustedProxies []string
+	AllowedIPs     []*net.IPNet
+	DeniedIPs      []*net.IPNet
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_TRUSTED_PROXIES"); v != "" {
+		TrustedProxies = azure.SplitList(v)
+		log.Printf("loading azure openai proxy trusted proxies: %s", strings.Join(TrustedProxies, ", "))
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_ALLOWED_IPS"); v != "" {
+		AllowedIPs = parseCIDRs("AZURE_OPENAI_PROXY_ALLOWED_IPS", v)
+		log.Printf("loading azure openai proxy allowed ips: %s", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_DENIED_IPS"); v != "" {
+		DeniedIPs = parseCIDRs("AZURE_OPENAI_PROXY_DENIED_IPS", v)
+		log.Printf("loading azure openai proxy denied ips: %s", v)
+	}
+}
+
+// parseCIDRs parses a comma separated list of CIDRs or plain IP addresses.
+func parseCIDRs(name, v string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, item := range azure.SplitList(v) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("error parsing %s, invalid value %s", name, item)
+			os.Exit(1)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter rejects clients that are on the deny list or, when an allow list
+// is configured, not on it. The client IP honours X-Forwarded-For only from
+// trusted proxies.
+func ipFilter(c *gin.Context) {
+	ip := net.ParseIP(c.ClientIP())
+	if ip == nil || containsIP(DeniedIPs, ip) || (len(AllowedIPs) > 0 && !containsIP(AllowedIPs, ip)) {
+		log.Printf("rejecting request from %s: not allowed", c.ClientIP())
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusForbidden,
+			Message:    "Your IP address is not allowed to access this proxy.",
+			Type:       "invalid_request_error",
+			Code:       "ip_not_allowed",
+		})
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// unixAddressPrefix marks an AZURE_OPENAI_PROXY_ADDRESS that is the path
+	// of a Unix domain socket.
+	unixAddressPrefix = "unix:"
+	// systemdListenFDsStart is the first file descriptor passed by systemd
+	// socket activation.
+	systemdListenFDsStart = 3
+)
+
+// SocketMode is the file mode of the Unix domain socket the proxy listens on.
+var SocketMode os.FileMode = 0o660
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_SOCKET_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0o777 {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_SOCKET_MODE, invalid value %s", v)
+			os.Exit(1)
+		}
+		SocketMode = os.FileMode(mode)
+	}
+}
+
+// serve serves handler on the sockets passed by systemd socket activation,
+// or else on Address, a TCP address or unix: followed by a socket path.
+func serve(handler http.Handler) error {
+	listeners, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		l, err := listen(Address)
+		if err != nil {
+			return err
+		}
+		listeners = []net.Listener{l}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("listening on %s %s", l.Addr().Network(), l.Addr())
+		go func(l net.Listener) {
+			errs <- http.Serve(l, handler)
+		}(l)
+	}
+	return <-errs
+}
+
+// listen opens the listener for address.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixAddressPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// A socket left behind by a previous run would make the bind fail.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, SocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets passed to the process by systemd
+// socket activation, if any.
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// The sockets are for this process only, not for any it starts.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := systemdListenFDsStart; fd < systemdListenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
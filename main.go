@@ -1,21 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
 	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+	"github.com/tidwall/gjson"
 )
 
 var (
 	Address   = "0.0.0.0:11437"
 	ProxyMode = "azure"
+	// ModelsAzureExtras adds the Azure model schema of each model, such as
+	// its capabilities and lifecycle status, under x-azure in /v1/models.
+	ModelsAzureExtras = false
+
+	azureProxy  *httputil.ReverseProxy
+	openaiProxy *httputil.ReverseProxy
 )
 
 // Define the ModelList and Model types based on the API documentation
@@ -35,6 +48,25 @@ type Model struct {
 	FineTune        string       `json:"fine_tune,omitempty"`
 }
 
+// OpenAIModel is a model in the format of the OpenAI API.
+type OpenAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	// XAzure is the model in the Azure schema, with ModelsAzureExtras.
+	XAzure *Model `json:"x-azure,omitempty"`
+}
+
+// OpenAIModelList is a list of models in the format of the OpenAI API.
+type OpenAIModelList struct {
+	Object string        `json:"object"`
+	Data   []OpenAIModel `json:"data"`
+}
+
+// modelOwner is the owned_by of the models served by the proxy.
+const modelOwner = "azure-openai"
+
 type Capabilities struct {
 	FineTune       bool `json:"fine_tune"`
 	Inference      bool `json:"inference"`
@@ -56,17 +88,101 @@ func init() {
 	if v := os.Getenv("AZURE_OPENAI_PROXY_MODE"); v != "" {
 		ProxyMode = v
 	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_MODELS_AZURE_EXTRAS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_MODELS_AZURE_EXTRAS, invalid value %s", v)
+			os.Exit(1)
+		}
+		ModelsAzureExtras = b
+	}
 	log.Printf("loading azure openai proxy address: %s", Address)
 	log.Printf("loading azure openai proxy mode: %s", ProxyMode)
 }
 
 func main() {
+	command, args := "serve", []string(nil)
+	if len(os.Args) > 1 {
+		command, args = os.Args[1], os.Args[2:]
+	}
+	switch command {
+	case "serve":
+		runServe()
+	case "validate":
+		os.Exit(runValidate(args))
+	case "probe":
+		os.Exit(runProbe(args))
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// runServe serves the proxy until it is stopped.
+func runServe() {
+	if azure.AzureOpenAIPIIScrubLogs {
+		gin.DefaultWriter = azure.NewPIIWriter(gin.DefaultWriter)
+	}
 	router := gin.Default()
+	if err := router.SetTrustedProxies(TrustedProxies); err != nil {
+		log.Printf("error parsing AZURE_OPENAI_PROXY_TRUSTED_PROXIES: %v", err)
+		os.Exit(1)
+	}
+	if len(AllowedIPs) > 0 || len(DeniedIPs) > 0 {
+		router.Use(ipFilter)
+	}
+
+	if len(DisabledRoutes) > 0 {
+		router.Use(rejectDisabledRoutes)
+	}
+	if len(StripResponseHeaders) > 0 || len(ResponseHeaders) > 0 {
+		router.Use(rewriteResponseHeaders)
+	}
+
 	if ProxyMode == "azure" {
+		azureProxy = azure.NewOpenAIReverseProxy()
+		azure.StartDeploymentDiscovery()
+		azure.StartConfigReload()
+		azure.StartUsageReports()
+		router.Use(trackInFlight, authenticate, limitBodySize)
+
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+		if azure.AdminEnabled() {
+			admin := router.Group("/admin", adminAuth)
+			admin.GET("/budgets", handleGetBudgets)
+			admin.POST("/budgets/:key/reset", handleResetBudget)
+			admin.GET("/tenants", handleGetTenants)
+			admin.GET("/rate-limits", handleGetRateLimits)
+			admin.POST("/rate-limits/:key/boost", handleBoostRateLimit)
+			admin.DELETE("/rate-limits/:key/boost", handleCancelRateLimitBoost)
+			if requestLog != nil {
+				admin.GET("/requests", handleGetRequests)
+				admin.POST("/requests/:id/replay", handleReplayRequest)
+			}
+			if len(azure.AzureOpenAICaptureKeys) > 0 {
+				admin.GET("/captures", handleExportCaptures)
+			}
+			if len(azure.AzureOpenAISchemaSampling) > 0 {
+				admin.GET("/schema", handleGetSchema)
+				admin.DELETE("/schema", handleResetSchema)
+			}
+			router.POST(managementServicePath+":method", adminAuth, handleManagement)
+			router.GET("/debug/pprof/*name", adminAuth, handlePprof)
+			router.POST("/debug/pprof/*name", adminAuth, handlePprof)
+			if DashboardEnabled {
+				router.GET("/dashboard", adminAuth, handleDashboard)
+				router.GET("/dashboard/data", adminAuth, handleDashboardData)
+			}
+		}
 		router.GET("/v1/models", handleGetModels)
+		router.GET("/v1/models/:model_id", handleGetModel)
+		router.POST("/v1/proxy/estimate", handleEstimate)
 		router.OPTIONS("/v1/*path", handleOptions)
 		// Existing routes
 		router.POST("/v1/chat/completions", handleAzureProxy)
+		router.POST("/v1/extensions/chat/completions", handleAzureProxy)
 		router.POST("/v1/completions", handleAzureProxy)
 		router.POST("/v1/embeddings", handleAzureProxy)
 		// DALL-E routes
@@ -77,6 +193,13 @@ func main() {
 		router.POST("/v1/audio/transcriptions", handleAzureProxy)
 		router.POST("/v1/audio/translations", handleAzureProxy)
 		// Fine-tuning routes
+		router.POST("/v1/fine_tuning/jobs", handleAzureProxy)
+		router.GET("/v1/fine_tuning/jobs", handleAzureProxy)
+		router.GET("/v1/fine_tuning/jobs/:fine_tuning_job_id", handleAzureProxy)
+		router.POST("/v1/fine_tuning/jobs/:fine_tuning_job_id/cancel", handleAzureProxy)
+		router.GET("/v1/fine_tuning/jobs/:fine_tuning_job_id/events", handleAzureProxy)
+		router.GET("/v1/fine_tuning/jobs/:fine_tuning_job_id/checkpoints", handleAzureProxy)
+		// Legacy fine-tunes routes
 		router.POST("/v1/fine_tunes", handleAzureProxy)
 		router.GET("/v1/fine_tunes", handleAzureProxy)
 		router.GET("/v1/fine_tunes/:fine_tune_id", handleAzureProxy)
@@ -88,38 +211,146 @@ func main() {
 		router.DELETE("/v1/files/:file_id", handleAzureProxy)
 		router.GET("/v1/files/:file_id", handleAzureProxy)
 		router.GET("/v1/files/:file_id/content", handleAzureProxy)
+		// Uploads routes
+		router.POST("/v1/uploads", handleAzureProxy)
+		router.POST("/v1/uploads/:upload_id/parts", handleAzureProxy)
+		router.POST("/v1/uploads/:upload_id/complete", handleAzureProxy)
+		router.POST("/v1/uploads/:upload_id/cancel", handleAzureProxy)
+		// Vector store routes
+		router.POST("/v1/vector_stores", handleAzureProxy)
+		router.GET("/v1/vector_stores", handleAzureProxy)
+		router.GET("/v1/vector_stores/:vector_store_id", handleAzureProxy)
+		router.POST("/v1/vector_stores/:vector_store_id", handleAzureProxy)
+		router.DELETE("/v1/vector_stores/:vector_store_id", handleAzureProxy)
+		router.POST("/v1/vector_stores/:vector_store_id/files", handleAzureProxy)
+		router.GET("/v1/vector_stores/:vector_store_id/files", handleAzureProxy)
+		router.GET("/v1/vector_stores/:vector_store_id/files/:file_id", handleAzureProxy)
+		router.DELETE("/v1/vector_stores/:vector_store_id/files/:file_id", handleAzureProxy)
+		router.POST("/v1/vector_stores/:vector_store_id/file_batches", handleAzureProxy)
+		router.GET("/v1/vector_stores/:vector_store_id/file_batches/:batch_id", handleAzureProxy)
+		router.POST("/v1/vector_stores/:vector_store_id/file_batches/:batch_id/cancel", handleAzureProxy)
+		router.GET("/v1/vector_stores/:vector_store_id/file_batches/:batch_id/files", handleAzureProxy)
 		// Deployments management routes
 		router.GET("/deployments", handleAzureProxy)
 		router.GET("/deployments/:deployment_id", handleAzureProxy)
 		router.GET("/v1/models/:model_id/capabilities", handleAzureProxy)
 	} else {
+		openaiProxy = openai.NewOpenAIReverseProxy()
 		router.Any("*path", handleOpenAIProxy)
 	}
 
-	router.Run(Address)
+	if err := serve(router.Handler()); err != nil {
+		log.Printf("error serving: %v", err)
+		os.Exit(1)
+	}
 }
 
 func handleGetModels(c *gin.Context) {
-	req, _ := http.NewRequest("GET", c.Request.URL.String(), nil)
-	req.Header.Set("Authorization", c.GetHeader("Authorization"))
+	if azure.AzureOpenAIDiscoveryInterval > 0 {
+		c.JSON(http.StatusOK, toOpenAIModelList(discoveredModels()))
+		return
+	}
 
-	models, err := fetchDeployedModels(req)
+	models, err := fetchDeployedModels(c.Request)
 	if err != nil {
 		log.Printf("error fetching deployed models: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch deployed models"})
 		return
 	}
-	result := ModelList{
-		Object: "list",
-		Data:   models,
+	c.JSON(http.StatusOK, toOpenAIModelList(models))
+}
+
+// toOpenAIModelList translates models from the Azure schema to the OpenAI
+// one, which strict clients expect.
+func toOpenAIModelList(models []Model) OpenAIModelList {
+	list := OpenAIModelList{Object: "list", Data: make([]OpenAIModel, len(models))}
+	for i, m := range models {
+		list.Data[i] = toOpenAIModel(m)
+	}
+	return list
+}
+
+func toOpenAIModel(m Model) OpenAIModel {
+	model := OpenAIModel{ID: m.ID, Object: "model", Created: m.CreatedAt, OwnedBy: modelOwner}
+	if ModelsAzureExtras {
+		model.XAzure = &m
+	}
+	return model
+}
+
+// handleGetModel returns a model the proxy serves in the OpenAI format, for
+// clients that look up their model before using it.
+func handleGetModel(c *gin.Context) {
+	id := c.Param("model_id")
+	model, ok := lookupModel(id)
+	if !ok {
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("The model '%s' does not exist", id),
+			Type:       "invalid_request_error",
+			Code:       "model_not_found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, model)
+}
+
+// lookupModel synthesizes the model id from the discovered deployments or
+// the model mappings of the proxy, its backends and tenants.
+func lookupModel(id string) (OpenAIModel, bool) {
+	for _, m := range discoveredModels() {
+		if m.ID == id {
+			return toOpenAIModel(m), true
+		}
+	}
+	model := OpenAIModel{ID: id, Object: "model", OwnedBy: modelOwner}
+	if _, ok := azure.ModelMapper()[id]; ok {
+		return model, true
+	}
+	for _, b := range azure.Backends() {
+		if _, ok := b.ModelMapper[id]; ok || b.Models[id] {
+			return model, true
+		}
+	}
+	for _, t := range azure.Tenants {
+		if _, ok := t.ModelMapper[id]; ok {
+			return model, true
+		}
 	}
-	c.JSON(http.StatusOK, result)
+	return model, false
+}
+
+// handleEstimate answers a chat completions, completions or embeddings
+// request body with where the proxy would send it and what it would cost,
+// without calling Azure.
+func handleEstimate(c *gin.Context) {
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !gjson.ValidBytes(body) {
+		abortWithError(c, azure.NewInvalidRequestError("", "invalid_json", "The request body is not valid JSON."))
+		return
+	}
+	keyName := c.GetString(virtualKeyContextKey)
+	tenant, apiErr := azure.ResolveTenant(keyName, c.GetHeader(azure.TenantHeader))
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return
+	}
+	estimate, apiErr := azure.EstimateRequest(body, keyName, tenant)
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return
+	}
+	c.JSON(http.StatusOK, estimate)
 }
 
 func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
 	endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
 	if endpoint == "" {
-		endpoint = azure.AzureOpenAIEndpoint
+		endpoint = azure.Backends()[0].Endpoint.String()
 	}
 
 	url := fmt.Sprintf("%s/openai/models?api-version=%s", endpoint, azure.AzureOpenAIAPIVersion)
@@ -128,12 +359,13 @@ func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", originalReq.Header.Get("Authorization"))
+	if key := azure.ClientKey(originalReq.Header); key != "" {
+		req.Header.Set("api-key", key)
+	}
 
 	azure.HandleToken(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := azure.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -152,10 +384,32 @@ func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
 	return deployedModelsResponse.Data, nil
 }
 
+// discoveredModels lists the discovered deployments as models, once each.
+// Clients can use their IDs as the model of requests.
+func discoveredModels() []Model {
+	models := []Model{}
+	seen := map[string]bool{}
+	for _, d := range azure.DiscoveredDeployments() {
+		if seen[d.ID] {
+			continue
+		}
+		seen[d.ID] = true
+		models = append(models, Model{
+			ID:              d.ID,
+			Object:          "model",
+			CreatedAt:       d.CreatedAt,
+			Capabilities:    Capabilities{Inference: true},
+			LifecycleStatus: "generally-available",
+			Status:          d.Status,
+		})
+	}
+	return models
+}
+
 func handleOptions(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, api-key, "+azure.DeploymentOverrideHeader+", "+azure.AzureOpenAISessionHeader+", "+azure.DryRunHeader+", "+azure.TenantHeader)
 	c.Status(200)
 	return
 }
@@ -166,13 +420,119 @@ func handleAzureProxy(c *gin.Context) {
 		return
 	}
 
-	server := azure.NewOpenAIReverseProxy()
-	server.ServeHTTP(c.Writer, c.Request)
+	c.Request = c.Request.WithContext(azure.NewRequestContext(c.Request.Context()))
+	info := azure.RequestInfoFromContext(c.Request.Context())
+	info.KeyName = c.GetString(virtualKeyContextKey)
+	info.EntraToken = c.GetString(entraTokenContextKey)
+	info.Priority = azure.KeyPriority(info.KeyName)
+	defer logRequest(c, time.Now())
+	defer recoverClientAbort(c)
+	captureBodies(c)
+
+	dryRun, err := azure.DryRunMode(c.GetHeader(azure.DryRunHeader))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	info.DryRun = dryRun
+	c.Request.Header.Del(azure.DryRunHeader)
+
+	tenant, apiErr := azure.ResolveTenant(info.KeyName, c.GetHeader(azure.TenantHeader))
+	if apiErr != nil {
+		abortWithError(c, apiErr)
+		return
+	}
+	info.Tenant = tenant
+	c.Request.Header.Del(azure.TenantHeader)
+
+	if err := azure.CheckDeploymentOverride(c.GetHeader(azure.DeploymentOverrideHeader), tenant); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	if err := azure.CheckBudget(info.KeyName); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := azure.CheckRateLimit(info); err != nil {
+		azure.WriteQuotaHeaders(c.Writer.Header(), info)
+		abortWithError(c, err)
+		return
+	}
+	if err := azure.CheckTenantRateLimit(info); err != nil {
+		azure.WriteQuotaHeaders(c.Writer.Header(), info)
+		abortWithError(c, err)
+		return
+	}
+
+	if !sampleSchema(c) {
+		return
+	}
+
+	if c.Request.URL.Path == "/v1/extensions/chat/completions" && !translateExtensionsRequest(c) {
+		return
+	}
+
+	if !handleLegacyEndpoint(c) {
+		return
+	}
+
+	if !scrubPII(c) {
+		return
+	}
+
+	if c.Request.URL.Path == "/v1/chat/completions" && azure.SystemPromptsEnabled() && !pinSystemPrompt(c) {
+		return
+	}
+
+	if (c.Request.URL.Path == "/v1/chat/completions" || c.Request.URL.Path == "/v1/completions") && !applyLogprobsCompat(c) {
+		return
+	}
+
+	if c.Request.URL.Path == "/v1/chat/completions" && !applyMultimodal(c) {
+		return
+	}
+
+	if !applyTokenLimits(c) {
+		return
+	}
+
+	if c.Request.URL.Path == "/v1/audio/speech" && !applySpeechStreamFormat(c) {
+		return
+	}
+
+	if c.Request.URL.Path == "/v1/chat/completions" {
+		applyStructuredOutputs(c)
+		applyReasoningShims(c)
+		if (azure.AzureOpenAIToolCallValidation != "off" && !isStreamRequest(c)) || azure.CapturesConversations(info.KeyName) {
+			keepRequestBody(c)
+		}
+	}
+
+	if c.Request.URL.Path == "/v1/embeddings" && serveEmbeddingsBatches(c) {
+		return
+	}
 
-	if c.Writer.Header().Get("Content-Type") == "text/event-stream" {
-		if _, err := c.Writer.Write([]byte("\n")); err != nil {
-			log.Printf("rewrite azure response error: %v", err)
+	// Dry runs are answered by the proxy, they are neither cached nor
+	// mirrored.
+	if info.DryRun == "" {
+		if c.Request.URL.Path == "/v1/chat/completions" && !info.LegacyCompletions && serveSemanticCache(c) {
+			return
 		}
+		mirrorRequest(c)
+	}
+
+	stream := isStreamRequest(c)
+	if stream {
+		prepareStreamRequest(c)
+	}
+
+	if azure.AzureOpenAISSEHeartbeatInterval > 0 && stream {
+		heartbeat := azure.NewHeartbeatWriter(c.Writer, azure.AzureOpenAISSEHeartbeatInterval)
+		defer heartbeat.Stop()
+		azureProxy.ServeHTTP(heartbeat, c.Request)
+	} else {
+		azureProxy.ServeHTTP(c.Writer, c.Request)
 	}
 
 	// Enhanced error logging
@@ -181,7 +541,402 @@ func handleAzureProxy(c *gin.Context) {
 	}
 }
 
+// recoverClientAbort handles the http.ErrAbortHandler panic with which the
+// reverse proxy gives up on a client that disconnected mid-response. The
+// upstream request has been cancelled by then, so there is nothing left to do
+// but to skip the stack trace gin would log for it.
+func recoverClientAbort(c *gin.Context) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r != http.ErrAbortHandler {
+		panic(r)
+	}
+	log.Printf("client disconnected: %s %s", c.Request.Method, c.Request.URL.Path)
+	c.Abort()
+}
+
+// applyTokenLimits enforces the per-model token guardrails on chat
+// completions, completions and embeddings requests, aborting the request with
+// an OpenAI style error when they fail.
+func applyTokenLimits(c *gin.Context) bool {
+	if len(azure.AzureOpenAIMaxTokens) == 0 && len(azure.AzureOpenAIMaxInputTokens) == 0 {
+		return true
+	}
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	body, err = azure.ApplyTokenLimits(strings.TrimPrefix(c.Request.URL.Path, "/v1/"), body)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	setRequestBody(c.Request, body)
+	return true
+}
+
+// scrubPII masks PII in the prompts of chat completions, completions and
+// embeddings requests for the models and keys it is enabled for, aborting
+// the request when its body cannot be read.
+func scrubPII(c *gin.Context) bool {
+	switch c.Request.URL.Path {
+	case "/v1/chat/completions", "/v1/completions", "/v1/embeddings":
+	default:
+		return true
+	}
+	if len(azure.AzureOpenAIPIIScrubModels) == 0 && len(azure.AzureOpenAIPIIScrubKeys) == 0 {
+		return true
+	}
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	if !azure.ScrubsPII(gjson.GetBytes(body, "model").String(), c.GetString(virtualKeyContextKey)) {
+		return true
+	}
+	if body, ok := azure.ScrubRequestPII(body); ok {
+		setRequestBody(c.Request, body)
+	}
+	return true
+}
+
+// sampleSchema records the fields of the body of a request sampled for the
+// schema report, as the client sent it, aborting the request when its body
+// cannot be read.
+func sampleSchema(c *gin.Context) bool {
+	if len(azure.AzureOpenAISchemaSampling) == 0 {
+		return true
+	}
+	route := azure.SchemaRoute(c.Request.URL.Path)
+	if !azure.SampleSchema(route) {
+		return true
+	}
+	if c.Request.Body != nil && strings.HasPrefix(c.ContentType(), "application/json") {
+		body, err := readRequestBody(c)
+		if err != nil {
+			abortWithError(c, err)
+			return false
+		}
+		azure.RecordRequestSchema(route, body)
+	}
+	azure.RequestInfoFromContext(c.Request.Context()).SchemaRoute = route
+	return true
+}
+
+// pinSystemPrompt adds the system prompts pinned to the model and client of
+// a chat completions request, aborting the request when its body cannot be
+// read.
+func pinSystemPrompt(c *gin.Context) bool {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	if body, ok := azure.PinSystemPrompt(body, c.GetString(virtualKeyContextKey)); ok {
+		setRequestBody(c.Request, body)
+	}
+	return true
+}
+
+// applyLogprobsCompat adapts the logprobs parameters of a request to the
+// api-version, telling the client about the changes in warning headers. It
+// aborts the request when its body cannot be read.
+func applyLogprobsCompat(c *gin.Context) bool {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	adapted, logprobs, warnings := azure.ApplyLogprobsCompat(c.Request.URL.Path, body)
+	for _, warning := range warnings {
+		c.Writer.Header().Add(azure.ProxyWarningHeader, warning)
+	}
+	azure.RequestInfoFromContext(c.Request.Context()).Logprobs = logprobs
+	if !bytes.Equal(adapted, body) {
+		setRequestBody(c.Request, adapted)
+	}
+	return true
+}
+
+// applyMultimodal checks the audio and image parts of chat completions and
+// sends the request with an api-version that supports them. It reports
+// whether the request may proceed.
+func applyMultimodal(c *gin.Context) bool {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	m, err := azure.ApplyMultimodal(body, MaxInputAudioSize, MaxImageSize)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	for _, warning := range m.Warnings {
+		c.Writer.Header().Add(azure.ProxyWarningHeader, warning)
+	}
+	azure.RequestInfoFromContext(c.Request.Context()).APIVersion = m.APIVersion
+	if !bytes.Equal(m.Body, body) {
+		setRequestBody(c.Request, m.Body)
+	}
+	return true
+}
+
+// applySpeechStreamFormat takes the stream_format parameter out of a speech
+// request, aborting the request when it is invalid or its body cannot be
+// read.
+func applySpeechStreamFormat(c *gin.Context) bool {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return true
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	adapted, sse, err := azure.ApplySpeechStreamFormat(body)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	azure.RequestInfoFromContext(c.Request.Context()).SpeechSSE = sse
+	if !bytes.Equal(adapted, body) {
+		setRequestBody(c.Request, adapted)
+	}
+	return true
+}
+
+// translateExtensionsRequest turns a legacy On Your Data extensions request
+// into a chat completions request with data_sources, aborting the request
+// when its body cannot be read.
+func translateExtensionsRequest(c *gin.Context) bool {
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return false
+	}
+	body, err = azure.TranslateExtensionsRequest(body)
+	if err != nil {
+		abortWithError(c, azure.NewInvalidRequestError("dataSources", "invalid_data_sources", err.Error()))
+		return false
+	}
+	setRequestBody(c.Request, body)
+	c.Request.URL.Path = "/v1/chat/completions"
+	return true
+}
+
+// handleLegacyEndpoint warns about requests to legacy endpoints and sends
+// completions requests for chat models as chat completions, when enabled.
+// It aborts the request when its body cannot be read.
+func handleLegacyEndpoint(c *gin.Context) bool {
+	path := c.Request.URL.Path
+	if path != "/v1/completions" && !strings.HasPrefix(path, "/v1/fine_tunes") {
+		return true
+	}
+	if !azure.AzureOpenAILegacyWarnings && !azure.AzureOpenAITranslateCompletions {
+		return true
+	}
+	var body []byte
+	if path == "/v1/completions" {
+		if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+			return true
+		}
+		var err error
+		if body, err = readRequestBody(c); err != nil {
+			abortWithError(c, err)
+			return false
+		}
+	}
+	legacy := azure.HandleLegacyEndpoint(path, c.GetString(virtualKeyContextKey), body)
+	if legacy == nil {
+		return true
+	}
+	if legacy.Warning != "" {
+		c.Writer.Header().Add("Warning", legacy.Warning)
+	}
+	if legacy.NotTranslated != "" {
+		c.Writer.Header().Add(azure.ProxyWarningHeader, "completions request not translated to chat completions: "+legacy.NotTranslated)
+	}
+	if legacy.Translated {
+		c.Writer.Header().Add(azure.ProxyWarningHeader, "completions request sent to Azure as chat completions")
+		azure.RequestInfoFromContext(c.Request.Context()).LegacyCompletions = true
+		setRequestBody(c.Request, legacy.Body)
+		c.Request.URL.Path = "/v1/chat/completions"
+	}
+	return true
+}
+
+// applyStructuredOutputs downgrades json_schema response formats the
+// deployment cannot serve, telling the client which one was sent.
+func applyStructuredOutputs(c *gin.Context) {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		return
+	}
+	adapted, format := azure.ApplyStructuredOutputs(body)
+	if format != "" {
+		c.Writer.Header().Set(azure.StructuredOutputHeader, format)
+	}
+	if !bytes.Equal(adapted, body) {
+		setRequestBody(c.Request, adapted)
+	}
+}
+
+// applyReasoningShims adapts chat completions requests for reasoning models,
+// telling the client about the parameters dropped in warning headers.
+func applyReasoningShims(c *gin.Context) {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		return
+	}
+	shimmed, warnings := azure.ApplyReasoningShims(body)
+	for _, warning := range warnings {
+		c.Writer.Header().Add(azure.ProxyWarningHeader, warning)
+	}
+	if !bytes.Equal(shimmed, body) {
+		setRequestBody(c.Request, shimmed)
+	}
+}
+
+// keepRequestBody makes the request body available to the response
+// handling, e.g. to validate tool calls against the request's tools.
+func keepRequestBody(c *gin.Context) {
+	if body, err := readRequestBody(c); err == nil {
+		c.Request = c.Request.WithContext(azure.WithRequestBody(c.Request.Context(), body))
+	}
+}
+
+// serveEmbeddingsBatches splits embeddings requests whose input array is
+// larger than Azure accepts into several upstream calls. It reports whether
+// the request was handled.
+func serveEmbeddingsBatches(c *gin.Context) bool {
+	if c.Request.Body == nil {
+		return false
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return true
+	}
+	bodies := azure.SplitEmbeddingsInput(body, azure.AzureOpenAIEmbeddingsBatchSize)
+	if bodies == nil {
+		return false
+	}
+	azure.ServeEmbeddingsBatches(c.Writer, c.Request, bodies)
+	return true
+}
+
+// serveSemanticCache answers chat completions from the semantic cache when
+// enabled. It reports whether the request was handled.
+func serveSemanticCache(c *gin.Context) bool {
+	if !azure.AzureOpenAISemanticCache || c.Request.Body == nil {
+		return false
+	}
+	body, err := readRequestBody(c)
+	if err != nil {
+		abortWithError(c, err)
+		return true
+	}
+	var handled bool
+	c.Request, handled = azure.ServeSemanticCache(c.Writer, c.Request, body)
+	return handled
+}
+
+// mirrorRequest sends a copy of the request to the mirror deployment of its
+// model, if one is configured.
+func mirrorRequest(c *gin.Context) {
+	if len(azure.AzureOpenAIMirrors) == 0 || c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return
+	}
+	if body, err := readRequestBody(c); err == nil {
+		azure.MirrorRequest(c.Request, body)
+	}
+}
+
+// isStreamRequest reports whether the JSON request body asks for an SSE
+// stream.
+func isStreamRequest(c *gin.Context) bool {
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return false
+	}
+	body, err := readRequestBody(c)
+	return err == nil && gjson.GetBytes(body, "stream").Bool()
+}
+
+// prepareStreamRequest keeps the body of a streaming request around so that
+// it can be retried without streaming, and sends it upstream as a
+// non-streaming request right away if the deployment is known not to stream.
+func prepareStreamRequest(c *gin.Context) {
+	body, err := readRequestBody(c)
+	if err != nil {
+		return
+	}
+	// SSE is never compressed, and a plain error body can be inspected.
+	c.Request.Header.Del("Accept-Encoding")
+	c.Request = c.Request.WithContext(azure.WithRequestBody(c.Request.Context(), body))
+
+	if azure.NeedsStreamFallback(gjson.GetBytes(body, "model").String()) {
+		c.Request, body = azure.PrepareStreamFallback(c.Request, body)
+		setRequestBody(c.Request, body)
+	}
+}
+
+// readRequestBody reads the request body and puts it back so that it can
+// still be proxied.
+func readRequestBody(c *gin.Context) ([]byte, error) {
+	body, err := azure.ReadRequestBody(c.Request.Body)
+	if limit, ok := isBodyTooLarge(err); ok {
+		return nil, azure.NewRequestTooLargeError(limit)
+	}
+	if err != nil {
+		return nil, &azure.APIError{StatusCode: http.StatusBadRequest, Message: "failed to read request body", Type: "invalid_request_error"}
+	}
+	setRequestBody(c.Request, body)
+	return body, nil
+}
+
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = azure.NewRequestBody(body)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// abortWithError writes err to the client in the OpenAI error format.
+func abortWithError(c *gin.Context, err error) {
+	apiErr, ok := err.(*azure.APIError)
+	if !ok {
+		apiErr = &azure.APIError{StatusCode: http.StatusInternalServerError, Message: err.Error(), Type: "server_error"}
+	}
+	c.AbortWithStatusJSON(apiErr.StatusCode, gin.H{"error": apiErr})
+}
+
 func handleOpenAIProxy(c *gin.Context) {
-	server := openai.NewOpenAIReverseProxy()
-	server.ServeHTTP(c.Writer, c.Request)
+	openaiProxy.ServeHTTP(c.Writer, c.Request)
 }
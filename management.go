@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// managementServicePath is the path prefix of the Connect management service,
+// see proto/azureoaiproxy/v1/management.proto.
+const managementServicePath = "/azureoaiproxy.v1.ManagementService/"
+
+// connectError is an error in the Connect protocol's JSON format.
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// connectStatus maps Connect error codes to HTTP status codes.
+var connectStatus = map[string]int{
+	"invalid_argument": http.StatusBadRequest,
+	"aborted":          http.StatusConflict,
+	"unimplemented":    http.StatusNotImplemented,
+	"internal":         http.StatusInternalServerError,
+}
+
+func writeConnectError(c *gin.Context, code, message string) {
+	c.AbortWithStatusJSON(connectStatus[code], connectError{Code: code, Message: message})
+}
+
+type backendStatsMessage struct {
+	Name                string                      `json:"name"`
+	Endpoint            string                      `json:"endpoint"`
+	Type                string                      `json:"type"`
+	Available           bool                        `json:"available"`
+	ConsecutiveFailures int                         `json:"consecutiveFailures"`
+	Requests            uint64                      `json:"requests,string"`
+	Errors              uint64                      `json:"errors,string"`
+	Throttled           uint64                      `json:"throttled,string"`
+	AverageLatencyMs    uint64                      `json:"averageLatencyMs,string"`
+	Capacity            []deploymentCapacityMessage `json:"capacity"`
+}
+
+type deploymentCapacityMessage struct {
+	Deployment        string `json:"deployment"`
+	RemainingRequests int    `json:"remainingRequests"`
+	RemainingTokens   int    `json:"remainingTokens,string"`
+	ObserveTime       string `json:"observeTime"`
+}
+
+type setConfigRequest struct {
+	Version         string            `json:"version"`
+	ExpectedVersion string            `json:"expectedVersion"`
+	ModelMapper     map[string]string `json:"modelMapper"`
+}
+
+// handleManagement serves the unary RPCs of the management service with the
+// Connect protocol and the JSON codec.
+func handleManagement(c *gin.Context) {
+	if !strings.HasPrefix(c.ContentType(), "application/json") {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		writeConnectError(c, "invalid_argument", err.Error())
+		return
+	}
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+
+	switch c.Param("method") {
+	case "GetHealth":
+		status := "STATUS_SERVING"
+		available := 0
+		for _, b := range azure.Backends() {
+			if b.Available() {
+				available++
+			}
+		}
+		if available == 0 {
+			status = "STATUS_NOT_SERVING"
+		} else if available < len(azure.Backends()) {
+			status = "STATUS_DEGRADED"
+		}
+		version, _ := azure.ConfigVersion()
+		c.JSON(http.StatusOK, gin.H{"status": status, "configVersion": version})
+	case "GetConfig":
+		version, updated := azure.ConfigVersion()
+		c.JSON(http.StatusOK, gin.H{
+			"version":     version,
+			"updateTime":  updated.UTC().Format(time.RFC3339Nano),
+			"modelMapper": azure.ModelMapper(),
+		})
+	case "GetBackendStats":
+		backends := []backendStatsMessage{}
+		for _, stat := range azure.BackendStats() {
+			capacity := []deploymentCapacityMessage{}
+			for _, c := range stat.Capacity {
+				capacity = append(capacity, deploymentCapacityMessage{
+					Deployment:        c.Deployment,
+					RemainingRequests: c.RemainingRequests,
+					RemainingTokens:   c.RemainingTokens,
+					ObserveTime:       c.Observed.UTC().Format(time.RFC3339Nano),
+				})
+			}
+			backends = append(backends, backendStatsMessage{
+				Name:                stat.Name,
+				Endpoint:            stat.Endpoint,
+				Type:                stat.Type,
+				Available:           stat.Available,
+				ConsecutiveFailures: stat.ConsecutiveFailures,
+				Requests:            stat.Requests,
+				Errors:              stat.Errors,
+				Throttled:           stat.Throttled,
+				AverageLatencyMs:    uint64(stat.AverageLatency.Milliseconds()),
+				Capacity:            capacity,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"backends": backends})
+	case "SetConfig":
+		var req setConfigRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeConnectError(c, "invalid_argument", "invalid SetConfigRequest: "+err.Error())
+			return
+		}
+		if req.Version == "" {
+			writeConnectError(c, "invalid_argument", "version is required")
+			return
+		}
+		if err := azure.SetModelMapper(req.ModelMapper, req.Version, req.ExpectedVersion); err != nil {
+			if errors.Is(err, azure.ErrConfigVersionMismatch) {
+				writeConnectError(c, "aborted", err.Error())
+				return
+			}
+			writeConnectError(c, "internal", err.Error())
+			return
+		}
+		version, updated := azure.ConfigVersion()
+		c.JSON(http.StatusOK, gin.H{"version": version, "updateTime": updated.UTC().Format(time.RFC3339Nano)})
+	default:
+		writeConnectError(c, "unimplemented", "unknown method "+strconv.Quote(c.Param("method")))
+	}
+}
@@ -0,0 +1,395 @@
+package azure
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// BackendProvisioned is a backend with provisioned throughput (PTU).
+	BackendProvisioned = "provisioned"
+	// BackendStandard is a pay-as-you-go backend.
+	BackendStandard = "standard"
+	// BackendMirror only receives requests mirrored with AZURE_OPENAI_MIRROR.
+	BackendMirror = "mirror"
+)
+
+// Backend is an Azure OpenAI resource requests can be routed to.
+type Backend struct {
+	Name     string
+	Endpoint *url.URL
+	// Type is BackendProvisioned or BackendStandard. Provisioned backends are
+	// preferred and requests spill over to the next backend on a 429.
+	Type string
+	// Models restricts the models served by the backend, empty means all.
+	Models map[string]bool
+	// ModelMapper overrides AzureOpenAIModelMapper for this backend.
+	ModelMapper map[string]string
+	// ConnectAddress is the host:port connections to the backend are made
+	// to, e.g. the IP of a Private Endpoint, while the Host header and TLS
+	// server name stay those of Endpoint. Empty resolves the endpoint host.
+	ConnectAddress string
+
+	tokenRef          string
+	secondaryTokenRef string
+	keys              *apiKeys
+	circuit           circuit
+	stats             backendStats
+	latency           latencyWindow
+	discovery         discovery
+}
+
+// backends are the configured backends, in the order they were declared.
+// The whole list is replaced when the configuration is reloaded.
+var backends atomic.Pointer[[]*Backend]
+
+// Backends returns the configured backends, in the order they were declared.
+func Backends() []*Backend {
+	if list := backends.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// loadBackends reads the backends from the environment, exiting when they
+// are invalid.
+func loadBackends() {
+	list, err := parseBackends(AzureOpenAIEndpoint)
+	if err != nil {
+		log.Printf("error parsing %v", err)
+		os.Exit(1)
+	}
+	backends.Store(&list)
+	if AzureOpenAIEndpoint == "" {
+		AzureOpenAIEndpoint = list[0].Endpoint.String()
+	}
+}
+
+// parseBackends reads AZURE_OPENAI_BACKENDS, a comma separated list of
+// backend names each configured with AZURE_OPENAI_BACKEND_<NAME>_* variables.
+// Without it the single backend is endpoint.
+func parseBackends(endpoint string) ([]*Backend, error) {
+	v := os.Getenv("AZURE_OPENAI_BACKENDS")
+	if v == "" {
+		remote, err := parseEndpoint("AZURE_OPENAI_ENDPOINT", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		connectAddress, err := parseConnectAddress("AZURE_OPENAI_CONNECT_ADDRESS")
+		if err != nil {
+			return nil, err
+		}
+		return []*Backend{{
+			Name:              "default",
+			Endpoint:          remote,
+			Type:              BackendStandard,
+			ConnectAddress:    connectAddress,
+			tokenRef:          secretRef("AZURE_OPENAI_TOKEN"),
+			secondaryTokenRef: secretRef("AZURE_OPENAI_TOKEN_SECONDARY"),
+			keys:              defaultKeys,
+		}}, nil
+	}
+
+	var list []*Backend
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		prefix := "AZURE_OPENAI_BACKEND_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		endpoint := os.Getenv(prefix + "ENDPOINT")
+		if endpoint == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_BACKENDS, %sENDPOINT is required", prefix)
+		}
+		remote, err := parseEndpoint(prefix+"ENDPOINT", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		connectAddress, err := parseConnectAddress(prefix + "CONNECT_ADDRESS")
+		if err != nil {
+			return nil, err
+		}
+
+		backend := &Backend{
+			Name:              name,
+			Endpoint:          remote,
+			Type:              BackendStandard,
+			ConnectAddress:    connectAddress,
+			Models:            map[string]bool{},
+			ModelMapper:       map[string]string{},
+			tokenRef:          secretRef(prefix + "TOKEN"),
+			secondaryTokenRef: secretRef(prefix + "TOKEN_SECONDARY"),
+			keys:              &apiKeys{},
+		}
+		if t := os.Getenv(prefix + "TYPE"); t != "" {
+			if t != BackendProvisioned && t != BackendStandard && t != BackendMirror {
+				return nil, fmt.Errorf("%sTYPE, invalid value %s", prefix, t)
+			}
+			backend.Type = t
+		}
+		if models := os.Getenv(prefix + "MODELS"); models != "" {
+			for _, model := range strings.Split(models, ",") {
+				backend.Models[strings.TrimSpace(model)] = true
+			}
+		}
+		if mapper := os.Getenv(prefix + "MODEL_MAPPER"); mapper != "" {
+			if backend.ModelMapper, err = parseKeyValues(prefix+"MODEL_MAPPER", mapper); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, backend)
+		log.Printf("loading azure backend %s: %s (%s)", backend.Name, backend.Endpoint, backend.Type)
+		if backend.ConnectAddress != "" {
+			log.Printf("loading azure backend %s connect address: %s", backend.Name, backend.ConnectAddress)
+		}
+	}
+	return list, nil
+}
+
+func parseConnectAddress(name string) (string, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		return "", fmt.Errorf("%s, invalid value %s, expected host:port", name, v)
+	}
+	return v, nil
+}
+
+// connectAddress returns the address to dial for addr, the host:port of a
+// backend endpoint: its ConnectAddress if it has one, else addr.
+func connectAddress(addr string) string {
+	for _, b := range Backends() {
+		if b.ConnectAddress != "" && endpointAddress(b.Endpoint) == addr {
+			return b.ConnectAddress
+		}
+	}
+	return addr
+}
+
+// endpointAddress returns the host:port the transport dials for endpoint.
+func endpointAddress(endpoint *url.URL) string {
+	port := endpoint.Port()
+	if port == "" {
+		port = "443"
+		if endpoint.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(endpoint.Hostname(), port)
+}
+
+// BackendByName returns the backend called name, or nil.
+func BackendByName(name string) *Backend {
+	for _, b := range Backends() {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func parseEndpoint(name, endpoint string) (*url.URL, error) {
+	remote, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%s, invalid value %s", name, endpoint)
+	}
+	return remote, nil
+}
+
+// Deployment returns the deployment serving model on this backend. Once its
+// deployments were discovered, a mapping to a missing deployment gives way to
+// one that exists for the model.
+func (b *Backend) Deployment(model string) string {
+	if v, ok := b.ModelMapper[model]; ok {
+		return v
+	}
+	mapped := GetDeploymentByModel(model)
+	if deployment, ok, _ := b.discoveredDeployment(model, mapped); ok {
+		return deployment
+	}
+	return mapped
+}
+
+// Serves reports whether the backend serves model. Without a list of models
+// that is every model, or once its deployments were discovered the models it
+// has a deployment for.
+func (b *Backend) Serves(model string) bool {
+	if len(b.Models) > 0 {
+		return b.Models[model]
+	}
+	if _, ok, known := b.discoveredDeployment(model, GetDeploymentByModel(model)); known {
+		return ok
+	}
+	return true
+}
+
+// apiKeys returns the keys of the backend, falling back to AZURE_OPENAI_TOKEN.
+func (b *Backend) apiKeys() *apiKeys {
+	if b.keys.current() != "" {
+		return b.keys
+	}
+	return defaultKeys
+}
+
+// HasAPIKey reports whether requests to the backend use its own API key
+// rather than the client's.
+func (b *Backend) HasAPIKey() bool {
+	return b.apiKeys().current() != ""
+}
+
+// apply points req at the backend.
+func (b *Backend) apply(req *http.Request, info *RequestInfo) {
+	req.Host = b.Endpoint.Host
+	req.URL.Scheme = b.Endpoint.Scheme
+	req.URL.Host = b.Endpoint.Host
+
+	if info.ResourceScoped {
+		req.URL.Path = path.Join("/openai", info.Operation)
+	} else {
+		deployment := info.Deployment
+		if deployment == "" {
+			deployment = b.Deployment(info.Model)
+		}
+		req.URL.Path = path.Join("/openai/deployments", deployment, info.Operation)
+	}
+	req.URL.RawPath = req.URL.EscapedPath()
+
+	switch key := b.apiKeys().current(); {
+	case info.EntraToken != "":
+		req.Header.Del("api-key")
+		req.Header.Set("Authorization", "Bearer "+info.EntraToken)
+	case key != "":
+		req.Header.Set("api-key", key)
+	default:
+		req.Header.Set("api-key", info.ClientKey)
+	}
+	info.Backend = b
+}
+
+// candidateBackends returns the available backends of tenant serving model,
+// provisioned ones first. If none declares the model every backend of the
+// tenant is a candidate.
+func candidateBackends(model string, tenant *Tenant) []*Backend {
+	var provisioned, standard, all []*Backend
+	for _, b := range tenant.backends() {
+		if b.Type == BackendMirror {
+			continue
+		}
+		all = append(all, b)
+		if !b.Serves(model) {
+			continue
+		}
+		if b.Type == BackendProvisioned {
+			provisioned = append(provisioned, b)
+		} else {
+			standard = append(standard, b)
+		}
+	}
+	candidates := append(provisioned, standard...)
+	if len(candidates) == 0 {
+		candidates = all
+	}
+	return availableBackends(candidates)
+}
+
+// availableBackends drops the backends whose circuit is open, unless that
+// leaves none.
+func availableBackends(backends []*Backend) []*Backend {
+	var available []*Backend
+	for _, b := range backends {
+		if b.Available() {
+			available = append(available, b)
+		}
+	}
+	if len(available) == 0 {
+		return backends
+	}
+	return available
+}
+
+// spillover retries a request that was throttled with a 429 on the next
+// candidate backend, so that provisioned capacity is used first and
+// pay-as-you-go backends absorb the overflow. Batch requests are not spilled
+// over, the overflow capacity is kept for interactive ones.
+func spillover(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		info := RequestInfoFromContext(req.Context())
+		if info == nil || len(info.Candidates) < 2 {
+			return next.RoundTrip(req)
+		}
+		replayable, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		if !replayable {
+			return next.RoundTrip(req)
+		}
+
+		start := 0
+		for i, b := range info.Candidates {
+			if b == info.Backend {
+				start = i
+			}
+		}
+		attempt := req
+		for i := start; ; i++ {
+			resp, err := next.RoundTrip(attempt)
+			if err != nil || resp.StatusCode != http.StatusTooManyRequests || i == len(info.Candidates)-1 {
+				return resp, err
+			}
+			if info.Priority == PriorityBatch {
+				shedRequests.Inc(info.Priority, "spillover")
+				return resp, err
+			}
+			resp.Body.Close()
+
+			nextBackend := info.Candidates[i+1]
+			log.Printf("backend %s returned 429 for [%s], spilling over to %s", info.Candidates[i].Name, info.Model, nextBackend.Name)
+			attempt = req.Clone(req.Context())
+			if req.GetBody != nil {
+				attempt.Body, _ = req.GetBody()
+			}
+			nextBackend.apply(attempt, info)
+		}
+	})
+}
+
+// maxReplayBodySize is the largest upload that is buffered so that it can be
+// retried. Larger uploads stream straight to Azure and are not retried.
+const maxReplayBodySize = 32 << 20
+
+// bufferBody reads the request body into memory and sets GetBody so that the
+// request can be sent more than once. It reports false for large uploads,
+// which are left streaming.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true, nil
+	}
+	if isStreamedUpload(req) && (req.ContentLength < 0 || req.ContentLength > maxReplayBodySize) {
+		return false, nil
+	}
+	body, err := ReadRequestBody(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return NewRequestBody(body), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// isStreamedUpload reports whether the request body is a file upload that is
+// streamed to Azure rather than read by the proxy.
+func isStreamedUpload(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "multipart/") || strings.HasPrefix(contentType, "application/octet-stream")
+}
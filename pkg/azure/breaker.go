@@ -0,0 +1,86 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// AzureOpenAICircuitBreakerThreshold is the number of consecutive failed
+	// requests, 5xx responses or connection errors, after which a backend is
+	// taken out of rotation. Zero disables the circuit breaker.
+	AzureOpenAICircuitBreakerThreshold = 0
+	// AzureOpenAICircuitBreakerCooldown is how long an open circuit keeps the
+	// backend out of rotation before requests are tried again.
+	AzureOpenAICircuitBreakerCooldown = 30 * time.Second
+)
+
+func init() {
+	AzureOpenAICircuitBreakerThreshold = envInt("AZURE_OPENAI_CIRCUIT_BREAKER_THRESHOLD", AzureOpenAICircuitBreakerThreshold)
+	AzureOpenAICircuitBreakerCooldown = envDuration("AZURE_OPENAI_CIRCUIT_BREAKER_COOLDOWN", AzureOpenAICircuitBreakerCooldown)
+	if AzureOpenAICircuitBreakerThreshold > 0 {
+		log.Printf("loading azure circuit breaker: %d failures, cooldown %s", AzureOpenAICircuitBreakerThreshold, AzureOpenAICircuitBreakerCooldown)
+	}
+}
+
+// circuit tracks the consecutive failures of a backend.
+type circuit struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// Available reports whether the circuit of the backend lets requests
+// through. After the cooldown requests are let through again and the first
+// success closes the circuit.
+func (b *Backend) Available() bool {
+	b.circuit.mu.Lock()
+	defer b.circuit.mu.Unlock()
+	return !time.Now().Before(b.circuit.openUntil)
+}
+
+func (b *Backend) recordResult(failed bool) {
+	if AzureOpenAICircuitBreakerThreshold == 0 {
+		return
+	}
+	c := &b.circuit
+	c.mu.Lock()
+	if !failed {
+		c.failures = 0
+		c.mu.Unlock()
+		return
+	}
+	c.failures++
+	if c.failures < AzureOpenAICircuitBreakerThreshold || time.Now().Before(c.openUntil) {
+		c.mu.Unlock()
+		return
+	}
+	c.openUntil = time.Now().Add(AzureOpenAICircuitBreakerCooldown)
+	failures := c.failures
+	c.mu.Unlock()
+
+	Emit(Event{
+		Type:    EventCircuitOpen,
+		Subject: b.Name,
+		Message: fmt.Sprintf("backend %s failed %d times in a row, taking it out of rotation for %s", b.Name, failures, AzureOpenAICircuitBreakerCooldown),
+		Details: map[string]any{"backend": b.Name, "failures": failures},
+	})
+}
+
+// breaker records the outcome of every attempt on the backend it was sent to.
+func breaker(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+		if err != nil && (isClientCancel(req, err) || hedgeLost(req)) {
+			// Not the backend's fault.
+			return resp, err
+		}
+		if info := RequestInfoFromContext(req.Context()); info != nil && info.Backend != nil {
+			info.Backend.recordResult(err != nil || resp.StatusCode >= http.StatusInternalServerError)
+		}
+		return resp, err
+	})
+}
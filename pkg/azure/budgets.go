@@ -0,0 +1,309 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// Price is the cost of a model in US dollars per million tokens.
+type Price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// Cost returns the cost of usage at this price.
+func (p Price) Cost(usage Usage) float64 {
+	return (float64(usage.PromptTokens)*p.Input + float64(usage.CompletionTokens)*p.Output) / 1e6
+}
+
+// Budget is the spend of a virtual key in the current day and month, in UTC,
+// against its caps. A zero limit means no cap.
+type Budget struct {
+	Key          string  `json:"key"`
+	Day          string  `json:"day"`
+	DailySpend   float64 `json:"daily_spend"`
+	DailyLimit   float64 `json:"daily_limit"`
+	Month        string  `json:"month"`
+	MonthlySpend float64 `json:"monthly_spend"`
+	MonthlyLimit float64 `json:"monthly_limit"`
+}
+
+var (
+	// AzureOpenAIModelPrices maps models or deployments to their price, "*"
+	// applies to models without their own entry.
+	AzureOpenAIModelPrices = map[string]Price{}
+	// AzureOpenAIDailyBudgets and AzureOpenAIMonthlyBudgets map virtual key
+	// names to their spend cap in US dollars, "*" applies to every other key.
+	AzureOpenAIDailyBudgets   = map[string]float64{}
+	AzureOpenAIMonthlyBudgets = map[string]float64{}
+	// AzureOpenAIBudgetsFile persists the spend across restarts when set.
+	AzureOpenAIBudgetsFile = ""
+
+	budgetsMu    sync.Mutex
+	budgets      = map[string]*Budget{}
+	budgetsDirty bool
+
+	spendTotal = metrics.NewCounter("azure_oai_proxy_spend_usd_total",
+		"Estimated spend in US dollars, by virtual key and model.", "key", "model")
+)
+
+// budgetsSaveInterval is how often changed spend is written to the file.
+const budgetsSaveInterval = 10 * time.Second
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_MODEL_PRICES"); v != "" {
+		for model, price := range parseKeyValueList("AZURE_OPENAI_MODEL_PRICES", v) {
+			input, output, _ := strings.Cut(price, ":")
+			in, err1 := strconv.ParseFloat(input, 64)
+			out, err2 := strconv.ParseFloat(output, 64)
+			if err1 != nil || err2 != nil || in < 0 || out < 0 {
+				log.Printf("error parsing AZURE_OPENAI_MODEL_PRICES, invalid value %s=%s", model, price)
+				os.Exit(1)
+			}
+			AzureOpenAIModelPrices[model] = Price{Input: in, Output: out}
+			log.Printf("loading azure model price: %s -> $%g/$%g per 1M tokens", model, in, out)
+		}
+	}
+	AzureOpenAIDailyBudgets = parseBudgets("AZURE_OPENAI_PROXY_DAILY_BUDGETS")
+	AzureOpenAIMonthlyBudgets = parseBudgets("AZURE_OPENAI_PROXY_MONTHLY_BUDGETS")
+	if len(AzureOpenAIModelPrices) == 0 {
+		if BudgetsEnabled() {
+			log.Printf("error loading budgets: AZURE_OPENAI_MODEL_PRICES is required to enforce budgets")
+			os.Exit(1)
+		}
+		return
+	}
+	onUsage(chargeBudget)
+
+	if v := os.Getenv("AZURE_OPENAI_PROXY_BUDGETS_FILE"); v != "" {
+		AzureOpenAIBudgetsFile = v
+		if err := loadBudgets(); err != nil {
+			log.Printf("error loading budgets from %s: %v", v, err)
+			os.Exit(1)
+		}
+		go saveBudgets()
+	}
+}
+
+func parseBudgets(name string) map[string]float64 {
+	limits := map[string]float64{}
+	v := os.Getenv(name)
+	if v == "" {
+		return limits
+	}
+	for key, value := range parseKeyValueList(name, v) {
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit < 0 {
+			log.Printf("error parsing %s, invalid value %s=%s", name, key, value)
+			os.Exit(1)
+		}
+		limits[key] = limit
+		log.Printf("loading azure budget %s: %s -> $%g", name, key, limit)
+	}
+	return limits
+}
+
+func lookupPrice(model string) (Price, bool) {
+	if price, ok := AzureOpenAIModelPrices[model]; ok {
+		return price, true
+	}
+	if price, ok := AzureOpenAIModelPrices[GetDeploymentByModel(model)]; ok {
+		return price, true
+	}
+	price, ok := AzureOpenAIModelPrices["*"]
+	return price, ok
+}
+
+func lookupBudget(limits map[string]float64, key string) float64 {
+	if limit, ok := limits[key]; ok {
+		return limit
+	}
+	return limits["*"]
+}
+
+// BudgetsEnabled reports whether spend caps are configured.
+func BudgetsEnabled() bool {
+	return len(AzureOpenAIDailyBudgets) > 0 || len(AzureOpenAIMonthlyBudgets) > 0
+}
+
+// budget returns the up to date budget of key. budgetsMu must be held.
+func budget(key string, now time.Time) *Budget {
+	b, ok := budgets[key]
+	if !ok {
+		b = &Budget{Key: key}
+		budgets[key] = b
+	}
+	if day := now.Format("2006-01-02"); b.Day != day {
+		b.Day, b.DailySpend = day, 0
+	}
+	if month := now.Format("2006-01"); b.Month != month {
+		b.Month, b.MonthlySpend = month, 0
+	}
+	b.DailyLimit = lookupBudget(AzureOpenAIDailyBudgets, key)
+	b.MonthlyLimit = lookupBudget(AzureOpenAIMonthlyBudgets, key)
+	return b
+}
+
+// CheckBudget returns a 429 error when the virtual key named key has spent
+// its daily or monthly budget.
+func CheckBudget(key string) *APIError {
+	if key == "" || !BudgetsEnabled() {
+		return nil
+	}
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+	b := budget(key, time.Now().UTC())
+	var period string
+	var spend, limit float64
+	switch {
+	case b.DailyLimit > 0 && b.DailySpend >= b.DailyLimit:
+		period, spend, limit = "daily", b.DailySpend, b.DailyLimit
+	case b.MonthlyLimit > 0 && b.MonthlySpend >= b.MonthlyLimit:
+		period, spend, limit = "monthly", b.MonthlySpend, b.MonthlyLimit
+	default:
+		return nil
+	}
+	return &APIError{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    fmt.Sprintf("The %s budget of %s for key %s is exhausted (spent %s). Contact the proxy administrator to raise it.", period, formatUSD(limit), key, formatUSD(spend)),
+		Type:       "insufficient_quota",
+		Code:       "budget_exceeded",
+	}
+}
+
+func chargeBudget(info *RequestInfo, usage Usage) {
+	price, ok := lookupPrice(info.Model)
+	if !ok {
+		return
+	}
+	cost := price.Cost(usage)
+	spendTotal.Add(cost, info.KeyName, info.Model)
+	if info.KeyName == "" || !BudgetsEnabled() {
+		return
+	}
+	budgetsMu.Lock()
+	b := budget(info.KeyName, time.Now().UTC())
+	var exceeded []Event
+	for _, p := range []struct {
+		period       string
+		spend, limit *float64
+	}{{"daily", &b.DailySpend, &b.DailyLimit}, {"monthly", &b.MonthlySpend, &b.MonthlyLimit}} {
+		before := *p.spend
+		*p.spend += cost
+		// The event is sent once per period, by the request that crosses
+		// the cap.
+		if *p.limit > 0 && before < *p.limit && *p.spend >= *p.limit {
+			exceeded = append(exceeded, Event{
+				Type:    EventBudgetExceeded,
+				Subject: info.KeyName,
+				Message: fmt.Sprintf("key %s exhausted its %s budget of %s", info.KeyName, p.period, formatUSD(*p.limit)),
+				Details: map[string]any{"key": info.KeyName, "period": p.period, "spend": *p.spend, "limit": *p.limit},
+			})
+		}
+	}
+	budgetsDirty = true
+	budgetsMu.Unlock()
+	for _, event := range exceeded {
+		Emit(event)
+	}
+}
+
+// Budgets returns the budgets of every configured and every seen key.
+func Budgets() []Budget {
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+	now := time.Now().UTC()
+	for _, limits := range []map[string]float64{AzureOpenAIDailyBudgets, AzureOpenAIMonthlyBudgets} {
+		for key := range limits {
+			if key != "*" {
+				budget(key, now)
+			}
+		}
+	}
+	list := make([]Budget, 0, len(budgets))
+	for key := range budgets {
+		list = append(list, *budget(key, now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// ResetBudget clears the spend of key for period, "daily", "monthly" or ""
+// for both.
+func ResetBudget(key, period string) error {
+	if period != "" && period != "daily" && period != "monthly" {
+		return NewInvalidRequestError("period", "invalid_period", fmt.Sprintf("Invalid period %q, expected daily or monthly.", period))
+	}
+	budgetsMu.Lock()
+	defer budgetsMu.Unlock()
+	b := budget(key, time.Now().UTC())
+	if period != "monthly" {
+		b.DailySpend = 0
+	}
+	if period != "daily" {
+		b.MonthlySpend = 0
+	}
+	budgetsDirty = true
+	log.Printf("reset %s budget of key %s", strings.TrimSpace(period+" "), key)
+	return nil
+}
+
+func loadBudgets() error {
+	data, err := os.ReadFile(AzureOpenAIBudgetsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*Budget
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, b := range list {
+		budgets[b.Key] = b
+	}
+	return nil
+}
+
+func saveBudgets() {
+	for range time.Tick(budgetsSaveInterval) {
+		budgetsMu.Lock()
+		if !budgetsDirty {
+			budgetsMu.Unlock()
+			continue
+		}
+		list := make([]*Budget, 0, len(budgets))
+		for _, b := range budgets {
+			list = append(list, b)
+		}
+		data, err := json.MarshalIndent(list, "", "  ")
+		budgetsDirty = false
+		budgetsMu.Unlock()
+
+		if err == nil {
+			tmp := AzureOpenAIBudgetsFile + ".tmp"
+			if err = os.WriteFile(tmp, data, 0o600); err == nil {
+				err = os.Rename(tmp, AzureOpenAIBudgetsFile)
+			}
+		}
+		if err != nil {
+			log.Printf("error saving budgets to %s: %v", AzureOpenAIBudgetsFile, err)
+		}
+	}
+}
+
+// formatUSD formats an amount in US dollars for errors and logs.
+func formatUSD(amount float64) string {
+	return "$" + strconv.FormatFloat(amount, 'f', 2, 64)
+}
@@ -0,0 +1,56 @@
+package azure
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CanaryRoute sends Percent of the requests for a model to Deployment.
+type CanaryRoute struct {
+	Deployment string  `json:"deployment"`
+	Percent    float64 `json:"percent"`
+}
+
+// AzureOpenAICanaries maps models to their canary route.
+var AzureOpenAICanaries = map[string]CanaryRoute{}
+
+func init() {
+	v := os.Getenv("AZURE_OPENAI_CANARY")
+	if v == "" {
+		return
+	}
+	for model, route := range parseKeyValueList("AZURE_OPENAI_CANARY", v) {
+		deployment, percent, ok := strings.Cut(route, ":")
+		p, err := strconv.ParseFloat(percent, 64)
+		if !ok || deployment == "" || err != nil || p < 0 || p > 100 {
+			log.Printf("error parsing AZURE_OPENAI_CANARY, invalid value %s=%s", model, route)
+			os.Exit(1)
+		}
+		AzureOpenAICanaries[model] = CanaryRoute{Deployment: deployment, Percent: p}
+		log.Printf("loading azure canary: %.2f%% of %s -> %s", p, model, deployment)
+	}
+}
+
+// pickCanary decides whether a request for model takes the canary route and
+// returns the canary deployment if so. Requests of the same session always
+// take the same route.
+func pickCanary(model, session string) (string, bool) {
+	route, ok := AzureOpenAICanaries[model]
+	if !ok {
+		return "", false
+	}
+	roll := rand.Float64()
+	if session != "" {
+		roll = sessionFraction(session, model)
+	}
+	canary := roll*100 < route.Percent
+	if canary {
+		canaryRequests.Inc(model, route.Deployment, "canary")
+		return route.Deployment, true
+	}
+	canaryRequests.Inc(model, GetDeploymentByModel(model), "stable")
+	return "", false
+}
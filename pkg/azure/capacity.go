@@ -0,0 +1,151 @@
+package azure
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	// AzureOpenAICapacityRouting orders the candidate backends of a request
+	// by the quota their deployment has left, as Azure last reported it.
+	AzureOpenAICapacityRouting = false
+	// AzureOpenAICapacityTTL is how long the quota Azure reported is trusted.
+	AzureOpenAICapacityTTL = 30 * time.Second
+
+	capacityMu sync.Mutex
+	// capacities are the quotas last reported by Azure, by backend and
+	// deployment.
+	capacities = map[string]map[string]DeploymentCapacity{}
+
+	remainingRequests = metrics.NewGauge("azure_oai_proxy_deployment_remaining_requests",
+		"Requests left in the quota of a deployment, as last reported by Azure.", "backend", "deployment")
+	remainingTokens = metrics.NewGauge("azure_oai_proxy_deployment_remaining_tokens",
+		"Tokens left in the quota of a deployment, as last reported by Azure.", "backend", "deployment")
+	capacityRouted = metrics.NewCounter("azure_oai_proxy_capacity_routed_total",
+		"Requests moved off a backend whose deployment had too little quota left, by backend.", "backend")
+)
+
+func init() {
+	AzureOpenAICapacityRouting = envBool("AZURE_OPENAI_CAPACITY_ROUTING", AzureOpenAICapacityRouting)
+	AzureOpenAICapacityTTL = envDuration("AZURE_OPENAI_CAPACITY_TTL", AzureOpenAICapacityTTL)
+	if AzureOpenAICapacityRouting {
+		log.Printf("loading azure capacity routing: remaining quota trusted for %s", AzureOpenAICapacityTTL)
+	}
+}
+
+// DeploymentCapacity is the quota a deployment of a backend has left, from
+// the x-ratelimit-remaining headers of its last response. A count of -1 was
+// not reported.
+type DeploymentCapacity struct {
+	Deployment        string    `json:"deployment"`
+	RemainingRequests int       `json:"remaining_requests"`
+	RemainingTokens   int       `json:"remaining_tokens"`
+	Observed          time.Time `json:"observed"`
+}
+
+// recordCapacity keeps the quota left that Azure reports in the headers of
+// a response.
+func recordCapacity(backend, deployment string, h http.Header) {
+	if deployment == "" {
+		return
+	}
+	c := DeploymentCapacity{Deployment: deployment, RemainingRequests: -1, RemainingTokens: -1, Observed: time.Now()}
+	if n, err := strconv.Atoi(h.Get("x-ratelimit-remaining-requests")); err == nil {
+		c.RemainingRequests = n
+		remainingRequests.Set(float64(n), backend, deployment)
+	}
+	if n, err := strconv.Atoi(h.Get("x-ratelimit-remaining-tokens")); err == nil {
+		c.RemainingTokens = n
+		remainingTokens.Set(float64(n), backend, deployment)
+	}
+	if c.RemainingRequests < 0 && c.RemainingTokens < 0 {
+		return
+	}
+	capacityMu.Lock()
+	if capacities[backend] == nil {
+		capacities[backend] = map[string]DeploymentCapacity{}
+	}
+	capacities[backend][deployment] = c
+	capacityMu.Unlock()
+}
+
+// lookupCapacity returns the quota the deployment of a backend has left,
+// false when Azure has not reported it within AzureOpenAICapacityTTL.
+func lookupCapacity(backend, deployment string) (DeploymentCapacity, bool) {
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	c, ok := capacities[backend][deployment]
+	if !ok || time.Since(c.Observed) > AzureOpenAICapacityTTL {
+		return DeploymentCapacity{}, false
+	}
+	return c, true
+}
+
+// backendCapacities returns the quotas last reported for the deployments of
+// backend, by deployment.
+func backendCapacities(backend string) []DeploymentCapacity {
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	var list []DeploymentCapacity
+	for _, c := range capacities[backend] {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Deployment < list[j].Deployment })
+	return list
+}
+
+// orderByCapacity moves the backends whose deployment has too little quota
+// left for a request of tokens to the end, since Azure would throttle it.
+// With reorder set the other backends of each type are also ordered by the
+// tokens they have left, most first, backends not reported recently first so
+// that they are measured. Provisioned backends still come first.
+func orderByCapacity(backends []*Backend, info *RequestInfo, tokens float64, reorder bool) []*Backend {
+	if !AzureOpenAICapacityRouting || len(backends) < 2 {
+		return backends
+	}
+	type score struct {
+		exhausted bool
+		remaining int
+	}
+	scores := make(map[*Backend]score, len(backends))
+	for _, b := range backends {
+		deployment := info.Deployment
+		if deployment == "" {
+			deployment = b.Deployment(info.Model)
+		}
+		s := score{remaining: math.MaxInt}
+		if c, ok := lookupCapacity(b.Name, deployment); ok {
+			s.exhausted = c.RemainingRequests == 0 || (c.RemainingTokens >= 0 && float64(c.RemainingTokens) < tokens)
+			if c.RemainingTokens >= 0 {
+				s.remaining = c.RemainingTokens
+			}
+		}
+		scores[b] = s
+	}
+	ordered := append([]*Backend(nil), backends...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := scores[ordered[i]], scores[ordered[j]]
+		if a.exhausted != b.exhausted {
+			return b.exhausted
+		}
+		if !reorder {
+			return false
+		}
+		if pi, pj := ordered[i].Type == BackendProvisioned, ordered[j].Type == BackendProvisioned; pi != pj {
+			return pi
+		}
+		return a.remaining > b.remaining
+	})
+	if ordered[0] != backends[0] && scores[backends[0]].exhausted {
+		log.Printf("capacity routing: deployment of backend %s is low on quota [%s], preferring %s", backends[0].Name, info.Model, ordered[0].Name)
+		capacityRouted.Inc(backends[0].Name)
+	}
+	return ordered
+}
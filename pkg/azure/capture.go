@@ -0,0 +1,347 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// captureDayLayout names the capture files, one per virtual key and day in
+// UTC.
+const captureDayLayout = "2006-01-02"
+
+var (
+	// AzureOpenAICaptureKeys are the virtual keys whose chat completions are
+	// captured, "*" captures every key.
+	AzureOpenAICaptureKeys = map[string]bool{}
+	// AzureOpenAICaptureDir is the directory the captured conversations are
+	// written to.
+	AzureOpenAICaptureDir = ""
+	// AzureOpenAICaptureRetention is how long captures are kept, zero keeps
+	// them forever.
+	AzureOpenAICaptureRetention time.Duration
+
+	captureMu sync.Mutex
+
+	// captureFileName keeps key names from escaping the capture directory.
+	captureFileName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+func init() {
+	v := os.Getenv("AZURE_OPENAI_PROXY_CAPTURE_KEYS")
+	if v == "" {
+		return
+	}
+	for _, key := range SplitList(v) {
+		AzureOpenAICaptureKeys[key] = true
+	}
+	AzureOpenAICaptureDir = os.Getenv("AZURE_OPENAI_PROXY_CAPTURE_DIR")
+	if AzureOpenAICaptureDir == "" {
+		log.Printf("error parsing AZURE_OPENAI_PROXY_CAPTURE_KEYS, AZURE_OPENAI_PROXY_CAPTURE_DIR is required")
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(AzureOpenAICaptureDir, 0o700); err != nil {
+		log.Printf("error creating capture directory %s: %v", AzureOpenAICaptureDir, err)
+		os.Exit(1)
+	}
+	AzureOpenAICaptureRetention = envDuration("AZURE_OPENAI_PROXY_CAPTURE_RETENTION", 0)
+	log.Printf("loading azure conversation capture: keys %s to %s, retention %s", v, AzureOpenAICaptureDir, AzureOpenAICaptureRetention)
+	if AzureOpenAICaptureRetention > 0 {
+		go pruneCaptures()
+	}
+}
+
+// CapturesConversations reports whether the chat completions of the virtual
+// key keyName are captured.
+func CapturesConversations(keyName string) bool {
+	return AzureOpenAICaptureKeys["*"] || (keyName != "" && AzureOpenAICaptureKeys[keyName])
+}
+
+// captureConversation captures the conversation of a successful chat
+// completion of a captured key: the request messages and the first choice of
+// the response, from its body or the events of its stream.
+func captureConversation(res *http.Response) error {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || info.Operation != "chat/completions" || info.DryRun != "" || res.StatusCode != http.StatusOK ||
+		!CapturesConversations(info.KeyName) {
+		return nil
+	}
+	body := requestBodyFromContext(res.Request.Context())
+	if !gjson.GetBytes(body, "messages").IsArray() {
+		return nil
+	}
+	capture := &captureStage{info: info, requestBody: body, session: requestSession(res.Request, body)}
+	if isEventStream(res) {
+		AddStreamStage(res, capture)
+		return nil
+	}
+	return rewriteResponseEvents(res, func(body []byte) []byte {
+		choice := gjson.GetBytes(body, "choices.0")
+		message := []byte(choice.Get("message").Raw)
+		if len(message) > 0 {
+			message, _ = sjson.DeleteBytes(message, "content_filter_results")
+			message, _ = sjson.DeleteBytes(message, "context")
+			capture.write(message, choice.Get("finish_reason").String())
+		}
+		return body
+	})
+}
+
+// captureStage assembles the assistant message of the first choice of a
+// stream, and captures it when the stream ends.
+type captureStage struct {
+	info        *RequestInfo
+	requestBody []byte
+	session     string
+
+	content      strings.Builder
+	toolCalls    []map[string]any
+	finishReason string
+}
+
+func (s *captureStage) Event(data []byte) [][]byte {
+	for _, choice := range gjson.GetBytes(data, "choices").Array() {
+		if choice.Get("index").Int() != 0 {
+			continue
+		}
+		if reason := choice.Get("finish_reason").String(); reason != "" {
+			s.finishReason = reason
+		}
+		s.content.WriteString(choice.Get("delta.content").String())
+		for _, call := range choice.Get("delta.tool_calls").Array() {
+			i := int(call.Get("index").Int())
+			for len(s.toolCalls) <= i {
+				s.toolCalls = append(s.toolCalls, map[string]any{"type": "function", "function": map[string]any{"name": "", "arguments": ""}})
+			}
+			toolCall := s.toolCalls[i]
+			if id := call.Get("id").String(); id != "" {
+				toolCall["id"] = id
+			}
+			function := toolCall["function"].(map[string]any)
+			function["name"] = function["name"].(string) + call.Get("function.name").String()
+			function["arguments"] = function["arguments"].(string) + call.Get("function.arguments").String()
+		}
+	}
+	return [][]byte{data}
+}
+
+func (s *captureStage) End() [][]byte {
+	message := map[string]any{"role": "assistant", "content": s.content.String()}
+	if len(s.toolCalls) > 0 {
+		message["tool_calls"] = s.toolCalls
+		if s.content.Len() == 0 {
+			message["content"] = nil
+		}
+	}
+	raw, _ := json.Marshal(message)
+	s.write(raw, s.finishReason)
+	return nil
+}
+
+// write appends the conversation to the capture file of the key, in the
+// fine-tuning chat format with the request's tools, and a metadata object.
+// Responses cut short by the length limit or the content filter are not
+// captured, they make poor examples.
+func (s *captureStage) write(message []byte, finishReason string) {
+	if finishReason != "stop" && finishReason != "tool_calls" {
+		return
+	}
+	if ScrubsPII(s.info.Model, s.info.KeyName) {
+		if content := gjson.GetBytes(message, "content"); content.Type == gjson.String {
+			scrubbed, _ := ScrubPII(content.String())
+			message, _ = sjson.SetBytes(message, "content", scrubbed)
+		}
+	}
+
+	var compact bytes.Buffer
+	if json.Compact(&compact, message) == nil {
+		message = compact.Bytes()
+	}
+	messages := []byte("[")
+	for _, m := range gjson.GetBytes(s.requestBody, "messages").Array() {
+		messages = append(append(messages, m.Raw...), ',')
+	}
+	messages = append(append(messages, message...), ']')
+	line, _ := sjson.SetRawBytes([]byte(`{}`), "messages", messages)
+	for _, field := range []string{"tools", "parallel_tool_calls"} {
+		if v := gjson.GetBytes(s.requestBody, field); v.Exists() {
+			line, _ = sjson.SetRawBytes(line, field, []byte(v.Raw))
+		}
+	}
+	now := time.Now().UTC()
+	metadata, _ := json.Marshal(map[string]string{
+		"time":    now.Format(time.RFC3339),
+		"key":     s.info.KeyName,
+		"model":   s.info.Model,
+		"session": s.session,
+	})
+	line, _ = sjson.SetRawBytes(line, "metadata", metadata)
+
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	dir := filepath.Join(AzureOpenAICaptureDir, captureKeyDir(s.info.KeyName))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("error capturing conversation: %v", err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(dir, now.Format(captureDayLayout)+".jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Printf("error capturing conversation: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("error capturing conversation: %v", err)
+	}
+}
+
+// captureKeyDir is the directory of the captures of a virtual key.
+func captureKeyDir(keyName string) string {
+	if keyName == "" {
+		return "_default"
+	}
+	return captureFileName.ReplaceAllString(keyName, "_")
+}
+
+// pruneCaptures deletes the capture files older than the retention, every
+// hour.
+func pruneCaptures() {
+	for ; ; time.Sleep(time.Hour) {
+		cutoff := time.Now().UTC().Add(-AzureOpenAICaptureRetention).Format(captureDayLayout)
+		files, _ := filepath.Glob(filepath.Join(AzureOpenAICaptureDir, "*", "*.jsonl"))
+		for _, file := range files {
+			if strings.TrimSuffix(filepath.Base(file), ".jsonl") < cutoff {
+				if err := os.Remove(file); err != nil {
+					log.Printf("error pruning captures: %v", err)
+				} else {
+					log.Printf("pruned captures %s", file)
+				}
+			}
+		}
+	}
+}
+
+// CaptureFilter selects the captures to export, zero fields match
+// everything.
+type CaptureFilter struct {
+	Key   string
+	Since time.Time
+	Until time.Time
+	// Metadata keeps the metadata object of every example.
+	Metadata bool
+}
+
+// ExportCaptures writes the captured conversations selected by f to w as
+// JSONL in the fine-tuning chat format, oldest first. The conversations of a
+// session that a later one of the same session continues are left out, so
+// that every session gives a single example with all of its turns.
+func ExportCaptures(w io.Writer, f CaptureFilter) error {
+	pattern := filepath.Join(AzureOpenAICaptureDir, "*", "*.jsonl")
+	if f.Key != "" {
+		pattern = filepath.Join(AzureOpenAICaptureDir, captureKeyDir(f.Key), "*.jsonl")
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+
+	captureMu.Lock()
+	var lines [][]byte
+	for _, file := range files {
+		day := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		if (!f.Since.IsZero() && day < f.Since.UTC().Format(captureDayLayout)) ||
+			(!f.Until.IsZero() && day > f.Until.UTC().Format(captureDayLayout)) {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			captureMu.Unlock()
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			t, _ := time.Parse(time.RFC3339, gjson.GetBytes(scanner.Bytes(), "metadata.time").String())
+			if (!f.Since.IsZero() && t.Before(f.Since)) || (!f.Until.IsZero() && t.After(f.Until)) {
+				continue
+			}
+			lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		}
+	}
+	captureMu.Unlock()
+	sort.SliceStable(lines, func(i, j int) bool {
+		return gjson.GetBytes(lines[i], "metadata.time").String() < gjson.GetBytes(lines[j], "metadata.time").String()
+	})
+
+	// The latest conversation of each session, by key and session.
+	continued := make([]bool, len(lines))
+	latest := map[string]int{}
+	for i, line := range lines {
+		session := gjson.GetBytes(line, "metadata.session").String()
+		if session == "" {
+			continue
+		}
+		id := gjson.GetBytes(line, "metadata.key").String() + "\x00" + session
+		if j, ok := latest[id]; ok && continuesConversation(lines[j], line) {
+			continued[j] = true
+		}
+		latest[id] = i
+	}
+
+	out := bufio.NewWriter(w)
+	for i, line := range lines {
+		if continued[i] {
+			continue
+		}
+		if !f.Metadata {
+			line, _ = sjson.DeleteBytes(line, "metadata")
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	return out.Flush()
+}
+
+// continuesConversation reports whether the messages of next start with all
+// the messages of prev.
+func continuesConversation(prev, next []byte) bool {
+	a := gjson.GetBytes(prev, "messages").Array()
+	b := gjson.GetBytes(next, "messages").Array()
+	if len(a) >= len(b) {
+		return false
+	}
+	for i := range a {
+		if !jsonEqual(a[i].Raw, b[i].Raw) {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonEqual compares two JSON values regardless of formatting and key order.
+func jsonEqual(a, b string) bool {
+	if a == b {
+		return true
+	}
+	var va, vb any
+	if json.Unmarshal([]byte(a), &va) != nil || json.Unmarshal([]byte(b), &vb) != nil {
+		return false
+	}
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+	return bytes.Equal(ja, jb)
+}
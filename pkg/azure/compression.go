@@ -0,0 +1,115 @@
+package azure
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// AzureOpenAIGzipResponses compresses non-streaming JSON responses for
+	// clients that accept gzip, when Azure sent them uncompressed.
+	AzureOpenAIGzipResponses = false
+	// AzureOpenAIGzipMinSize is the smallest response body in bytes that is
+	// compressed.
+	AzureOpenAIGzipMinSize = 1024
+)
+
+func init() {
+	AzureOpenAIGzipResponses = envBool("AZURE_OPENAI_GZIP_RESPONSES", AzureOpenAIGzipResponses)
+	AzureOpenAIGzipMinSize = envInt("AZURE_OPENAI_GZIP_MIN_SIZE", AzureOpenAIGzipMinSize)
+	if AzureOpenAIGzipResponses {
+		log.Printf("loading azure gzip responses: min size %d bytes", AzureOpenAIGzipMinSize)
+	}
+}
+
+// decodeResponseBody replaces a gzip or deflate encoded response body with
+// the decoded one, so that the proxy can inspect or rewrite it, and removes
+// the headers that no longer describe the body.
+func decodeResponseBody(res *http.Response) error {
+	var body io.ReadCloser
+	switch strings.ToLower(res.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return err
+		}
+		body = zr
+	case "deflate":
+		body = flate.NewReader(res.Body)
+	default:
+		return nil
+	}
+
+	decoded, err := io.ReadAll(body)
+	body.Close()
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(decoded))
+	res.ContentLength = int64(len(decoded))
+	res.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+	res.Header.Del("Content-Encoding")
+	res.Uncompressed = true
+	return nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// shouldGzip reports whether a JSON body of size bytes is worth compressing
+// for a client sending acceptEncoding.
+func shouldGzip(header http.Header, acceptEncoding string, size int) bool {
+	return AzureOpenAIGzipResponses &&
+		size >= AzureOpenAIGzipMinSize &&
+		header.Get("Content-Encoding") == "" &&
+		strings.HasPrefix(header.Get("Content-Type"), "application/json") &&
+		acceptsGzip(acceptEncoding)
+}
+
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// compressResponse gzips a non-streaming JSON response toward the client.
+// acceptEncoding is the Accept-Encoding header the client sent.
+func compressResponse(res *http.Response, acceptEncoding string) error {
+	if res.ContentLength >= 0 && res.ContentLength < int64(AzureOpenAIGzipMinSize) {
+		return nil
+	}
+	if !shouldGzip(res.Header, acceptEncoding, AzureOpenAIGzipMinSize) {
+		return nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) >= AzureOpenAIGzipMinSize {
+		body = gzipBytes(body)
+		res.Header.Set("Content-Encoding", "gzip")
+		res.Header.Add("Vary", "Accept-Encoding")
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
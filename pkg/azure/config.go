@@ -0,0 +1,128 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InitialConfigVersion is the version of the configuration loaded from the
+// environment, before any SetModelMapper.
+const InitialConfigVersion = "initial"
+
+var (
+	// configMu guards AzureOpenAIModelMapper once the proxy serves requests,
+	// and the version of the configuration.
+	configMu      sync.RWMutex
+	configVersion = InitialConfigVersion
+	configUpdated = time.Now()
+)
+
+// ErrConfigVersionMismatch is returned by SetModelMapper when the current
+// configuration is not the version the caller expected.
+var ErrConfigVersionMismatch = fmt.Errorf("config version mismatch")
+
+// ConfigVersion returns the version of the configuration and when it was
+// set.
+func ConfigVersion() (string, time.Time) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return configVersion, configUpdated
+}
+
+// ModelMapper returns a copy of the model to deployment mapping.
+func ModelMapper() map[string]string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	mapper := make(map[string]string, len(AzureOpenAIModelMapper))
+	for model, deployment := range AzureOpenAIModelMapper {
+		mapper[model] = deployment
+	}
+	return mapper
+}
+
+// SetModelMapper replaces the whole model to deployment mapping at once and
+// tags the configuration with version. When expectedVersion is set the
+// mapping is only replaced if it is the current version.
+func SetModelMapper(mapper map[string]string, version, expectedVersion string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if expectedVersion != "" && expectedVersion != configVersion {
+		return fmt.Errorf("%w: current version is %s, expected %s", ErrConfigVersionMismatch, configVersion, expectedVersion)
+	}
+	next := make(map[string]string, len(mapper))
+	for model, deployment := range mapper {
+		next[model] = deployment
+	}
+	AzureOpenAIModelMapper = next
+	configVersion = version
+	configUpdated = time.Now()
+	log.Printf("loading azure model mapper version %s with %d models", version, len(next))
+	return nil
+}
+
+// backendStats counts the upstream attempts of a backend.
+type backendStats struct {
+	requests  atomic.Uint64
+	errors    atomic.Uint64
+	throttled atomic.Uint64
+	latencyMs atomic.Uint64
+}
+
+func (s *backendStats) record(status int, err error, latency time.Duration) {
+	s.requests.Add(1)
+	s.latencyMs.Add(uint64(latency.Milliseconds()))
+	switch {
+	case err != nil || status >= 500:
+		s.errors.Add(1)
+	case status == 429:
+		s.throttled.Add(1)
+	}
+}
+
+// BackendStat is a snapshot of the state and counters of a backend since
+// the proxy started.
+type BackendStat struct {
+	Name                string
+	Endpoint            string
+	Type                string
+	Available           bool
+	ConsecutiveFailures int
+	Requests            uint64
+	Errors              uint64
+	Throttled           uint64
+	AverageLatency      time.Duration
+	// Capacity is the quota left of each deployment, as Azure last
+	// reported it.
+	Capacity []DeploymentCapacity
+}
+
+// BackendStats returns the stats of every backend, by name.
+func BackendStats() []BackendStat {
+	stats := make([]BackendStat, 0, len(Backends()))
+	for _, b := range Backends() {
+		b.circuit.mu.Lock()
+		failures := b.circuit.failures
+		b.circuit.mu.Unlock()
+		stat := BackendStat{
+			Name:                b.Name,
+			Endpoint:            b.Endpoint.String(),
+			Type:                b.Type,
+			Available:           b.Available(),
+			ConsecutiveFailures: failures,
+			Requests:            b.stats.requests.Load(),
+			Errors:              b.stats.errors.Load(),
+			Throttled:           b.stats.throttled.Load(),
+			Capacity:            backendCapacities(b.Name),
+		}
+		if stat.Requests > 0 {
+			stat.AverageLatency = time.Duration(b.stats.latencyMs.Load()/stat.Requests) * time.Millisecond
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,117 @@
+package azure
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestBodyKey contextKey = iota
+	streamFallbackKey
+	requestInfoKey
+	semanticCacheKey
+)
+
+// RequestInfo carries the routing state of a proxied request from the
+// director to the transport middleware.
+type RequestInfo struct {
+	// Model is the model named in the client request.
+	Model string
+	// Deployment is set when the deployment does not depend on the backend,
+	// because the client overrode it or the route forces one.
+	Deployment string
+	// Operation is the path below the deployment, e.g. "chat/completions".
+	Operation string
+	// ResourceScoped is set for operations on the Azure OpenAI resource
+	// rather than a deployment, such as files. Operation is then the path
+	// below /openai.
+	ResourceScoped bool
+	// Session identifies the conversation for sticky routing, if any.
+	Session string
+	// ClientKey is the key the client sent, used for backends without a
+	// configured token.
+	ClientKey string
+	// KeyName is the name of the proxy virtual key the client authenticated
+	// with, if any.
+	KeyName string
+	// EntraToken is a validated Microsoft Entra ID token of the client that
+	// is sent upstream instead of an API key.
+	EntraToken string
+	// PinnedBackend, when set, is the only backend the request is sent to.
+	PinnedBackend *Backend
+	// Candidates are the backends able to serve the request, in the order
+	// they are tried.
+	Candidates []*Backend
+	// Backend is the backend the request was last sent to.
+	Backend *Backend
+	// UpstreamLatency is the time Azure took to return the response headers
+	// of the last attempt.
+	UpstreamLatency time.Duration
+	// Priority is the priority class of the client, PriorityInteractive or
+	// PriorityBatch.
+	Priority string
+	// Tenant is the tenant the request is made for, if any.
+	Tenant *Tenant
+	// DryRun is the dry run mode of the request, empty when it is sent to
+	// Azure.
+	DryRun string
+	// Logprobs is set for chat completions that asked for logprobs.
+	Logprobs bool
+	// LegacyCompletions is set for completions requests sent to Azure as
+	// chat completions, whose responses are returned as completions.
+	LegacyCompletions bool
+	// APIVersion overrides the api-version of the request, e.g. for audio
+	// that AzureOpenAIAPIVersion does not support.
+	APIVersion string
+	// SpeechSSE is set for speech requests whose audio is sent to the client
+	// as server-sent events.
+	SpeechSSE bool
+	// SchemaRoute is set for requests whose fields are recorded for the
+	// schema report, to their route.
+	SchemaRoute string
+	// RateLimit is the state of the client's rate limit, if it has one.
+	RateLimit *RateLimitStatus
+	// quotaCharge is set when the completion tokens of the request are to be
+	// taken from its deployment quota.
+	quotaCharge *quotaCharge
+	// Usage and FinishReason are filled in once a successful response has
+	// been read.
+	Usage        Usage
+	FinishReason string
+}
+
+// NewRequestContext returns a copy of ctx holding a new RequestInfo. The
+// client identity, priority, tenant, dry run mode and pinned backend of a
+// RequestInfo already in ctx carry over, so that requests the proxy makes on
+// behalf of the client are attributed to it and handled alike.
+func NewRequestContext(ctx context.Context) context.Context {
+	info := &RequestInfo{}
+	if parent := RequestInfoFromContext(ctx); parent != nil {
+		info.KeyName = parent.KeyName
+		info.EntraToken = parent.EntraToken
+		info.Priority = parent.Priority
+		info.Tenant = parent.Tenant
+		info.DryRun = parent.DryRun
+		info.PinnedBackend = parent.PinnedBackend
+	}
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// RequestInfoFromContext returns the RequestInfo stored in ctx, if any.
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*RequestInfo)
+	return info
+}
+
+// WithRequestBody stores the client request body in ctx so that the response
+// handling can reissue the request if needed.
+func WithRequestBody(ctx context.Context, body []byte) context.Context {
+	return context.WithValue(ctx, requestBodyKey, body)
+}
+
+func requestBodyFromContext(ctx context.Context) []byte {
+	body, _ := ctx.Value(requestBodyKey).([]byte)
+	return body
+}
@@ -0,0 +1,189 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// discoveryAPIVersion is the api-version used to list deployments, which
+// newer api versions no longer offer on the data plane.
+const discoveryAPIVersion = "2022-12-01"
+
+// Deployment is a deployment found on a backend by discovery.
+type Deployment struct {
+	ID        string `json:"id"`
+	Model     string `json:"model"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+	Backend   string `json:"-"`
+}
+
+var (
+	// AzureOpenAIDiscoveryInterval is how often the deployments of every
+	// backend are listed, zero disables discovery.
+	AzureOpenAIDiscoveryInterval time.Duration
+
+	deploymentsCount = metrics.NewGauge("azure_oai_proxy_deployments",
+		"Deployments found by discovery, by backend.", "backend")
+	deploymentChanges = metrics.NewCounter("azure_oai_proxy_deployment_changes_total",
+		"Deployments that appeared or disappeared since the first discovery, by backend.", "backend", "change")
+)
+
+func init() {
+	AzureOpenAIDiscoveryInterval = envDuration("AZURE_OPENAI_DISCOVERY_INTERVAL", 0)
+	if AzureOpenAIDiscoveryInterval > 0 {
+		log.Printf("loading azure deployment discovery: every %s", AzureOpenAIDiscoveryInterval)
+	}
+}
+
+// discovery holds the deployments last found on a backend.
+type discovery struct {
+	mu sync.RWMutex
+	// deployments is nil until the backend was listed successfully.
+	deployments map[string]Deployment
+	// warnOnce logs that a backend without an API key is skipped.
+	warnOnce sync.Once
+}
+
+// StartDeploymentDiscovery lists the deployments of every backend now and
+// then every AzureOpenAIDiscoveryInterval in the background, if discovery is
+// enabled.
+func StartDeploymentDiscovery() {
+	if AzureOpenAIDiscoveryInterval <= 0 {
+		return
+	}
+	go func() {
+		for ; ; time.Sleep(AzureOpenAIDiscoveryInterval) {
+			for _, b := range Backends() {
+				refreshDeployments(b)
+			}
+		}
+	}()
+}
+
+func refreshDeployments(b *Backend) {
+	key := b.apiKeys().current()
+	if key == "" {
+		b.discovery.warnOnce.Do(func() {
+			log.Printf("skipping deployment discovery on backend %s, it has no API key", b.Name)
+		})
+		return
+	}
+	found, err := listDeployments(b, key)
+	if err != nil {
+		log.Printf("error discovering deployments on backend %s, keeping the previous ones: %v", b.Name, err)
+		return
+	}
+
+	b.discovery.mu.Lock()
+	previous := b.discovery.deployments
+	b.discovery.deployments = found
+	b.discovery.mu.Unlock()
+	deploymentsCount.Set(float64(len(found)), b.Name)
+
+	if previous == nil {
+		log.Printf("discovered %d deployments on backend %s", len(found), b.Name)
+		return
+	}
+	for id, d := range found {
+		if _, ok := previous[id]; !ok {
+			log.Printf("deployment %s (%s) appeared on backend %s", id, d.Model, b.Name)
+			deploymentChanges.Inc(b.Name, "added")
+		}
+	}
+	for id, d := range previous {
+		if _, ok := found[id]; !ok {
+			log.Printf("deployment %s (%s) disappeared from backend %s", id, d.Model, b.Name)
+			deploymentChanges.Inc(b.Name, "removed")
+		}
+	}
+}
+
+// listDeployments returns the deployments of b that can serve requests, by
+// ID.
+func listDeployments(b *Backend, key string) (map[string]Deployment, error) {
+	url := fmt.Sprintf("%s/openai/deployments?api-version=%s", b.Endpoint.String(), discoveryAPIVersion)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("api-key", key)
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+
+	var list struct {
+		Data []Deployment `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	found := make(map[string]Deployment, len(list.Data))
+	for _, d := range list.Data {
+		if d.Status != "" && d.Status != "succeeded" {
+			continue
+		}
+		d.Backend = b.Name
+		found[d.ID] = d
+	}
+	return found, nil
+}
+
+// discoveredDeployment returns the deployment serving model on b according
+// to discovery: mapped if it exists, else a deployment named model, else the
+// first deployment of model by ID. known is false until b was listed.
+func (b *Backend) discoveredDeployment(model, mapped string) (deployment string, ok, known bool) {
+	b.discovery.mu.RLock()
+	defer b.discovery.mu.RUnlock()
+	deployments := b.discovery.deployments
+	if deployments == nil {
+		return "", false, false
+	}
+	if _, ok := deployments[mapped]; ok {
+		return mapped, true, true
+	}
+	if _, ok := deployments[model]; ok {
+		return model, true, true
+	}
+	for _, d := range sortedDeployments(deployments) {
+		if d.Model == model {
+			return d.ID, true, true
+		}
+	}
+	return "", false, true
+}
+
+// DiscoveredDeployments returns the deployments found on every backend, by
+// backend and ID. It is empty while discovery is disabled.
+func DiscoveredDeployments() []Deployment {
+	var all []Deployment
+	for _, b := range Backends() {
+		b.discovery.mu.RLock()
+		all = append(all, sortedDeployments(b.discovery.deployments)...)
+		b.discovery.mu.RUnlock()
+	}
+	return all
+}
+
+func sortedDeployments(deployments map[string]Deployment) []Deployment {
+	list := make([]Deployment, 0, len(deployments))
+	for _, d := range deployments {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
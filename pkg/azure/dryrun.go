@@ -0,0 +1,258 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// DryRunHeader asks for a dry run of a single request, with DryRunMock or
+// DryRunEcho.
+const DryRunHeader = "X-Proxy-Dry-Run"
+
+// Dry run modes, in which requests are routed as usual but answered by the
+// proxy instead of Azure.
+const (
+	// DryRunMock answers with a completion describing where the request
+	// would have been sent.
+	DryRunMock = "mock"
+	// DryRunEcho answers with a completion repeating the prompt.
+	DryRunEcho = "echo"
+)
+
+// dryRunDimensions is the size of mocked embeddings for requests that do not
+// set dimensions.
+const dryRunDimensions = 1536
+
+// AzureOpenAIDryRun puts every request in a dry run mode, empty sends them to
+// Azure.
+var AzureOpenAIDryRun = ""
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_DRY_RUN"); v != "" {
+		if !validDryRun(v) {
+			log.Printf("error parsing AZURE_OPENAI_DRY_RUN, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAIDryRun = v
+		log.Printf("loading azure dry run: %s, requests are not sent to Azure", v)
+	}
+}
+
+func validDryRun(mode string) bool {
+	return mode == DryRunMock || mode == DryRunEcho
+}
+
+// DryRunMode returns the dry run mode of a request given its DryRunHeader,
+// which takes precedence over AzureOpenAIDryRun.
+func DryRunMode(header string) (string, error) {
+	if header == "" {
+		return AzureOpenAIDryRun, nil
+	}
+	if !validDryRun(header) {
+		return "", &APIError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Invalid %s header %q, expected %s or %s.", DryRunHeader, header, DryRunMock, DryRunEcho),
+			Type:       "invalid_request_error",
+			Code:       "invalid_dry_run",
+		}
+	}
+	return header, nil
+}
+
+// dryRun answers requests in a dry run with a mocked response once they are
+// routed, without sending them to Azure. It is the outermost middleware so
+// that dry runs take no quota and are not counted as upstream requests.
+func dryRun(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		info := RequestInfoFromContext(req.Context())
+		if info == nil || info.DryRun == "" {
+			return next.RoundTrip(req)
+		}
+		var body []byte
+		if req.Body != nil && !isStreamedUpload(req) {
+			var err error
+			if body, err = ReadRequestBody(req.Body); err != nil {
+				return nil, err
+			}
+			req.Body.Close()
+		}
+		return dryRunResponse(req, info, body)
+	})
+}
+
+func dryRunResponse(req *http.Request, info *RequestInfo, body []byte) (*http.Response, error) {
+	route := map[string]any{
+		"object":      "proxy.dry_run",
+		"method":      req.Method,
+		"url":         req.URL.String(),
+		"deployment":  deploymentFromPath(req.URL.Path),
+		"api_version": req.URL.Query().Get("api-version"),
+		"operation":   info.Operation,
+	}
+	if info.Backend != nil {
+		route["backend"] = info.Backend.Name
+	}
+
+	var out []byte
+	var err error
+	contentType := "application/json"
+	switch info.Operation {
+	case "chat/completions", "completions":
+		content := fmt.Sprintf("Dry run: %s %s would be sent to deployment %s of backend %v with api-version %s.",
+			req.Method, req.URL.Path, route["deployment"], route["backend"], route["api_version"])
+		if info.DryRun == DryRunEcho {
+			content = dryRunPrompt(body)
+		}
+		out = dryRunCompletion(info, body, content)
+		if gjson.GetBytes(body, "stream").Bool() {
+			if out, err = completionToSSE(out, gjson.GetBytes(body, "stream_options.include_usage").Bool()); err != nil {
+				return nil, err
+			}
+			contentType = "text/event-stream"
+		}
+	case "embeddings":
+		out = dryRunEmbeddings(info, body)
+	default:
+		out, _ = json.Marshal(route)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set(DryRunHeader, info.DryRun)
+	header.Set("X-Proxy-Upstream-Url", req.URL.String())
+	res := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(out)),
+		Request:    req,
+	}
+	if contentType == "text/event-stream" {
+		res.ContentLength = -1
+	} else {
+		res.ContentLength = int64(len(out))
+		header.Set("Content-Length", strconv.Itoa(len(out)))
+	}
+	return res, nil
+}
+
+// dryRunPrompt returns the text of the last user message of a chat request,
+// or the prompt of a completions request.
+func dryRunPrompt(body []byte) string {
+	messages := gjson.GetBytes(body, "messages").Array()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Get("role").String() != "user" {
+			continue
+		}
+		content := messages[i].Get("content")
+		if !content.IsArray() {
+			return content.String()
+		}
+		var parts []string
+		for _, part := range content.Array() {
+			if part.Get("type").String() == "text" {
+				parts = append(parts, part.Get("text").String())
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	prompt := gjson.GetBytes(body, "prompt")
+	if prompt.IsArray() {
+		return prompt.Get("0").String()
+	}
+	return prompt.String()
+}
+
+// dryRunID derives the ID of a mocked response from the request, so that the
+// same request gets the same response.
+func dryRunID(prefix string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return prefix + "-dryrun-" + hex.EncodeToString(sum[:12])
+}
+
+func dryRunCompletion(info *RequestInfo, body []byte, content string) []byte {
+	promptTokens := EstimateRequestTokens(body)
+	completionTokens := EstimateTokens(content)
+	usage := Usage{PromptTokens: promptTokens, CompletionTokens: completionTokens, TotalTokens: promptTokens + completionTokens}
+	completion := map[string]any{
+		"id":      dryRunID("chatcmpl", body),
+		"object":  "chat.completion",
+		"created": 0,
+		"model":   info.Model,
+		"choices": []any{map[string]any{
+			"index":         0,
+			"message":       map[string]any{"role": "assistant", "content": content},
+			"finish_reason": "stop",
+		}},
+		"usage": usage,
+	}
+	if info.Operation == "completions" {
+		completion["id"] = dryRunID("cmpl", body)
+		completion["object"] = "text_completion"
+		completion["choices"] = []any{map[string]any{"index": 0, "text": content, "logprobs": nil, "finish_reason": "stop"}}
+	}
+	out, _ := json.Marshal(completion)
+	return out
+}
+
+// dryRunEmbeddings returns a unit vector per input, derived from its text.
+func dryRunEmbeddings(info *RequestInfo, body []byte) []byte {
+	input := gjson.GetBytes(body, "input")
+	inputs := []gjson.Result{input}
+	if input.IsArray() {
+		inputs = input.Array()
+	}
+	dimensions := int(gjson.GetBytes(body, "dimensions").Int())
+	if dimensions <= 0 {
+		dimensions = dryRunDimensions
+	}
+
+	data := make([]any, len(inputs))
+	tokens := 0
+	for i, text := range inputs {
+		tokens += EstimateTokens(text.String())
+		data[i] = map[string]any{"object": "embedding", "index": i, "embedding": dryRunVector(text.Raw, dimensions)}
+	}
+	out, _ := json.Marshal(map[string]any{
+		"object": "list",
+		"data":   data,
+		"model":  info.Model,
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+	return out
+}
+
+func dryRunVector(text string, dimensions int) []float64 {
+	vector := make([]float64, dimensions)
+	var norm float64
+	seed := sha256.Sum256([]byte(text))
+	for i := range vector {
+		if i%8 == 0 && i > 0 {
+			seed = sha256.Sum256(seed[:])
+		}
+		v := float64(binary.BigEndian.Uint32(seed[i%8*4:]))/math.MaxUint32*2 - 1
+		vector[i] = v
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
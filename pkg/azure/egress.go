@@ -0,0 +1,43 @@
+package azure
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// egressProxy returns the proxy function of the upstream transport. With
+// AZURE_OPENAI_EGRESS_PROXY every upstream request goes through that proxy,
+// except to the hosts in NO_PROXY. Otherwise the HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY environment variables apply.
+func egressProxy() func(*http.Request) (*url.URL, error) {
+	v := os.Getenv("AZURE_OPENAI_EGRESS_PROXY")
+	if v == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := url.Parse(v)
+	if err != nil || proxyURL.Host == "" {
+		log.Printf("error parsing AZURE_OPENAI_EGRESS_PROXY, invalid value %s", v)
+		os.Exit(1)
+	}
+	if username := os.Getenv("AZURE_OPENAI_EGRESS_PROXY_USERNAME"); username != "" {
+		proxyURL.User = url.UserPassword(username, os.Getenv("AZURE_OPENAI_EGRESS_PROXY_PASSWORD"))
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	log.Printf("loading azure egress proxy: %s, no proxy for %q", proxyURL.Redacted(), noProxy)
+
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
@@ -0,0 +1,187 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// AzureOpenAIEmbeddingsBatchSize is the largest input array sent upstream
+	// in a single embeddings request.
+	AzureOpenAIEmbeddingsBatchSize = 2048
+)
+
+// embeddingsConcurrency bounds the batches of one request in flight at once.
+const embeddingsConcurrency = 4
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_EMBEDDINGS_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Printf("error parsing AZURE_OPENAI_EMBEDDINGS_BATCH_SIZE, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAIEmbeddingsBatchSize = n
+	}
+	log.Printf("loading azure embeddings batch size: %d", AzureOpenAIEmbeddingsBatchSize)
+}
+
+type embeddingsResponse struct {
+	Object string            `json:"object"`
+	Data   []json.RawMessage `json:"data"`
+	Model  string            `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+type embeddingsBatch struct {
+	offset int
+	body   []byte
+	status int
+	header http.Header
+	result []byte
+	err    error
+}
+
+// SplitEmbeddingsInput splits the input array of an embeddings request body
+// into request bodies of at most size inputs each. It returns nil when the
+// request fits in a single upstream call.
+func SplitEmbeddingsInput(body []byte, size int) [][]byte {
+	input := gjson.GetBytes(body, "input")
+	if !input.IsArray() {
+		return nil
+	}
+	items := input.Array()
+	if len(items) <= size || items[0].Type == gjson.Number {
+		// A flat array of numbers is a single pre-tokenized input.
+		return nil
+	}
+
+	var bodies [][]byte
+	for start := 0; start < len(items); start += size {
+		end := min(start+size, len(items))
+		raw := make([]byte, 0, len(input.Raw))
+		raw = append(raw, '[')
+		for i, item := range items[start:end] {
+			if i > 0 {
+				raw = append(raw, ',')
+			}
+			raw = append(raw, item.Raw...)
+		}
+		raw = append(raw, ']')
+
+		chunk, err := sjson.SetRawBytes(body, "input", raw)
+		if err != nil {
+			return nil
+		}
+		bodies = append(bodies, chunk)
+	}
+	return bodies
+}
+
+// ServeEmbeddingsBatches sends each of the split bodies as its own upstream
+// embeddings request and writes a single merged response to w, keeping the
+// indexes in input order and summing the usage. If any batch fails its
+// upstream response is returned to the client unchanged.
+func ServeEmbeddingsBatches(w http.ResponseWriter, req *http.Request, bodies [][]byte) {
+	batches := make([]*embeddingsBatch, len(bodies))
+	offset := 0
+	for i, body := range bodies {
+		batches[i] = &embeddingsBatch{offset: offset, body: body}
+		offset += len(gjson.GetBytes(body, "input").Array())
+	}
+	log.Printf("splitting embeddings request of %d inputs into %d batches", offset, len(batches))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, embeddingsConcurrency)
+	for _, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch *embeddingsBatch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			batch.do(req)
+		}(batch)
+	}
+	wg.Wait()
+
+	var merged embeddingsResponse
+	for _, batch := range batches {
+		if batch.err != nil {
+			log.Printf("embeddings batch at offset %d failed: %v", batch.offset, batch.err)
+			WriteError(w, newServerError(http.StatusBadGateway, batch.err.Error()))
+			return
+		}
+		if batch.status != http.StatusOK {
+			for k, v := range batch.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(batch.status)
+			w.Write(batch.result)
+			return
+		}
+
+		var resp embeddingsResponse
+		if err := json.Unmarshal(batch.result, &resp); err != nil {
+			WriteError(w, newServerError(http.StatusBadGateway, "invalid embeddings response from upstream"))
+			return
+		}
+		for _, item := range resp.Data {
+			index := gjson.GetBytes(item, "index").Int()
+			item, _ = sjson.SetBytes(item, "index", int64(batch.offset)+index)
+			merged.Data = append(merged.Data, item)
+		}
+		merged.Object = resp.Object
+		merged.Model = resp.Model
+		merged.Usage.PromptTokens += resp.Usage.PromptTokens
+		merged.Usage.TotalTokens += resp.Usage.TotalTokens
+	}
+
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.Model = gjson.GetBytes(bodies[0], "model").String()
+		recordUsage(info, Usage{PromptTokens: merged.Usage.PromptTokens, TotalTokens: merged.Usage.TotalTokens})
+	}
+
+	body, _ := json.Marshal(merged)
+	w.Header().Set("Content-Type", "application/json")
+	if shouldGzip(w.Header(), req.Header.Get("Accept-Encoding"), len(body)) {
+		body = gzipBytes(body)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+func (b *embeddingsBatch) do(original *http.Request) {
+	req := original.Clone(NewRequestContext(original.Context()))
+	req.RequestURI = ""
+	req.Body = io.NopCloser(bytes.NewReader(b.body))
+	req.ContentLength = int64(len(b.body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(b.body)))
+	// Let the transport negotiate and decode compression for us.
+	req.Header.Del("Accept-Encoding")
+	director(req)
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		b.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	b.status = resp.StatusCode
+	b.header = resp.Header
+	b.result, b.err = io.ReadAll(resp.Body)
+}
@@ -0,0 +1,281 @@
+package azure
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AzureOpenAIEntraPassthrough accepts Microsoft Entra ID access tokens
+	// from clients, validates them and forwards them to Azure OpenAI.
+	AzureOpenAIEntraPassthrough = false
+	// AzureOpenAIEntraTenantID is the tenant tokens must be issued by.
+	AzureOpenAIEntraTenantID = ""
+	// AzureOpenAIEntraAudiences are the accepted token audiences.
+	AzureOpenAIEntraAudiences = []string{"https://cognitiveservices.azure.com"}
+	// AzureOpenAIEntraClaimMap maps "appid:<id>", "oid:<id>" or
+	// "group:<id>" to a virtual key name whose policies, such as budgets,
+	// apply to the identity. When set, identities without a mapping are
+	// rejected.
+	AzureOpenAIEntraClaimMap = map[string]string{}
+	// AzureOpenAIAuthorityHost is the Entra ID authority, overridden for
+	// sovereign clouds.
+	AzureOpenAIAuthorityHost = "https://login.microsoftonline.com"
+
+	jwksMu      sync.Mutex
+	jwksKeys    map[string]*rsa.PublicKey
+	jwksFetched time.Time
+)
+
+const (
+	// jwksRefreshInterval is how often signing keys are refetched, and
+	// jwksMinRefreshInterval how soon an unknown key id may trigger a refetch.
+	jwksRefreshInterval    = 24 * time.Hour
+	jwksMinRefreshInterval = 5 * time.Minute
+	// entraClockSkew is the tolerance for the token lifetime checks.
+	entraClockSkew = 5 * time.Minute
+)
+
+func init() {
+	AzureOpenAIEntraPassthrough = envBool("AZURE_OPENAI_ENTRA_PASSTHROUGH", AzureOpenAIEntraPassthrough)
+	if !AzureOpenAIEntraPassthrough {
+		return
+	}
+	AzureOpenAIEntraTenantID = os.Getenv("AZURE_OPENAI_ENTRA_TENANT_ID")
+	if AzureOpenAIEntraTenantID == "" {
+		AzureOpenAIEntraTenantID = os.Getenv("AZURE_TENANT_ID")
+	}
+	if AzureOpenAIEntraTenantID == "" {
+		log.Printf("error loading entra passthrough: AZURE_OPENAI_ENTRA_TENANT_ID is required")
+		os.Exit(1)
+	}
+	if v := os.Getenv("AZURE_OPENAI_ENTRA_AUDIENCES"); v != "" {
+		AzureOpenAIEntraAudiences = SplitList(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_ENTRA_CLAIM_MAP"); v != "" {
+		AzureOpenAIEntraClaimMap = parseKeyValueList("AZURE_OPENAI_ENTRA_CLAIM_MAP", v)
+		for claim := range AzureOpenAIEntraClaimMap {
+			kind, _, _ := strings.Cut(claim, ":")
+			if kind != "appid" && kind != "oid" && kind != "group" {
+				log.Printf("error parsing AZURE_OPENAI_ENTRA_CLAIM_MAP, invalid claim %s", claim)
+				os.Exit(1)
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_AUTHORITY_HOST"); v != "" {
+		AzureOpenAIAuthorityHost = strings.TrimSuffix(v, "/")
+	}
+	log.Printf("loading azure entra passthrough: tenant %s, audiences %s, %d claim mappings",
+		AzureOpenAIEntraTenantID, strings.Join(AzureOpenAIEntraAudiences, ","), len(AzureOpenAIEntraClaimMap))
+}
+
+// EntraClaims are the validated claims of an Entra ID access token.
+type EntraClaims struct {
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	Expires   int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	TenantID  string   `json:"tid"`
+	ObjectID  string   `json:"oid"`
+	AppID     string   `json:"appid"`
+	// AuthorizedParty is the client application of v2 tokens.
+	AuthorizedParty string   `json:"azp"`
+	Groups          []string `json:"groups"`
+}
+
+// App returns the client application id of the token.
+func (c *EntraClaims) App() string {
+	if c.AppID != "" {
+		return c.AppID
+	}
+	return c.AuthorizedParty
+}
+
+// KeyName returns the virtual key name mapped to the identity. The app id is
+// looked up first, then the object id, then the groups.
+func (c *EntraClaims) KeyName() (string, bool) {
+	if name, ok := AzureOpenAIEntraClaimMap["appid:"+c.App()]; ok {
+		return name, true
+	}
+	if name, ok := AzureOpenAIEntraClaimMap["oid:"+c.ObjectID]; ok {
+		return name, true
+	}
+	for _, group := range c.Groups {
+		if name, ok := AzureOpenAIEntraClaimMap["group:"+group]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+// IsJWT reports whether token looks like a JWT rather than an API key.
+func IsJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// ValidateEntraToken checks the signature, issuer, audience and lifetime of
+// an Entra ID access token.
+func ValidateEntraToken(token string) (*EntraClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %s", header.Alg)
+	}
+	key, err := entraSigningKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims EntraClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.After(time.Unix(claims.Expires, 0).Add(entraClockSkew)) {
+		return nil, errors.New("token is expired")
+	}
+	if claims.NotBefore != 0 && now.Add(entraClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if claims.Issuer != "https://sts.windows.net/"+AzureOpenAIEntraTenantID+"/" &&
+		claims.Issuer != AzureOpenAIAuthorityHost+"/"+AzureOpenAIEntraTenantID+"/v2.0" {
+		return nil, fmt.Errorf("untrusted issuer %s", claims.Issuer)
+	}
+	if !audienceAllowed(claims.Audience) {
+		return nil, fmt.Errorf("invalid audience %s", strings.Join(claims.Audience, ","))
+	}
+	return &claims, nil
+}
+
+func audienceAllowed(aud audience) bool {
+	for _, a := range aud {
+		for _, allowed := range AzureOpenAIEntraAudiences {
+			if strings.TrimSuffix(a, "/") == strings.TrimSuffix(allowed, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// entraSigningKey returns the tenant signing key kid, refetching the keys
+// when they are old or kid is unknown.
+func entraSigningKey(kid string) (*rsa.PublicKey, error) {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+	key, ok := jwksKeys[kid]
+	age := time.Since(jwksFetched)
+	if ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+	if !ok && age < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	keys, err := fetchEntraSigningKeys()
+	if err != nil {
+		if ok {
+			// Keep using the known key while the authority is unreachable.
+			log.Printf("error refreshing entra signing keys: %v", err)
+			return key, nil
+		}
+		return nil, err
+	}
+	jwksKeys, jwksFetched = keys, time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+func fetchEntraSigningKeys() (map[string]*rsa.PublicKey, error) {
+	url := fmt.Sprintf("%s/%s/discovery/v2.0/keys", AzureOpenAIAuthorityHost, AzureOpenAIEntraTenantID)
+	resp, err := Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get entra signing keys: %s", string(body))
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,91 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseKeyValueList parses a comma separated list of key=value pairs and
+// exits on malformed input, mirroring AZURE_OPENAI_MODEL_MAPPER.
+func parseKeyValueList(name, value string) map[string]string {
+	pairs, err := parseKeyValues(name, value)
+	if err != nil {
+		log.Printf("error parsing %v", err)
+		os.Exit(1)
+	}
+	return pairs
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs.
+func parseKeyValues(name, value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		info := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(info) != 2 || info[0] == "" {
+			return nil, fmt.Errorf("%s, invalid value %s", name, pair)
+		}
+		pairs[info[0]] = info[1]
+	}
+	return pairs, nil
+}
+
+// SplitList splits a comma separated list, trimming the items and dropping
+// empty ones.
+func SplitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envInt returns the integer value of the environment variable name, or def
+// when it is unset. Invalid values are fatal.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("error parsing %s, invalid value %s", name, v)
+		os.Exit(1)
+	}
+	return n
+}
+
+// envDuration returns the duration value of the environment variable name,
+// such as "30s" or "2m", or def when it is unset. Invalid values are fatal.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("error parsing %s, invalid value %s", name, v)
+		os.Exit(1)
+	}
+	return d
+}
+
+// envBool returns the boolean value of the environment variable name, or def
+// when it is unset. Invalid values are fatal.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("error parsing %s, invalid value %s", name, v)
+		os.Exit(1)
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// APIError is an error returned to clients in the OpenAI error format.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"message"`
+	Type       string `json:"type"`
+	Param      any    `json:"param"`
+	Code       any    `json:"code"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// NewInvalidRequestError returns a 400 invalid_request_error for param.
+func NewInvalidRequestError(param, code, message string) *APIError {
+	return &APIError{
+		StatusCode: http.StatusBadRequest,
+		Message:    message,
+		Type:       "invalid_request_error",
+		Param:      param,
+		Code:       code,
+	}
+}
+
+// NewRequestTooLargeError returns the 413 for a request body larger than
+// the limit of the proxy, in bytes.
+func NewRequestTooLargeError(limit int64) *APIError {
+	return &APIError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Message:    fmt.Sprintf("Request body is too large. The maximum size allowed by this proxy is %d bytes.", limit),
+		Type:       "invalid_request_error",
+		Code:       "request_too_large",
+	}
+}
+
+// WriteError writes err to w in the OpenAI error format.
+func WriteError(w http.ResponseWriter, err *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode)
+	json.NewEncoder(w).Encode(map[string]*APIError{"error": err})
+}
+
+func newServerError(status int, message string) *APIError {
+	return &APIError{StatusCode: status, Message: message, Type: "server_error"}
+}
@@ -0,0 +1,117 @@
+package azure
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+// Estimate describes where a request would be sent and what it would cost,
+// worked out by the proxy without calling Azure.
+type Estimate struct {
+	Object    string `json:"object"`
+	Model     string `json:"model"`
+	Operation string `json:"operation"`
+	// Backend is the backend tried first, Backends all of them in order.
+	Backend    string   `json:"backend"`
+	Backends   []string `json:"backends"`
+	Deployment string   `json:"deployment"`
+	// Canary is the canary route of the model, taken by a share of the
+	// requests instead of Deployment.
+	Canary     *CanaryRoute `json:"canary,omitempty"`
+	APIVersion string       `json:"api_version"`
+	// PromptTokens is estimated, MaxCompletionTokens is the limit the request
+	// sets, if any.
+	PromptTokens        int   `json:"prompt_tokens"`
+	MaxCompletionTokens int64 `json:"max_completion_tokens,omitempty"`
+	// Cost is nil when the model has no price.
+	Cost *EstimatedCost `json:"estimated_cost"`
+	// Error is how the proxy would reject the request, if it would.
+	Error *APIError `json:"error,omitempty"`
+}
+
+// EstimatedCost is the cost of a request in US dollars: of its prompt, and
+// at most, should it use all of its completion tokens. MaxUSD is nil when the
+// request does not limit its completion tokens.
+type EstimatedCost struct {
+	PromptUSD float64  `json:"prompt_usd"`
+	MaxUSD    *float64 `json:"max_usd"`
+}
+
+// estimateOperation returns the operation of a request body: chat
+// completions, completions or embeddings.
+func estimateOperation(body []byte) (string, bool) {
+	switch {
+	case gjson.GetBytes(body, "messages").Exists():
+		return "chat/completions", true
+	case gjson.GetBytes(body, "prompt").Exists():
+		return "completions", true
+	case gjson.GetBytes(body, "input").Exists():
+		return "embeddings", true
+	}
+	return "", false
+}
+
+// EstimateRequest estimates the chat completions, completions or embeddings
+// request body of a client of tenant, routing it like the proxy would. The
+// request is checked against the token limits and the budget of the key,
+// which is charged nothing. Canary splits and latency routing are not
+// rolled, the estimate is for the stable deployment and the first backend.
+func EstimateRequest(body []byte, keyName string, tenant *Tenant) (*Estimate, *APIError) {
+	operation, ok := estimateOperation(body)
+	if !ok {
+		return nil, NewInvalidRequestError("messages", "invalid_request", "Expected a chat completions, completions or embeddings request body, with messages, prompt or input.")
+	}
+	model := gjson.GetBytes(body, "model").String()
+	if model == "" {
+		return nil, NewInvalidRequestError("model", "missing_required_parameter", "Missing required parameter: 'model'.")
+	}
+	if operation == "chat/completions" {
+		if pinned, ok := PinSystemPrompt(body, keyName); ok {
+			body = pinned
+		}
+	}
+	estimate := &Estimate{Object: "proxy.estimate", Model: model, Operation: operation, APIVersion: AzureOpenAIAPIVersion}
+	if operation == "chat/completions" {
+		if m, err := ApplyMultimodal(body, 0, 0); err != nil {
+			estimate.Error, _ = err.(*APIError)
+		} else if m.APIVersion != "" {
+			estimate.APIVersion = m.APIVersion
+		}
+	}
+	// The token limits may lower max_tokens or truncate the prompt.
+	if limited, err := ApplyTokenLimits(operation, body); err != nil {
+		estimate.Error, _ = err.(*APIError)
+	} else {
+		body = limited
+	}
+	if err := CheckBudget(keyName); err != nil && estimate.Error == nil {
+		estimate.Error = err
+	}
+	estimate.PromptTokens = EstimateRequestTokens(body)
+
+	candidates := candidateBackends(model, tenant)
+	for _, b := range candidates {
+		estimate.Backends = append(estimate.Backends, b.Name)
+	}
+	estimate.Backend = candidates[0].Name
+	estimate.Deployment = candidates[0].Deployment(model)
+	if deployment, ok := tenant.deployment(model); ok {
+		estimate.Deployment = deployment
+	}
+	if route, ok := AzureOpenAICanaries[model]; ok {
+		estimate.Canary = &route
+	}
+
+	maxTokens := gjson.GetBytes(body, "max_completion_tokens")
+	if !maxTokens.Exists() {
+		maxTokens = gjson.GetBytes(body, "max_tokens")
+	}
+	estimate.MaxCompletionTokens = maxTokens.Int()
+	if price, ok := lookupPrice(model); ok {
+		estimate.Cost = &EstimatedCost{PromptUSD: price.Cost(Usage{PromptTokens: estimate.PromptTokens})}
+		if estimate.MaxCompletionTokens > 0 || operation == "embeddings" {
+			max := price.Cost(Usage{PromptTokens: estimate.PromptTokens, CompletionTokens: int(estimate.MaxCompletionTokens)})
+			estimate.Cost.MaxUSD = &max
+		}
+	}
+	return estimate, nil
+}
@@ -0,0 +1,151 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types sent to the webhooks.
+const (
+	EventBackendThrottled = "backend_throttled"
+	EventCircuitOpen      = "circuit_open"
+	EventBudgetExceeded   = "budget_exceeded"
+	EventSlowUpstream     = "slow_upstream"
+)
+
+// Event is a notification about something an operator should know about.
+type Event struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Message string         `json:"message"`
+	Subject string         `json:"subject"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+var (
+	// AzureOpenAIEventWebhooks are the URLs events are POSTed to. Slack
+	// incoming webhooks get a Slack message, other URLs the Event as JSON.
+	AzureOpenAIEventWebhooks []string
+	// AzureOpenAIEventCooldown is the minimum time between two events of the
+	// same type and subject.
+	AzureOpenAIEventCooldown = 5 * time.Minute
+	// AzureOpenAIEventThrottleThreshold is the number of 429s a backend has to
+	// return within AzureOpenAIEventThrottleWindow to raise an event.
+	AzureOpenAIEventThrottleThreshold = 10
+	AzureOpenAIEventThrottleWindow    = time.Minute
+	// AzureOpenAIEventLatencyThreshold raises an event for upstream requests
+	// slower than it, zero disables it.
+	AzureOpenAIEventLatencyThreshold time.Duration
+
+	eventsMu   sync.Mutex
+	lastEvents = map[string]time.Time{}
+	throttles  = map[string]*throttleWindow{}
+)
+
+type throttleWindow struct {
+	start time.Time
+	count int
+}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_EVENT_WEBHOOKS"); v != "" {
+		for _, u := range SplitList(v) {
+			if _, err := url.ParseRequestURI(u); err != nil {
+				log.Printf("error parsing AZURE_OPENAI_EVENT_WEBHOOKS, invalid url %s", u)
+				os.Exit(1)
+			}
+			AzureOpenAIEventWebhooks = append(AzureOpenAIEventWebhooks, u)
+		}
+		log.Printf("loading azure event webhooks: %d", len(AzureOpenAIEventWebhooks))
+	}
+	AzureOpenAIEventCooldown = envDuration("AZURE_OPENAI_EVENT_COOLDOWN", AzureOpenAIEventCooldown)
+	AzureOpenAIEventThrottleThreshold = envInt("AZURE_OPENAI_EVENT_THROTTLE_THRESHOLD", AzureOpenAIEventThrottleThreshold)
+	AzureOpenAIEventThrottleWindow = envDuration("AZURE_OPENAI_EVENT_THROTTLE_WINDOW", AzureOpenAIEventThrottleWindow)
+	AzureOpenAIEventLatencyThreshold = envDuration("AZURE_OPENAI_EVENT_LATENCY_THRESHOLD", AzureOpenAIEventLatencyThreshold)
+}
+
+// Emit logs event and sends it to the webhooks in the background, unless an
+// event of the same type and subject was emitted within
+// AzureOpenAIEventCooldown.
+func Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	key := event.Type + "\xff" + event.Subject
+	eventsMu.Lock()
+	if last, ok := lastEvents[key]; ok && event.Time.Sub(last) < AzureOpenAIEventCooldown {
+		eventsMu.Unlock()
+		return
+	}
+	lastEvents[key] = event.Time
+	eventsMu.Unlock()
+
+	log.Printf("event %s: %s", event.Type, event.Message)
+
+	for _, u := range AzureOpenAIEventWebhooks {
+		go postEvent(u, event)
+	}
+}
+
+func postEvent(webhook string, event Event) {
+	var payload any = event
+	if strings.HasPrefix(webhook, "https://hooks.slack.com/") {
+		payload = map[string]string{"text": fmt.Sprintf(":warning: *%s*: %s", event.Type, event.Message)}
+	}
+	body, _ := json.Marshal(payload)
+	// Webhooks are not Azure, bypass the upstream middleware.
+	client := &http.Client{Transport: Transport, Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("error sending %s event to webhook: %v", event.Type, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("error sending %s event to webhook: status %d", event.Type, resp.StatusCode)
+	}
+}
+
+// observeUpstream raises events for throttled and slow upstream requests.
+func observeUpstream(backend, deployment string, status int, latency time.Duration) {
+	if AzureOpenAIEventLatencyThreshold > 0 && latency > AzureOpenAIEventLatencyThreshold {
+		Emit(Event{
+			Type:    EventSlowUpstream,
+			Subject: backend + "/" + deployment,
+			Message: fmt.Sprintf("deployment %s on backend %s took %s to respond", deployment, backend, latency.Round(time.Millisecond)),
+			Details: map[string]any{"backend": backend, "deployment": deployment, "latency_seconds": latency.Seconds()},
+		})
+	}
+	if status != http.StatusTooManyRequests || AzureOpenAIEventThrottleThreshold == 0 {
+		return
+	}
+
+	now := time.Now()
+	eventsMu.Lock()
+	w, ok := throttles[backend]
+	if !ok || now.Sub(w.start) > AzureOpenAIEventThrottleWindow {
+		w = &throttleWindow{start: now}
+		throttles[backend] = w
+	}
+	w.count++
+	count := w.count
+	eventsMu.Unlock()
+
+	if count == AzureOpenAIEventThrottleThreshold {
+		Emit(Event{
+			Type:    EventBackendThrottled,
+			Subject: backend,
+			Message: fmt.Sprintf("backend %s returned %d 429 responses within %s", backend, count, AzureOpenAIEventThrottleWindow),
+			Details: map[string]any{"backend": backend, "deployment": deployment, "count": count},
+		})
+	}
+}
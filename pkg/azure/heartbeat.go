@@ -0,0 +1,156 @@
+package azure
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AzureOpenAISSEHeartbeatInterval is how often an SSE comment is sent to
+	// streaming clients while waiting for the first upstream byte, 0 disables.
+	AzureOpenAISSEHeartbeatInterval time.Duration
+)
+
+func init() {
+	AzureOpenAISSEHeartbeatInterval = envDuration("AZURE_OPENAI_SSE_HEARTBEAT_INTERVAL", 0)
+	if AzureOpenAISSEHeartbeatInterval > 0 {
+		log.Printf("loading azure sse heartbeat interval: %s", AzureOpenAISSEHeartbeatInterval)
+	}
+}
+
+// HeartbeatWriter keeps an idle streaming response alive by sending SSE
+// comments until the upstream response body starts. Once a heartbeat has been
+// sent the response status is committed, so an upstream error is delivered to
+// the client as a final SSE data event instead.
+//
+// The headers are set on a map of its own, copied to the underlying writer
+// by WriteHeader, so that the heartbeats never race with them.
+type HeartbeatWriter struct {
+	http.ResponseWriter
+
+	header        http.Header
+	mu            sync.Mutex
+	done          chan struct{}
+	headerWritten bool
+	// stream is set when the response headers were for an SSE stream.
+	stream      bool
+	bodyStarted bool
+	pinged      bool
+	failed      bool
+	errorBody   bytes.Buffer
+}
+
+// NewHeartbeatWriter starts sending heartbeats on w every interval.
+func NewHeartbeatWriter(w http.ResponseWriter, interval time.Duration) *HeartbeatWriter {
+	hw := &HeartbeatWriter{ResponseWriter: w, header: w.Header().Clone(), done: make(chan struct{})}
+	go hw.run(interval)
+	return hw
+}
+
+func (hw *HeartbeatWriter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hw.done:
+			return
+		case <-ticker.C:
+			if !hw.ping() {
+				return
+			}
+		}
+	}
+}
+
+func (hw *HeartbeatWriter) ping() bool {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.bodyStarted {
+		return false
+	}
+	if !hw.headerWritten {
+		header := hw.ResponseWriter.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("X-Accel-Buffering", "no")
+		hw.ResponseWriter.WriteHeader(http.StatusOK)
+		hw.headerWritten = true
+		hw.stream = true
+		hw.pinged = true
+	} else if !hw.stream {
+		// The upstream response is not a stream, comments would corrupt it.
+		return false
+	}
+	if _, err := hw.ResponseWriter.Write([]byte(": ping\n\n")); err != nil {
+		return false
+	}
+	hw.ResponseWriter.(http.Flusher).Flush()
+	return true
+}
+
+// Header returns the headers of the response, which are sent by WriteHeader
+// unless a heartbeat already committed the response.
+func (hw *HeartbeatWriter) Header() http.Header {
+	return hw.header
+}
+
+func (hw *HeartbeatWriter) WriteHeader(code int) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.writeHeader(code)
+}
+
+func (hw *HeartbeatWriter) writeHeader(code int) {
+	if hw.pinged {
+		hw.failed = code >= http.StatusBadRequest
+		return
+	}
+	header := hw.ResponseWriter.Header()
+	clear(header)
+	for k, v := range hw.header {
+		header[k] = v
+	}
+	hw.stream = strings.HasPrefix(hw.header.Get("Content-Type"), "text/event-stream")
+	hw.headerWritten = true
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *HeartbeatWriter) Write(b []byte) (int, error) {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if !hw.headerWritten {
+		hw.writeHeader(http.StatusOK)
+	}
+	hw.bodyStarted = true
+	if hw.failed {
+		return hw.errorBody.Write(b)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *HeartbeatWriter) Flush() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if !hw.failed {
+		hw.ResponseWriter.(http.Flusher).Flush()
+	}
+}
+
+// Stop ends the heartbeats and delivers any upstream error received after the
+// response was committed as an SSE data event.
+func (hw *HeartbeatWriter) Stop() {
+	close(hw.done)
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	hw.bodyStarted = true
+	if hw.failed && hw.errorBody.Len() > 0 {
+		hw.ResponseWriter.Write([]byte("data: "))
+		hw.ResponseWriter.Write(bytes.TrimSpace(hw.errorBody.Bytes()))
+		hw.ResponseWriter.Write([]byte("\n\n"))
+		hw.ResponseWriter.(http.Flusher).Flush()
+	}
+}
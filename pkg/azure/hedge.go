@@ -0,0 +1,237 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// AzureOpenAIHedgeDelay is how long a request waits for a response before
+	// a duplicate is sent to another backend, zero disables hedging.
+	AzureOpenAIHedgeDelay time.Duration
+	// AzureOpenAIHedgeP95 sets the hedge delay of each backend and
+	// deployment to the p95 of its recent response times instead.
+	AzureOpenAIHedgeP95 = false
+	// AzureOpenAIHedgeOperations are the operations that are hedged. Only
+	// operations without side effects belong here, as both requests reach
+	// Azure.
+	AzureOpenAIHedgeOperations = map[string]bool{"chat/completions": true, "completions": true, "embeddings": true}
+
+	// errHedgeLost cancels the request that lost the race.
+	errHedgeLost = errors.New("hedged request lost")
+
+	hedgeLatencyMu sync.Mutex
+	// hedgeLatencies are the recent response times of each backend and
+	// deployment.
+	hedgeLatencies = map[string]*latencyWindow{}
+
+	hedgedRequests = metrics.NewCounter("azure_oai_proxy_hedged_requests_total",
+		"Requests duplicated to another backend after the hedge delay, by the request that won.", "winner")
+)
+
+func init() {
+	switch v := os.Getenv("AZURE_OPENAI_HEDGE_DELAY"); v {
+	case "":
+	case "p95":
+		AzureOpenAIHedgeP95 = true
+	default:
+		AzureOpenAIHedgeDelay = envDuration("AZURE_OPENAI_HEDGE_DELAY", 0)
+	}
+	if v := os.Getenv("AZURE_OPENAI_HEDGE_OPERATIONS"); v != "" {
+		AzureOpenAIHedgeOperations = map[string]bool{}
+		for _, operation := range SplitList(v) {
+			AzureOpenAIHedgeOperations[operation] = true
+		}
+	}
+	if AzureOpenAIHedgeP95 || AzureOpenAIHedgeDelay > 0 {
+		log.Printf("loading azure request hedging: delay %s, operations %s", os.Getenv("AZURE_OPENAI_HEDGE_DELAY"), strings.Join(SortedKeys(AzureOpenAIHedgeOperations), ","))
+	}
+}
+
+// hedgeable reports whether req may be sent twice: a non-streaming request
+// for a hedged operation with another backend to go to. Batch requests are
+// not hedged, nor are stored completions, which Azure would store twice.
+func hedgeable(req *http.Request, info *RequestInfo) bool {
+	if !AzureOpenAIHedgeP95 && AzureOpenAIHedgeDelay <= 0 {
+		return false
+	}
+	if info == nil || info.Backend == nil || info.ResourceScoped || info.PinnedBackend != nil || len(info.Candidates) < 2 ||
+		req.Method != http.MethodPost || info.Priority == PriorityBatch || !AzureOpenAIHedgeOperations[info.Operation] {
+		return false
+	}
+	if replayable, err := bufferBody(req); err != nil || !replayable || req.GetBody == nil {
+		return false
+	}
+	body := replayBody(req)
+	return !gjson.GetBytes(body, "stream").Bool() && !gjson.GetBytes(body, "store").Bool()
+}
+
+func hedgeLatency(backend *Backend, deployment string) *latencyWindow {
+	key := backend.Name + "/" + deployment
+	hedgeLatencyMu.Lock()
+	defer hedgeLatencyMu.Unlock()
+	w, ok := hedgeLatencies[key]
+	if !ok {
+		w = &latencyWindow{}
+		hedgeLatencies[key] = w
+	}
+	return w
+}
+
+// hedgeDelay returns how long to wait for the backend and deployment before
+// hedging, false when its p95 is not known yet.
+func hedgeDelay(backend *Backend, deployment string) (time.Duration, bool) {
+	if !AzureOpenAIHedgeP95 {
+		return AzureOpenAIHedgeDelay, true
+	}
+	return hedgeLatency(backend, deployment).p95(time.Now())
+}
+
+// hedgeLost reports whether req was cancelled because the other request of
+// its hedge answered first.
+func hedgeLost(req *http.Request) bool {
+	return errors.Is(context.Cause(req.Context()), errHedgeLost)
+}
+
+// hedgeAttempt is one of the requests of a hedge.
+type hedgeAttempt struct {
+	index  int
+	info   *RequestInfo
+	resp   *http.Response
+	err    error
+	cancel context.CancelCauseFunc
+}
+
+func (a *hedgeAttempt) failed() bool {
+	return a.err != nil || a.resp.StatusCode == http.StatusTooManyRequests || a.resp.StatusCode >= http.StatusInternalServerError
+}
+
+// discard cancels the attempt and releases its response.
+func (a *hedgeAttempt) discard() {
+	a.cancel(errHedgeLost)
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+}
+
+// hedge sends a duplicate of a request to the next candidate backend when
+// the first has not answered within the hedge delay, and returns the first
+// successful response, cancelling the other request. It wraps spillover, so
+// that each of the requests spills over on its own.
+func hedge(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		info := RequestInfoFromContext(req.Context())
+		if !hedgeable(req, info) {
+			return next.RoundTrip(req)
+		}
+		deployment := deploymentFromPath(req.URL.Path)
+		var other *Backend
+		for _, b := range info.Candidates {
+			if b != info.Backend {
+				other = b
+				break
+			}
+		}
+
+		// Each request gets its own copy of the RequestInfo, the one that
+		// wins is copied back.
+		results := make(chan *hedgeAttempt, 2)
+		var cancels []context.CancelCauseFunc
+		start := func(b *Backend) {
+			attemptInfo := *info
+			ctx, cancel := context.WithCancelCause(req.Context())
+			cancels = append(cancels, cancel)
+			attempt := req.Clone(context.WithValue(ctx, requestInfoKey, &attemptInfo))
+			attempt.Body, _ = req.GetBody()
+			if b != nil {
+				b.apply(attempt, &attemptInfo)
+			}
+			index := len(cancels) - 1
+			go func() {
+				begin := time.Now()
+				resp, err := next.RoundTrip(attempt)
+				if err == nil && resp.StatusCode == http.StatusOK {
+					hedgeLatency(attemptInfo.Backend, deploymentFromPath(resp.Request.URL.Path)).add(time.Since(begin), time.Now())
+				}
+				results <- &hedgeAttempt{index: index, info: &attemptInfo, resp: resp, err: err, cancel: cancel}
+			}()
+		}
+
+		start(nil)
+		var timer <-chan time.Time
+		if delay, ok := hedgeDelay(info.Backend, deployment); ok && other != nil {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			timer = t.C
+		}
+		pending := 1
+		var failed *hedgeAttempt
+		for {
+			select {
+			case <-timer:
+				log.Printf("backend %s has not answered [%s] within the hedge delay, hedging on %s", info.Backend.Name, info.Model, other.Name)
+				start(other)
+				pending++
+				continue
+			case a := <-results:
+				pending--
+				if a.failed() && pending > 0 {
+					// The other request may still succeed.
+					failed = a
+					continue
+				}
+				if failed != nil {
+					failed.discard()
+				}
+				for i, cancel := range cancels {
+					if i != a.index {
+						cancel(errHedgeLost)
+					}
+				}
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						(<-results).discard()
+					}
+				}(pending)
+				if len(cancels) > 1 {
+					winner := "primary"
+					if a.index > 0 {
+						winner = "hedge"
+					}
+					hedgedRequests.Inc(winner)
+				}
+
+				*info = *a.info
+				if a.err != nil {
+					return nil, a.err
+				}
+				a.resp.Request = a.resp.Request.WithContext(req.Context())
+				a.resp.Body = &hedgeBody{ReadCloser: a.resp.Body, cancel: a.cancel}
+				return a.resp, nil
+			}
+		}
+	})
+}
+
+// hedgeBody cancels the request of the winning response once its body is
+// closed.
+type hedgeBody struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (b *hedgeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type accessToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+var (
+	tokenCacheMu sync.Mutex
+	tokenCache   = map[string]accessToken{}
+)
+
+// GetAccessToken returns a Microsoft Entra ID access token for resource, such
+// as "https://vault.azure.net". It uses a service principal when
+// AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET are set, the App
+// Service managed identity endpoint when IDENTITY_ENDPOINT is set, and the
+// instance metadata service otherwise. Tokens are cached until shortly before
+// they expire.
+func GetAccessToken(resource string) (string, error) {
+	tokenCacheMu.Lock()
+	defer tokenCacheMu.Unlock()
+	if token, ok := tokenCache[resource]; ok && time.Until(token.expiresAt) > 5*time.Minute {
+		return token.value, nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case os.Getenv("AZURE_CLIENT_SECRET") != "":
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {os.Getenv("AZURE_CLIENT_ID")},
+			"client_secret": {os.Getenv("AZURE_CLIENT_SECRET")},
+			"scope":         {strings.TrimSuffix(resource, "/") + "/.default"},
+		}
+		endpoint := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", os.Getenv("AZURE_TENANT_ID"))
+		req, err = http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	case os.Getenv("IDENTITY_ENDPOINT") != "":
+		query := url.Values{"resource": {resource}, "api-version": {"2019-08-01"}}
+		if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err = http.NewRequest(http.MethodGet, os.Getenv("IDENTITY_ENDPOINT")+"?"+query.Encode(), nil)
+		if err == nil {
+			req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+		}
+	default:
+		query := url.Values{"resource": {resource}, "api-version": {"2018-02-01"}}
+		if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err = http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get access token for %s: %w", resource, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get access token for %s: %s", resource, string(body))
+	}
+
+	var result struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	expiresIn, _ := result.ExpiresIn.Int64()
+	tokenCache[resource] = accessToken{
+		value:     result.AccessToken,
+		expiresAt: time.Now().Add(time.Duration(expiresIn) * time.Second),
+	}
+	return result.AccessToken, nil
+}
@@ -0,0 +1,142 @@
+package azure
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// validateSchema checks value against the subset of JSON Schema used by
+// function definitions: type, properties, required, additionalProperties,
+// items, enum and anyOf. It returns one message per violation.
+func validateSchema(schema, value gjson.Result, path string) []string {
+	if !schema.IsObject() {
+		return nil
+	}
+	if anyOf := schema.Get("anyOf"); anyOf.IsArray() {
+		for _, sub := range anyOf.Array() {
+			if len(validateSchema(sub, value, path)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s does not match any of the allowed schemas", schemaPath(path))}
+	}
+	if types := schemaTypes(schema); len(types) > 0 && !matchesAnyType(value, types) {
+		return []string{fmt.Sprintf("%s should be %s, got %s", schemaPath(path), strings.Join(types, " or "), jsonType(value))}
+	}
+	if enum := schema.Get("enum"); enum.IsArray() {
+		found := false
+		for _, allowed := range enum.Array() {
+			if allowed.Raw == value.Raw || (allowed.Type == gjson.String && allowed.String() == value.String() && value.Type == gjson.String) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s should be one of %s", schemaPath(path), enum.Raw)}
+		}
+	}
+
+	var errs []string
+	switch {
+	case value.IsObject():
+		properties := schema.Get("properties")
+		for _, name := range schema.Get("required").Array() {
+			if !value.Get(gjson.Escape(name.String())).Exists() {
+				errs = append(errs, fmt.Sprintf("%s is missing required property %q", schemaPath(path), name.String()))
+			}
+		}
+		value.ForEach(func(key, item gjson.Result) bool {
+			sub := properties.Get(gjson.Escape(key.String()))
+			if !sub.Exists() {
+				if additional := schema.Get("additionalProperties"); additional.Type == gjson.False {
+					errs = append(errs, fmt.Sprintf("%s has unexpected property %q", schemaPath(path), key.String()))
+				} else if additional.IsObject() {
+					errs = append(errs, validateSchema(additional, item, path+"."+key.String())...)
+				}
+				return true
+			}
+			errs = append(errs, validateSchema(sub, item, path+"."+key.String())...)
+			return true
+		})
+	case value.IsArray():
+		items := schema.Get("items")
+		for i, item := range value.Array() {
+			errs = append(errs, validateSchema(items, item, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	}
+	return errs
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "arguments"
+	}
+	return "arguments" + path
+}
+
+func schemaTypes(schema gjson.Result) []string {
+	t := schema.Get("type")
+	if t.IsArray() {
+		var types []string
+		for _, item := range t.Array() {
+			types = append(types, item.String())
+		}
+		return types
+	}
+	if t.Exists() {
+		return []string{t.String()}
+	}
+	return nil
+}
+
+func matchesAnyType(value gjson.Result, types []string) bool {
+	for _, t := range types {
+		if matchesType(value, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(value gjson.Result, t string) bool {
+	switch t {
+	case "string":
+		return value.Type == gjson.String
+	case "number":
+		return value.Type == gjson.Number
+	case "integer":
+		return value.Type == gjson.Number && value.Float() == float64(int64(value.Float()))
+	case "boolean":
+		return value.Type == gjson.True || value.Type == gjson.False
+	case "null":
+		return value.Type == gjson.Null
+	case "object":
+		return value.IsObject()
+	case "array":
+		return value.IsArray()
+	}
+	return true
+}
+
+func jsonType(value gjson.Result) string {
+	switch {
+	case value.IsObject():
+		return "object"
+	case value.IsArray():
+		return "array"
+	}
+	switch value.Type {
+	case gjson.String:
+		return "string"
+	case gjson.Number:
+		return "number"
+	case gjson.True, gjson.False:
+		return "boolean"
+	case gjson.Null:
+		return "null"
+	}
+	return "nothing"
+}
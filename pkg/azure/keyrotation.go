@@ -0,0 +1,104 @@
+package azure
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// apiKeys holds the primary and secondary key of an Azure OpenAI resource.
+// When one of them is rejected the other one is used until the rejected key
+// is replaced, which allows rotating keys without downtime.
+type apiKeys struct {
+	mu           sync.Mutex
+	primary      string
+	secondary    string
+	primaryStale bool
+}
+
+// defaultKeys are the keys configured with AZURE_OPENAI_TOKEN and
+// AZURE_OPENAI_TOKEN_SECONDARY.
+var defaultKeys = &apiKeys{}
+
+func (k *apiKeys) set(primary, secondary string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if primary != k.primary {
+		k.primaryStale = false
+	}
+	k.primary = primary
+	k.secondary = secondary
+}
+
+// current returns the key to use for the next request.
+func (k *apiKeys) current() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.primaryStale && k.secondary != "" {
+		return k.secondary
+	}
+	return k.primary
+}
+
+func (k *apiKeys) owns(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return key != "" && k.secondary != "" && (key == k.primary || key == k.secondary)
+}
+
+// reject marks key as rejected and returns the key to retry with.
+func (k *apiKeys) reject(key string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key == k.primary {
+		if !k.primaryStale {
+			log.Printf("primary azure api key was rejected, marking it stale and failing over to the secondary key")
+		}
+		k.primaryStale = true
+		return k.secondary
+	}
+	if k.primaryStale {
+		log.Printf("secondary azure api key was rejected, failing back to the primary key")
+	}
+	k.primaryStale = false
+	return k.primary
+}
+
+// keyFailover retries requests rejected with a 401 using the other key of
+// the backend they were sent to.
+func keyFailover(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		keys := defaultKeys
+		if info := RequestInfoFromContext(req.Context()); info != nil && info.Backend != nil {
+			keys = info.Backend.apiKeys()
+		}
+		key := req.Header.Get("api-key")
+		if !keys.owns(key) {
+			return next.RoundTrip(req)
+		}
+		replayable, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		if !replayable {
+			return next.RoundTrip(req)
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		other := keys.reject(key)
+		if other == "" || other == key {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			retry.Body, _ = req.GetBody()
+		}
+		retry.Header.Set("api-key", other)
+		return next.RoundTrip(retry)
+	})
+}
@@ -0,0 +1,186 @@
+package azure
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// latencyMinSamples is the number of recent samples a backend needs for
+	// its p95 to be known. Backends below it are preferred, so that they are
+	// measured.
+	latencyMinSamples = 5
+	// latencyMaxSamples bounds the samples kept per backend.
+	latencyMaxSamples = 256
+)
+
+var (
+	// AzureOpenAILatencyRouting sends streamed chat completions to the
+	// backend with the lowest p95 time to first byte.
+	AzureOpenAILatencyRouting = false
+	// AzureOpenAILatencyWindow is how long latency samples count towards the
+	// p95 of a backend.
+	AzureOpenAILatencyWindow = 5 * time.Minute
+	// AzureOpenAILatencyHysteresis is how much faster, as a fraction of its
+	// p95, another backend must be to replace the preferred one.
+	AzureOpenAILatencyHysteresis = 0.2
+
+	latencyMu sync.Mutex
+	// latencyLeaders is the preferred backend of each set of candidates.
+	latencyLeaders = map[string]*Backend{}
+
+	backendLatencyP95 = metrics.NewGauge("azure_oai_proxy_backend_latency_p95_seconds",
+		"Rolling p95 time to first byte of streamed chat completions, by backend.", "backend")
+	latencyRouted = metrics.NewCounter("azure_oai_proxy_latency_routed_total",
+		"Streamed chat completions routed by latency, by chosen backend.", "backend")
+)
+
+func init() {
+	AzureOpenAILatencyRouting = envBool("AZURE_OPENAI_LATENCY_ROUTING", AzureOpenAILatencyRouting)
+	AzureOpenAILatencyWindow = envDuration("AZURE_OPENAI_LATENCY_WINDOW", AzureOpenAILatencyWindow)
+	if v := os.Getenv("AZURE_OPENAI_LATENCY_HYSTERESIS"); v != "" {
+		h, err := strconv.ParseFloat(v, 64)
+		if err != nil || h < 0 || h >= 1 {
+			log.Printf("error parsing AZURE_OPENAI_LATENCY_HYSTERESIS, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAILatencyHysteresis = h
+	}
+	if AzureOpenAILatencyRouting {
+		log.Printf("loading azure latency routing: p95 over %s, hysteresis %g", AzureOpenAILatencyWindow, AzureOpenAILatencyHysteresis)
+	}
+}
+
+// latencyWindow holds the recent latencies of a backend.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []latencySample
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+func (w *latencyWindow) add(latency time.Duration, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.prune(now)
+	if len(w.samples) == latencyMaxSamples {
+		w.samples = w.samples[1:]
+	}
+	w.samples = append(w.samples, latencySample{at: now, latency: latency})
+}
+
+// p95 returns the 95th percentile of the samples in the window, and false
+// when there are too few of them.
+func (w *latencyWindow) p95(now time.Time) (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.prune(now)
+	if len(w.samples) < latencyMinSamples {
+		return 0, false
+	}
+	latencies := make([]time.Duration, len(w.samples))
+	for i, s := range w.samples {
+		latencies[i] = s.latency
+	}
+	slices.Sort(latencies)
+	return latencies[(len(latencies)*95-1)/100], true
+}
+
+// prune drops the samples older than the window. w.mu must be held.
+func (w *latencyWindow) prune(now time.Time) {
+	i := 0
+	for i < len(w.samples) && now.Sub(w.samples[i].at) > AzureOpenAILatencyWindow {
+		i++
+	}
+	w.samples = w.samples[i:]
+}
+
+// latencySensitive reports whether a request is routed by latency: a
+// streamed chat completion, whose client waits for the first tokens.
+func latencySensitive(info *RequestInfo, body []byte) bool {
+	return AzureOpenAILatencyRouting && info.Operation == "chat/completions" && gjson.GetBytes(body, "stream").Bool()
+}
+
+// recordLatency adds the time to first byte of a successful stream to the
+// window of the backend that served it.
+func recordLatency(info *RequestInfo, resp *http.Response, latency time.Duration) {
+	if !AzureOpenAILatencyRouting || info == nil || info.Backend == nil || resp.StatusCode != http.StatusOK || !isEventStream(resp) {
+		return
+	}
+	now := time.Now()
+	info.Backend.latency.add(latency, now)
+	if p95, ok := info.Backend.latency.p95(now); ok {
+		backendLatencyP95.Set(p95.Seconds(), info.Backend.Name)
+	}
+}
+
+// orderByLatency puts the fastest backend of each type first, provisioned
+// backends still coming first. The preferred backend of a set of candidates
+// only changes when another is faster by AzureOpenAILatencyHysteresis, so
+// that requests do not flap between backends of similar latency.
+func orderByLatency(backends []*Backend) []*Backend {
+	if len(backends) < 2 {
+		return backends
+	}
+	now := time.Now()
+	p95s := make(map[*Backend]time.Duration, len(backends))
+	for _, b := range backends {
+		// Backends without enough recent samples sort first to be measured.
+		p95s[b], _ = b.latency.p95(now)
+	}
+	ordered := append([]*Backend(nil), backends...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Type != ordered[j].Type {
+			return ordered[i].Type == BackendProvisioned
+		}
+		return p95s[ordered[i]] < p95s[ordered[j]]
+	})
+
+	// Only the backends of the first type are tried before spilling over.
+	group := ordered
+	for i, b := range ordered {
+		if b.Type != ordered[0].Type {
+			group = ordered[:i]
+			break
+		}
+	}
+	names := make([]string, len(group))
+	for i, b := range group {
+		names[i] = b.Name
+	}
+	slices.Sort(names)
+	key := strings.Join(names, ",")
+
+	latencyMu.Lock()
+	leader, ok := latencyLeaders[key]
+	fastest := group[0]
+	if !ok || float64(p95s[fastest]) < float64(p95s[leader])*(1-AzureOpenAILatencyHysteresis) {
+		if ok && leader != fastest {
+			log.Printf("latency routing: preferring backend %s (p95 %s) over %s (p95 %s)",
+				fastest.Name, p95s[fastest].Round(time.Millisecond), leader.Name, p95s[leader].Round(time.Millisecond))
+		}
+		leader = fastest
+		latencyLeaders[key] = leader
+	}
+	latencyMu.Unlock()
+
+	if i := slices.Index(ordered, leader); i > 0 {
+		copy(ordered[1:i+1], ordered[:i])
+		ordered[0] = leader
+	}
+	latencyRouted.Inc(leader.Name)
+	return ordered
+}
@@ -0,0 +1,225 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// AzureOpenAILegacyWarnings adds a Warning header to the responses of
+	// legacy endpoints, naming their replacement, and logs their requests.
+	AzureOpenAILegacyWarnings = false
+	// AzureOpenAITranslateCompletions sends completions requests for chat
+	// models to Azure as chat completions, and returns the responses in the
+	// completions format.
+	AzureOpenAITranslateCompletions = false
+
+	legacyRequests = metrics.NewCounter("azure_oai_proxy_legacy_requests_total",
+		"Requests to legacy endpoints, by endpoint and whether they were translated.", "endpoint", "translated")
+)
+
+// completionsModels are the prefixes of the models that serve completions,
+// the other models only serve chat completions.
+var completionsModels = []string{"babbage-", "code-", "davinci-", "gpt-35-turbo-instruct", "gpt-3.5-turbo-instruct", "text-"}
+
+func init() {
+	AzureOpenAILegacyWarnings = envBool("AZURE_OPENAI_LEGACY_WARNINGS", AzureOpenAILegacyWarnings)
+	if AzureOpenAILegacyWarnings {
+		log.Printf("loading azure legacy endpoint warnings: enabled")
+	}
+	AzureOpenAITranslateCompletions = envBool("AZURE_OPENAI_TRANSLATE_COMPLETIONS", AzureOpenAITranslateCompletions)
+	if AzureOpenAITranslateCompletions {
+		log.Printf("loading azure completions translation: enabled")
+	}
+}
+
+// chatOnlyModel reports whether neither model nor the deployment it is
+// mapped to serves completions.
+func chatOnlyModel(model string) bool {
+	for _, name := range []string{model, GetDeploymentByModel(model)} {
+		for _, prefix := range completionsModels {
+			if strings.HasPrefix(name, prefix) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LegacyRequest is what the proxy does with a request to a legacy endpoint.
+type LegacyRequest struct {
+	// Warning is the value of the Warning header for the response, empty
+	// when warnings are disabled.
+	Warning string
+	// Body is the request body, translated when Translated is set.
+	Body []byte
+	// Translated is set when a completions request was turned into a chat
+	// completions request.
+	Translated bool
+	// NotTranslated is why a completions request for a chat model could
+	// not be translated, if it was to be.
+	NotTranslated string
+}
+
+// HandleLegacyEndpoint checks whether a request goes to a legacy endpoint:
+// the fine_tunes API, replaced by fine_tuning jobs, or completions for a chat
+// model. It returns nil for other requests. The request is counted, and
+// logged when warnings are enabled.
+func HandleLegacyEndpoint(path, keyName string, body []byte) *LegacyRequest {
+	var endpoint, model, replacement string
+	switch {
+	case strings.HasPrefix(path, "/v1/fine_tunes"):
+		endpoint, replacement = "fine_tunes", "/v1/fine_tuning/jobs"
+	case path == "/v1/completions":
+		model = gjson.GetBytes(body, "model").String()
+		if model == "" || !chatOnlyModel(model) {
+			return nil
+		}
+		endpoint, replacement = "completions", "/v1/chat/completions"
+	default:
+		return nil
+	}
+
+	legacy := &LegacyRequest{Body: body}
+	if endpoint == "completions" && AzureOpenAITranslateCompletions {
+		translated, err := translateCompletionsRequest(body)
+		if err != nil {
+			legacy.NotTranslated = err.Error()
+		} else {
+			legacy.Body, legacy.Translated = translated, true
+		}
+	}
+	legacyRequests.Inc(endpoint, strconv.FormatBool(legacy.Translated))
+	if !AzureOpenAILegacyWarnings {
+		return legacy
+	}
+
+	message := fmt.Sprintf("%s is deprecated, use %s instead", path, replacement)
+	if model != "" {
+		message = fmt.Sprintf("%s is deprecated for the chat model %s, use %s instead", path, model, replacement)
+	}
+	legacy.Warning = "299 - " + strconv.Quote(message)
+	log.Printf("legacy endpoint: %s [%s] key %q, translated %t", path, model, keyName, legacy.Translated)
+	return legacy
+}
+
+// completionsParameters are the completions request parameters that chat
+// completions take as they are.
+var completionsParameters = []string{"model", "max_tokens", "temperature", "top_p", "n", "stream", "stream_options",
+	"stop", "presence_penalty", "frequency_penalty", "logit_bias", "user", "seed"}
+
+// translateCompletionsRequest turns a completions request body into a chat
+// completions request with the prompt as the user message. Prompts that have
+// no chat equivalent, such as several prompts at once, are rejected.
+func translateCompletionsRequest(body []byte) ([]byte, error) {
+	prompt := gjson.GetBytes(body, "prompt")
+	if prompt.IsArray() {
+		prompts := prompt.Array()
+		if len(prompts) != 1 {
+			return nil, fmt.Errorf("%d prompts cannot be sent as one chat completion", len(prompts))
+		}
+		prompt = prompts[0]
+	}
+	if prompt.Exists() && prompt.Type != gjson.String {
+		return nil, fmt.Errorf("token prompts cannot be sent as a chat completion")
+	}
+	for _, field := range []string{"suffix", "echo"} {
+		if v := gjson.GetBytes(body, field); v.Exists() && v.Type != gjson.Null && v.Type != gjson.False {
+			return nil, fmt.Errorf("%s is not supported by chat completions", field)
+		}
+	}
+	if gjson.GetBytes(body, "best_of").Int() > 1 {
+		return nil, fmt.Errorf("best_of is not supported by chat completions")
+	}
+
+	chat := []byte(`{}`)
+	for _, field := range completionsParameters {
+		if v := gjson.GetBytes(body, field); v.Exists() {
+			chat, _ = sjson.SetRawBytes(chat, field, []byte(v.Raw))
+		}
+	}
+	message, _ := sjson.SetBytes([]byte(`{"role":"user"}`), "content", prompt.String())
+	chat, _ = sjson.SetRawBytes(chat, "messages", []byte("["+string(message)+"]"))
+	if logprobs := gjson.GetBytes(body, "logprobs"); logprobs.Type == gjson.Number {
+		chat, _ = sjson.SetBytes(chat, "logprobs", true)
+		chat, _ = sjson.SetBytes(chat, "top_logprobs", logprobs.Int())
+	}
+	return chat, nil
+}
+
+// translateCompletionsResponse returns the chat completions response of a
+// translated completions request in the completions format.
+func translateCompletionsResponse(res *http.Response) error {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || !info.LegacyCompletions || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	return rewriteResponseEvents(res, chatToCompletion)
+}
+
+// chatToCompletion converts a chat completion, or a chunk of one, to a text
+// completion. Stream events with empty choices, such as the prompt filter
+// results and the usage, only get the object changed.
+func chatToCompletion(body []byte) []byte {
+	if !gjson.GetBytes(body, "choices").Exists() {
+		return body
+	}
+	body, _ = sjson.SetBytes(body, "object", "text_completion")
+	choices := []byte(`[]`)
+	gjson.GetBytes(body, "choices").ForEach(func(_, choice gjson.Result) bool {
+		text := choice.Get("message.content")
+		if !text.Exists() {
+			text = choice.Get("delta.content")
+		}
+		c := []byte(`{}`)
+		c, _ = sjson.SetBytes(c, "text", text.String())
+		c, _ = sjson.SetBytes(c, "index", choice.Get("index").Int())
+		c, _ = sjson.SetRawBytes(c, "logprobs", completionLogprobs(choice.Get("logprobs.content")))
+		if reason := choice.Get("finish_reason"); reason.Exists() {
+			c, _ = sjson.SetRawBytes(c, "finish_reason", []byte(reason.Raw))
+		}
+		if filter := choice.Get("content_filter_results"); filter.Exists() {
+			c, _ = sjson.SetRawBytes(c, "content_filter_results", []byte(filter.Raw))
+		}
+		choices, _ = sjson.SetRawBytes(choices, "-1", c)
+		return true
+	})
+	body, _ = sjson.SetRawBytes(body, "choices", choices)
+	body, _ = sjson.DeleteBytes(body, "system_fingerprint")
+	return body
+}
+
+// completionLogprobs converts the logprobs content of a chat choice to the
+// logprobs of a completions choice, null when there are none.
+func completionLogprobs(content gjson.Result) []byte {
+	if !content.IsArray() {
+		return []byte(`null`)
+	}
+	logprobs := []byte(`{"tokens":[],"token_logprobs":[],"top_logprobs":[],"text_offset":[]}`)
+	offset := 0
+	content.ForEach(func(_, entry gjson.Result) bool {
+		token := entry.Get("token").String()
+		logprobs, _ = sjson.SetBytes(logprobs, "tokens.-1", token)
+		logprobs, _ = sjson.SetRawBytes(logprobs, "token_logprobs.-1", []byte(entry.Get("logprob").Raw))
+		top := map[string]float64{}
+		entry.Get("top_logprobs").ForEach(func(_, alt gjson.Result) bool {
+			top[alt.Get("token").String()] = alt.Get("logprob").Float()
+			return true
+		})
+		topJSON, _ := json.Marshal(top)
+		logprobs, _ = sjson.SetRawBytes(logprobs, "top_logprobs.-1", topJSON)
+		logprobs, _ = sjson.SetBytes(logprobs, "text_offset.-1", offset)
+		offset += utf8.RuneCountInString(token)
+		return true
+	})
+	return logprobs
+}
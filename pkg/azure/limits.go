@@ -0,0 +1,166 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// AzureOpenAIMaxTokens caps max_tokens per model, "*" applies to every model.
+	AzureOpenAIMaxTokens = map[string]int{}
+	// AzureOpenAIMaxInputTokens caps the estimated prompt tokens per model.
+	AzureOpenAIMaxInputTokens = map[string]int{}
+	// AzureOpenAITokenLimitMode is either "reject" or "truncate".
+	AzureOpenAITokenLimitMode = "reject"
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_MAX_TOKENS"); v != "" {
+		AzureOpenAIMaxTokens = parseTokenLimits("AZURE_OPENAI_MAX_TOKENS", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_MAX_INPUT_TOKENS"); v != "" {
+		AzureOpenAIMaxInputTokens = parseTokenLimits("AZURE_OPENAI_MAX_INPUT_TOKENS", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_TOKEN_LIMIT_MODE"); v != "" {
+		if v != "reject" && v != "truncate" {
+			log.Printf("error parsing AZURE_OPENAI_TOKEN_LIMIT_MODE, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAITokenLimitMode = v
+	}
+
+	for k, v := range AzureOpenAIMaxTokens {
+		log.Printf("loading azure max tokens: %s -> %d", k, v)
+	}
+	for k, v := range AzureOpenAIMaxInputTokens {
+		log.Printf("loading azure max input tokens: %s -> %d", k, v)
+	}
+}
+
+func parseTokenLimits(name, value string) map[string]int {
+	limits := map[string]int{}
+	for model, limit := range parseKeyValueList(name, value) {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			log.Printf("error parsing %s, invalid limit %s=%s", name, model, limit)
+			os.Exit(1)
+		}
+		limits[model] = n
+	}
+	return limits
+}
+
+func lookupTokenLimit(limits map[string]int, model string) (int, bool) {
+	if v, ok := limits[model]; ok {
+		return v, true
+	}
+	if v, ok := limits[GetDeploymentByModel(model)]; ok {
+		return v, true
+	}
+	v, ok := limits["*"]
+	return v, ok
+}
+
+// ApplyTokenLimits enforces the configured max_tokens ceiling and prompt size
+// for the model named in body. Depending on AzureOpenAITokenLimitMode an
+// oversized request is either rejected or clamped, in which case the
+// rewritten body is returned. The ceiling applies to chat completions and
+// completions, the prompt size also to the input of embeddings; bodies of
+// other operations are returned unchanged.
+func ApplyTokenLimits(operation string, body []byte) ([]byte, error) {
+	prompt := "messages"
+	switch operation {
+	case "chat/completions":
+	case "completions":
+		prompt = "prompt"
+	case "embeddings":
+		prompt = "input"
+	default:
+		return body, nil
+	}
+	model := gjson.GetBytes(body, "model").String()
+	truncate := AzureOpenAITokenLimitMode == "truncate"
+
+	if ceiling, ok := lookupTokenLimit(AzureOpenAIMaxTokens, model); ok && operation != "embeddings" {
+		field := "max_tokens"
+		if gjson.GetBytes(body, "max_completion_tokens").Exists() {
+			field = "max_completion_tokens"
+		}
+		requested := gjson.GetBytes(body, field)
+		if requested.Exists() && requested.Int() > int64(ceiling) && !truncate {
+			return nil, NewInvalidRequestError(field, "max_tokens_exceeded",
+				fmt.Sprintf("%s is too large: %d. This model supports at most %d completion tokens on this proxy.", field, requested.Int(), ceiling))
+		}
+		if !requested.Exists() || requested.Int() > int64(ceiling) {
+			var err error
+			if body, err = sjson.SetBytes(body, field, ceiling); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	limit, ok := lookupTokenLimit(AzureOpenAIMaxInputTokens, model)
+	if !ok {
+		return body, nil
+	}
+	estimated := EstimateRequestTokens(body)
+	if estimated <= limit {
+		return body, nil
+	}
+	if truncate && gjson.GetBytes(body, "messages").IsArray() {
+		if truncated, ok := truncateMessages(body, limit); ok {
+			log.Printf("truncated prompt for model %s from ~%d to the %d input token limit", model, estimated, limit)
+			return truncated, nil
+		}
+	}
+	return nil, NewInvalidRequestError(prompt, "context_length_exceeded",
+		fmt.Sprintf("This model's maximum context length on this proxy is %d tokens. However, your %s resulted in approximately %d tokens. Please reduce the length of the %s.", limit, prompt, estimated, prompt))
+}
+
+// truncateMessages drops the oldest non-system messages, always keeping the
+// last one, until the estimated prompt fits within limit.
+func truncateMessages(body []byte, limit int) ([]byte, bool) {
+	messages := gjson.GetBytes(body, "messages").Array()
+	costs := make([]int, len(messages))
+	total := tokensPerReply
+	for i, message := range messages {
+		costs[i] = EstimateMessageTokens(message)
+		total += costs[i]
+	}
+
+	dropped := make([]bool, len(messages))
+	for i := 0; i < len(messages)-1; i++ {
+		role := messages[i].Get("role").String()
+		if role == "system" || role == "developer" {
+			continue
+		}
+		// Tool results must not outlive the assistant message that requested them.
+		orphaned := role == "tool" && i > 0 && dropped[i-1]
+		if total <= limit && !orphaned {
+			break
+		}
+		dropped[i] = true
+		total -= costs[i]
+	}
+	if total > limit {
+		return nil, false
+	}
+
+	kept := make([]string, 0, len(messages))
+	for i, message := range messages {
+		if !dropped[i] {
+			kept = append(kept, message.Raw)
+		}
+	}
+	body, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(kept, ",")+"]"))
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
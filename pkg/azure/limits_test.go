@@ -0,0 +1,91 @@
+package azure
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestApplyTokenLimits(t *testing.T) {
+	defer func(maxTokens, maxInput map[string]int) {
+		AzureOpenAIMaxTokens, AzureOpenAIMaxInputTokens = maxTokens, maxInput
+	}(AzureOpenAIMaxTokens, AzureOpenAIMaxInputTokens)
+	AzureOpenAIMaxTokens = map[string]int{"*": 100}
+	AzureOpenAIMaxInputTokens = map[string]int{"*": 50}
+	long := strings.Repeat("word ", 200)
+
+	tests := []struct {
+		name      string
+		operation string
+		body      string
+		// wantMaxTokens is the max_tokens sent, empty when the body is
+		// unchanged.
+		wantMaxTokens string
+		wantCode      string
+	}{
+		{
+			name:          "chat completions get the ceiling",
+			operation:     "chat/completions",
+			body:          `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+			wantMaxTokens: "100",
+		},
+		{
+			name:          "completions get the ceiling",
+			operation:     "completions",
+			body:          `{"model":"gpt-35-turbo-instruct","prompt":"hi"}`,
+			wantMaxTokens: "100",
+		},
+		{
+			name:      "chat completions over the input cap",
+			operation: "chat/completions",
+			body:      `{"model":"gpt-4o","max_tokens":10,"messages":[{"role":"user","content":"` + long + `"}]}`,
+			wantCode:  "context_length_exceeded",
+		},
+		{
+			name:      "embeddings pass through",
+			operation: "embeddings",
+			body:      `{"model":"text-embedding-3-small","input":"hi"}`,
+		},
+		{
+			name:      "embeddings over the input cap",
+			operation: "embeddings",
+			body:      `{"model":"text-embedding-3-small","input":"` + long + `"}`,
+			wantCode:  "context_length_exceeded",
+		},
+		{
+			name:      "images pass through",
+			operation: "images/generations",
+			body:      `{"model":"dall-e-3","prompt":"` + long + `"}`,
+		},
+		{
+			name:      "speech passes through",
+			operation: "audio/speech",
+			body:      `{"model":"tts-1","input":"` + long + `","voice":"alloy"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyTokenLimits(tt.operation, []byte(tt.body))
+			if tt.wantCode != "" {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) || apiErr.Code != tt.wantCode {
+					t.Fatalf("ApplyTokenLimits() error = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyTokenLimits() error = %v", err)
+			}
+			if tt.wantMaxTokens == "" {
+				if !bytes.Equal(got, []byte(tt.body)) {
+					t.Errorf("ApplyTokenLimits() = %s, want it unchanged", got)
+				}
+			} else if maxTokens := gjson.GetBytes(got, "max_tokens").Raw; maxTokens != tt.wantMaxTokens {
+				t.Errorf("max_tokens = %s, want %s", maxTokens, tt.wantMaxTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package azure
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ProxyWarningHeader tells the client that the proxy changed its request.
+// It is added once per change.
+const ProxyWarningHeader = "X-Proxy-Warning"
+
+const (
+	// chatLogprobsAPIVersion is the first api-version that accepts logprobs
+	// and top_logprobs on chat completions.
+	chatLogprobsAPIVersion = "2023-12-01-preview"
+	// maxChatTopLogprobs and maxCompletionsLogprobs are the most alternative
+	// tokens Azure returns per position.
+	maxChatTopLogprobs     = 20
+	maxCompletionsLogprobs = 5
+)
+
+// apiVersionBefore reports whether the api-version version was released
+// before than. Both start with their release date.
+func apiVersionBefore(version, than string) bool {
+	if len(version) > 10 {
+		version = version[:10]
+	}
+	if len(than) > 10 {
+		than = than[:10]
+	}
+	return version < than
+}
+
+// ApplyLogprobsCompat makes the logprobs parameters of a chat completions or
+// completions request body work the same on every api-version. Chat clients
+// may send the completions style logprobs count and completions clients the
+// chat style flag, top_logprobs without logprobs is enabled, counts are
+// capped to what Azure accepts and chat logprobs are removed when the
+// api-version cannot return them. It returns the body, whether chat logprobs
+// were requested, and a warning for every change the client should know
+// about.
+func ApplyLogprobsCompat(path string, body []byte) ([]byte, bool, []string) {
+	logprobs := gjson.GetBytes(body, "logprobs")
+	top := gjson.GetBytes(body, "top_logprobs")
+	if !logprobs.Exists() && !top.Exists() {
+		return body, false, nil
+	}
+	var warnings []string
+	if path == "/v1/completions" {
+		count := top.Int()
+		switch logprobs.Type {
+		case gjson.Number:
+			count = logprobs.Int()
+		case gjson.False:
+			body, _ = sjson.DeleteBytes(body, "logprobs")
+			body, _ = sjson.DeleteBytes(body, "top_logprobs")
+			return body, false, nil
+		}
+		if count > maxCompletionsLogprobs {
+			warnings = append(warnings, fmt.Sprintf("logprobs was lowered from %d to %d, the most Azure returns", count, maxCompletionsLogprobs))
+			count = maxCompletionsLogprobs
+		}
+		body, _ = sjson.SetBytes(body, "logprobs", count)
+		body, _ = sjson.DeleteBytes(body, "top_logprobs")
+		return body, false, warnings
+	}
+
+	count, hasCount := top.Int(), top.Exists()
+	if logprobs.Type == gjson.Number && !hasCount {
+		count, hasCount = logprobs.Int(), true
+	}
+	if logprobs.Type == gjson.False {
+		body, _ = sjson.DeleteBytes(body, "top_logprobs")
+		return body, false, nil
+	}
+	if apiVersionBefore(AzureOpenAIAPIVersion, chatLogprobsAPIVersion) {
+		body, _ = sjson.DeleteBytes(body, "logprobs")
+		body, _ = sjson.DeleteBytes(body, "top_logprobs")
+		warnings = append(warnings, fmt.Sprintf("logprobs were removed, api-version %s does not support them for chat completions", AzureOpenAIAPIVersion))
+		return body, false, warnings
+	}
+	body, _ = sjson.SetBytes(body, "logprobs", true)
+	if hasCount {
+		if count > maxChatTopLogprobs {
+			warnings = append(warnings, fmt.Sprintf("top_logprobs was lowered from %d to %d, the most Azure returns", count, maxChatTopLogprobs))
+			count = maxChatTopLogprobs
+		}
+		body, _ = sjson.SetBytes(body, "top_logprobs", count)
+	}
+	return body, true, warnings
+}
+
+// normalizeLogprobs fills in the bytes and top_logprobs fields that some
+// api-versions leave out of chat completions logprobs, so that clients
+// always get the OpenAI shape.
+func normalizeLogprobs(res *http.Response) error {
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || !info.Logprobs {
+		return nil
+	}
+	return rewriteResponseEvents(res, fillLogprobs)
+}
+
+// jsonSet is a value to set at a path of a JSON document.
+type jsonSet struct {
+	path  string
+	value any
+}
+
+func fillLogprobs(body []byte) []byte {
+	var sets []jsonSet
+	gjson.GetBytes(body, "choices").ForEach(func(i, choice gjson.Result) bool {
+		for _, field := range []string{"content", "refusal"} {
+			path := "choices." + i.String() + ".logprobs." + field
+			choice.Get("logprobs." + field).ForEach(func(j, entry gjson.Result) bool {
+				entryPath := path + "." + j.String()
+				if !entry.Get("bytes").Exists() {
+					sets = append(sets, jsonSet{entryPath + ".bytes", tokenBytes(entry.Get("token").String())})
+				}
+				if !entry.Get("top_logprobs").Exists() {
+					sets = append(sets, jsonSet{entryPath + ".top_logprobs", []any{}})
+				}
+				entry.Get("top_logprobs").ForEach(func(k, alt gjson.Result) bool {
+					if !alt.Get("bytes").Exists() {
+						sets = append(sets, jsonSet{entryPath + ".top_logprobs." + k.String() + ".bytes", tokenBytes(alt.Get("token").String())})
+					}
+					return true
+				})
+				return true
+			})
+		}
+		return true
+	})
+	for _, set := range sets {
+		if next, err := sjson.SetBytes(body, set.path, set.value); err == nil {
+			body = next
+		}
+	}
+	return body
+}
+
+// tokenBytes returns the UTF-8 bytes of token as OpenAI reports them, a list
+// of integers.
+func tokenBytes(token string) []int {
+	b := make([]int, len(token))
+	for i := range len(token) {
+		b[i] = int(token[i])
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	upstreamRequests = metrics.NewCounter("azure_oai_proxy_upstream_requests_total",
+		"Requests sent to Azure OpenAI, including retries.", "backend", "deployment", "status")
+	upstreamLatency = metrics.NewHistogram("azure_oai_proxy_upstream_latency_seconds",
+		"Time until Azure OpenAI returned the response headers.", metrics.DefaultBuckets, "backend", "deployment")
+	clientCancelled = metrics.NewCounter("azure_oai_proxy_client_cancelled_total",
+		"Upstream requests cancelled because the client went away, before or during the response body.", "backend", "deployment")
+	activeStreams = metrics.NewGauge("azure_oai_proxy_active_streams",
+		"SSE responses currently being relayed to clients.", "deployment")
+	canaryRequests = metrics.NewCounter("azure_oai_proxy_canary_requests_total",
+		"Requests routed by canary splits, by variant.", "model", "deployment", "variant")
+)
+
+// deploymentFromPath returns the deployment of an upstream request path.
+func deploymentFromPath(p string) string {
+	rest, ok := strings.CutPrefix(p, "/openai/deployments/")
+	if !ok {
+		return ""
+	}
+	deployment, _, _ := strings.Cut(rest, "/")
+	return deployment
+}
+
+func backendName(req *http.Request) string {
+	if info := RequestInfoFromContext(req.Context()); info != nil && info.Backend != nil {
+		return info.Backend.Name
+	}
+	return req.URL.Host
+}
+
+// instrument records every upstream attempt. It sits closest to the
+// network so that retries are counted individually.
+func instrument(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		backend, deployment := backendName(req), deploymentFromPath(req.URL.Path)
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		latency := time.Since(start)
+		upstreamLatency.Observe(latency.Seconds(), backend, deployment)
+		info := RequestInfoFromContext(req.Context())
+		if info != nil {
+			info.UpstreamLatency = latency
+		}
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+			observeUpstream(backend, deployment, resp.StatusCode, latency)
+			recordCapacity(backend, deployment, resp.Header)
+			recordLatency(info, resp, latency)
+			resp.Body = &cancelWatcher{ReadCloser: resp.Body, req: req, backend: backend, deployment: deployment}
+		} else if isClientCancel(req, err) {
+			status = "client_cancelled"
+			clientCancelled.Inc(backend, deployment)
+		} else if hedgeLost(req) {
+			status = "hedge_cancelled"
+		}
+		upstreamRequests.Inc(backend, deployment, status)
+		if info != nil && info.Backend != nil && status != "client_cancelled" && status != "hedge_cancelled" {
+			code := 0
+			if resp != nil {
+				code = resp.StatusCode
+			}
+			info.Backend.stats.record(code, err, latency)
+		}
+		return resp, err
+	})
+}
+
+// isClientCancel reports whether err is the cancellation of req by a client
+// that disconnected. The upstream request is cancelled with it, so that Azure
+// stops generating tokens nobody reads.
+func isClientCancel(req *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) && errors.Is(req.Context().Err(), context.Canceled) && !hedgeLost(req)
+}
+
+// cancelWatcher counts a response body whose read was cancelled by the
+// client going away, e.g. in the middle of a stream.
+type cancelWatcher struct {
+	io.ReadCloser
+	req                 *http.Request
+	backend, deployment string
+	counted             bool
+}
+
+func (w *cancelWatcher) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !w.counted && isClientCancel(w.req, err) {
+		w.counted = true
+		clientCancelled.Inc(w.backend, w.deployment)
+	}
+	return n, err
+}
+
+// trackStream counts res as an active stream until its body is closed.
+func trackStream(res *http.Response) {
+	deployment := deploymentFromPath(res.Request.URL.Path)
+	activeStreams.Inc(deployment)
+	res.Body = &streamTracker{ReadCloser: res.Body, deployment: deployment}
+}
+
+type streamTracker struct {
+	io.ReadCloser
+	deployment string
+	once       sync.Once
+}
+
+func (t *streamTracker) Close() error {
+	t.once.Do(func() { activeStreams.Dec(t.deployment) })
+	return t.ReadCloser.Close()
+}
@@ -0,0 +1,135 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+// MirrorRoute copies Percent of the requests for a model to Deployment,
+// on Backend if set and otherwise on the backend serving the request.
+type MirrorRoute struct {
+	Backend    *Backend
+	Deployment string
+	Percent    float64
+}
+
+var (
+	// AzureOpenAIMirrors maps models to their mirror route.
+	AzureOpenAIMirrors = map[string]MirrorRoute{}
+	// AzureOpenAIMirrorTimeout bounds each mirrored request.
+	AzureOpenAIMirrorTimeout = 5 * time.Minute
+
+	// mirrorSlots bounds the mirrored requests in flight. Requests beyond it
+	// are not mirrored, so that shadow traffic never piles up.
+	mirrorSlots = make(chan struct{}, 32)
+
+	mirrorRequests = metrics.NewCounter("azure_oai_proxy_mirror_requests_total",
+		"Requests mirrored to shadow deployments, by status or \"dropped\".", "model", "deployment", "status")
+	mirrorLatency = metrics.NewHistogram("azure_oai_proxy_mirror_latency_seconds",
+		"Time until a mirrored request was fully read.", metrics.DefaultBuckets, "model", "deployment")
+)
+
+// loadMirrors reads AZURE_OPENAI_MIRROR, once the backends are loaded.
+func loadMirrors() {
+	v := os.Getenv("AZURE_OPENAI_MIRROR")
+	if v == "" {
+		return
+	}
+	AzureOpenAIMirrorTimeout = envDuration("AZURE_OPENAI_MIRROR_TIMEOUT", AzureOpenAIMirrorTimeout)
+	for model, route := range parseKeyValueList("AZURE_OPENAI_MIRROR", v) {
+		target, percent, ok := strings.Cut(route, ":")
+		p, err := strconv.ParseFloat(percent, 64)
+		if !ok || target == "" || err != nil || p < 0 || p > 100 {
+			log.Printf("error parsing AZURE_OPENAI_MIRROR, invalid value %s=%s", model, route)
+			os.Exit(1)
+		}
+		mirror := MirrorRoute{Deployment: target, Percent: p}
+		if name, deployment, ok := strings.Cut(target, "/"); ok {
+			mirror.Deployment = deployment
+			if mirror.Backend = BackendByName(name); mirror.Backend == nil {
+				log.Printf("error parsing AZURE_OPENAI_MIRROR, unknown backend %s", name)
+				os.Exit(1)
+			}
+		}
+		AzureOpenAIMirrors[model] = mirror
+		log.Printf("loading azure mirror: %.2f%% of %s -> %s", p, model, target)
+	}
+}
+
+// MirrorRequest sends a copy of a chat completions, completions or
+// embeddings request with body to the mirror deployment of its model, for a
+// share of the requests. The copy runs in the background, its response is
+// discarded and it is not charged to the client's budget or rate limit.
+func MirrorRequest(req *http.Request, body []byte) {
+	switch req.URL.Path {
+	case "/v1/chat/completions", "/v1/completions", "/v1/embeddings":
+	default:
+		return
+	}
+	model := gjson.GetBytes(body, "model").String()
+	route, ok := AzureOpenAIMirrors[model]
+	if !ok || rand.Float64()*100 >= route.Percent {
+		return
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirrorRequests.Inc(model, route.Deployment, "dropped")
+		return
+	}
+
+	// The copy must outlive the client request and carry none of its
+	// response handling, only the client identity.
+	parent := RequestInfoFromContext(req.Context())
+	info := &RequestInfo{}
+	if parent != nil {
+		info.KeyName, info.EntraToken, info.Tenant = parent.KeyName, parent.EntraToken, parent.Tenant
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), requestInfoKey, info), AzureOpenAIMirrorTimeout)
+	mreq, err := http.NewRequestWithContext(ctx, req.Method, "/", bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		<-mirrorSlots
+		return
+	}
+	mreq.Header.Set("Content-Type", "application/json")
+	mreq.URL.RawQuery = "api-version=" + AzureOpenAIAPIVersion
+	info.Model = model
+	info.Deployment = route.Deployment
+	info.Operation = strings.TrimPrefix(req.URL.Path, "/v1/")
+	info.ClientKey = ClientKey(req.Header)
+	backend := route.Backend
+	if backend == nil {
+		backend = candidateBackends(model, info.Tenant)[0]
+	}
+	info.Candidates = []*Backend{backend}
+	backend.apply(mreq, info)
+
+	go func() {
+		defer func() { <-mirrorSlots }()
+		defer cancel()
+
+		start := time.Now()
+		resp, err := Client.Do(mreq)
+		if err != nil {
+			mirrorRequests.Inc(model, route.Deployment, "error")
+			log.Printf("error mirroring request [%s] to %s: %v", model, route.Deployment, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mirrorLatency.Observe(time.Since(start).Seconds(), model, route.Deployment)
+		mirrorRequests.Inc(model, route.Deployment, strconv.Itoa(resp.StatusCode))
+	}()
+}
@@ -0,0 +1,79 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// AzureOpenAIRewriteResponseModel replaces the deployment name that Azure
+// reports in the model field of responses with the model the client asked
+// for.
+var AzureOpenAIRewriteResponseModel = false
+
+func init() {
+	AzureOpenAIRewriteResponseModel = envBool("AZURE_OPENAI_REWRITE_RESPONSE_MODEL", AzureOpenAIRewriteResponseModel)
+	if AzureOpenAIRewriteResponseModel {
+		log.Printf("loading azure response model rewrite: enabled")
+	}
+}
+
+// rewriteResponseModel sets the model field of a JSON response, or of every
+// event of an SSE stream, to the model of the request.
+func rewriteResponseModel(res *http.Response) error {
+	if !AzureOpenAIRewriteResponseModel || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || info.Model == "" || info.ResourceScoped {
+		return nil
+	}
+	return rewriteResponseEvents(res, func(body []byte) []byte {
+		return setResponseModel(body, info.Model)
+	})
+}
+
+// setResponseModel replaces a non-empty model field of body with model.
+// Azure sends the prompt filter results in a first event without a model,
+// which is left as is.
+func setResponseModel(body []byte, model string) []byte {
+	if gjson.GetBytes(body, "model").String() == "" {
+		return body
+	}
+	rewritten, err := sjson.SetBytes(body, "model", model)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
+
+// rewriteResponseEvents applies rewrite to the body of a JSON response, or
+// adds it as a stage to the pipeline of an SSE stream.
+func rewriteResponseEvents(res *http.Response, rewrite func([]byte) []byte) error {
+	if isEventStream(res) {
+		AddStreamStage(res, StreamStageFunc(rewrite))
+		return nil
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = rewrite(body)
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,162 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// chatAudioAPIVersion is the first api-version that accepts audio input
+	// and output on chat completions.
+	chatAudioAPIVersion = "2025-01-01-preview"
+	// chatVisionAPIVersion is the first api-version that accepts image_url
+	// content parts.
+	chatVisionAPIVersion = "2023-12-01-preview"
+)
+
+// AzureOpenAIMultimodalAPIVersion is the api-version chat completions with
+// audio or images are sent with when AzureOpenAIAPIVersion predates them.
+var AzureOpenAIMultimodalAPIVersion = chatAudioAPIVersion
+
+// inputAudioFormats are the formats of input_audio content parts Azure
+// accepts.
+var inputAudioFormats = map[string]bool{"wav": true, "mp3": true}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_MULTIMODAL_APIVERSION"); v != "" {
+		if apiVersionBefore(v, chatAudioAPIVersion) {
+			log.Printf("error parsing AZURE_OPENAI_MULTIMODAL_APIVERSION, invalid value %s, audio needs %s or later", v, chatAudioAPIVersion)
+			os.Exit(1)
+		}
+		AzureOpenAIMultimodalAPIVersion = v
+		log.Printf("loading azure multimodal api version: %s", v)
+	}
+}
+
+// RequestsAudio reports whether a chat completions request body asks for an
+// audio answer.
+func RequestsAudio(body []byte) bool {
+	for _, modality := range gjson.GetBytes(body, "modalities").Array() {
+		if modality.String() == "audio" {
+			return true
+		}
+	}
+	return false
+}
+
+// base64Size returns the decoded size of base64 data.
+func base64Size(data string) int64 {
+	return int64(len(data))*3/4 - int64(len(data)-len(strings.TrimRight(data, "=")))
+}
+
+// MultimodalRequest is what ApplyMultimodal made of a chat completions
+// request with audio or images.
+type MultimodalRequest struct {
+	Body []byte
+	// APIVersion is the api-version to send the request with, empty for
+	// AzureOpenAIAPIVersion.
+	APIVersion string
+	// Warnings are the changes the client should know about.
+	Warnings []string
+}
+
+// ApplyMultimodal checks the input_audio and image_url content parts of a
+// chat completions request body against Azure's formats and the size limits,
+// zero for none, and picks an api-version that supports them and the audio
+// modality. A request for audio output without modalities gets them set.
+func ApplyMultimodal(body []byte, maxAudioSize, maxImageSize int64) (*MultimodalRequest, error) {
+	m := &MultimodalRequest{Body: body}
+	audio, images := RequestsAudio(body), false
+	if gjson.GetBytes(body, "audio").IsObject() && !gjson.GetBytes(body, "modalities").Exists() {
+		m.Body, _ = sjson.SetRawBytes(m.Body, "modalities", []byte(`["text","audio"]`))
+		m.Warnings = append(m.Warnings, `modalities was set to ["text","audio"] for the audio parameter`)
+		audio = true
+	}
+	if audio && !gjson.GetBytes(body, "audio").IsObject() {
+		return nil, NewInvalidRequestError("audio", "missing_required_parameter", "The audio parameter is required with the audio modality.")
+	}
+
+	var err error
+	gjson.GetBytes(body, "messages").ForEach(func(i, message gjson.Result) bool {
+		message.Get("content").ForEach(func(j, part gjson.Result) bool {
+			param := fmt.Sprintf("messages[%s].content[%s]", i, j)
+			switch part.Get("type").String() {
+			case "input_audio":
+				audio = true
+				err = checkInputAudio(part.Get("input_audio"), param+".input_audio", maxAudioSize)
+			case "image_url":
+				images = true
+				err = checkImageURL(part.Get("image_url.url").String(), param+".image_url.url", maxImageSize)
+			}
+			return err == nil
+		})
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	required := ""
+	switch {
+	case audio:
+		required = chatAudioAPIVersion
+	case images:
+		required = chatVisionAPIVersion
+	}
+	if required != "" && apiVersionBefore(AzureOpenAIAPIVersion, required) {
+		m.APIVersion = AzureOpenAIMultimodalAPIVersion
+	}
+	return m, nil
+}
+
+func checkInputAudio(audio gjson.Result, param string, maxSize int64) error {
+	data := audio.Get("data")
+	if data.Type != gjson.String || data.String() == "" {
+		return NewInvalidRequestError(param+".data", "missing_required_parameter", "Missing required parameter: '"+param+".data'.")
+	}
+	if format := audio.Get("format").String(); !inputAudioFormats[format] {
+		return NewInvalidRequestError(param+".format", "invalid_value",
+			fmt.Sprintf("Invalid value %q for '%s.format', expected one of: %s.", format, param, strings.Join(SortedKeys(inputAudioFormats), ", ")))
+	}
+	if size := base64Size(data.String()); maxSize > 0 && size > maxSize {
+		return &APIError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Message:    fmt.Sprintf("The audio of '%s' is %d bytes, over the %d bytes this proxy accepts.", param, size, maxSize),
+			Type:       "invalid_request_error",
+			Param:      param + ".data",
+			Code:       "audio_too_large",
+		}
+	}
+	return nil
+}
+
+// checkImageURL checks an image given as a data URL. Images given by URL are
+// fetched by Azure.
+func checkImageURL(url, param string, maxSize int64) error {
+	if !strings.HasPrefix(url, "data:") {
+		if url == "" {
+			return NewInvalidRequestError(param, "missing_required_parameter", "Missing required parameter: '"+param+"'.")
+		}
+		return nil
+	}
+	mediaType, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasPrefix(mediaType, "image/") || !strings.HasSuffix(mediaType, ";base64") {
+		return NewInvalidRequestError(param, "invalid_image_url", "Invalid image data URL in '"+param+"', expected data:image/{type};base64,{data}.")
+	}
+	if size := base64Size(data); maxSize > 0 && size > maxSize {
+		return &APIError{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Message:    fmt.Sprintf("The image of '%s' is %d bytes, over the %d bytes this proxy accepts.", param, size, maxSize),
+			Type:       "invalid_request_error",
+			Param:      param,
+			Code:       "image_too_large",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestApplyMultimodal(t *testing.T) {
+	audio := base64.StdEncoding.EncodeToString(make([]byte, 1000))
+	image := "data:image/png;base64," + base64.StdEncoding.EncodeToString(make([]byte, 2000))
+	message := func(part string) string {
+		return `{"model":"gpt-4o","messages":[{"role":"user","content":[{"type":"text","text":"hi"},` + part + `]}]}`
+	}
+	audioPart := func(format string) string {
+		return `{"type":"input_audio","input_audio":{"data":"` + audio + `","format":"` + format + `"}}`
+	}
+	imagePart := func(url string) string {
+		return `{"type":"image_url","image_url":{"url":"` + url + `"}}`
+	}
+
+	tests := []struct {
+		name       string
+		apiVersion string
+		body       string
+		maxSize    int64
+		// wantAPIVersion is the api-version the request is sent with, empty
+		// for AzureOpenAIAPIVersion.
+		wantAPIVersion string
+		wantModalities string
+		wantWarnings   int
+		wantStatus     int
+		wantCode       string
+	}{
+		{
+			name:       "text only",
+			apiVersion: "2024-05-01-preview",
+			body:       `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+		},
+		{
+			name:           "input audio passes through",
+			apiVersion:     "2024-05-01-preview",
+			body:           message(audioPart("wav")),
+			wantAPIVersion: AzureOpenAIMultimodalAPIVersion,
+		},
+		{
+			name:       "input audio on a recent api-version",
+			apiVersion: "2025-04-01-preview",
+			body:       message(audioPart("mp3")),
+		},
+		{
+			name:       "input audio within the size limit",
+			apiVersion: "2025-04-01-preview",
+			body:       message(audioPart("wav")),
+			maxSize:    1000,
+		},
+		{
+			name:       "input audio over the size limit",
+			apiVersion: "2025-04-01-preview",
+			body:       message(audioPart("wav")),
+			maxSize:    999,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   "audio_too_large",
+		},
+		{
+			name:       "input audio format",
+			apiVersion: "2025-04-01-preview",
+			body:       message(audioPart("flac")),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_value",
+		},
+		{
+			name:       "input audio without data",
+			apiVersion: "2025-04-01-preview",
+			body:       message(`{"type":"input_audio","input_audio":{"format":"wav"}}`),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "missing_required_parameter",
+		},
+		{
+			name:           "image url passes through",
+			apiVersion:     "2023-05-15",
+			body:           message(imagePart("https://example.com/cat.png")),
+			wantAPIVersion: AzureOpenAIMultimodalAPIVersion,
+		},
+		{
+			name:       "image url on a recent api-version",
+			apiVersion: "2024-05-01-preview",
+			body:       message(imagePart("https://example.com/cat.png")),
+		},
+		{
+			name:       "image data url within the size limit",
+			apiVersion: "2024-05-01-preview",
+			body:       message(imagePart(image)),
+			maxSize:    2000,
+		},
+		{
+			name:       "image data url over the size limit",
+			apiVersion: "2024-05-01-preview",
+			body:       message(imagePart(image)),
+			maxSize:    1999,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantCode:   "image_too_large",
+		},
+		{
+			name:       "image data url media type",
+			apiVersion: "2024-05-01-preview",
+			body:       message(imagePart("data:text/plain;base64,aGk=")),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_image_url",
+		},
+		{
+			name:           "audio output sets modalities",
+			apiVersion:     "2024-05-01-preview",
+			body:           `{"model":"gpt-4o","audio":{"voice":"alloy","format":"wav"},"messages":[{"role":"user","content":"hi"}]}`,
+			wantAPIVersion: AzureOpenAIMultimodalAPIVersion,
+			wantModalities: `["text","audio"]`,
+			wantWarnings:   1,
+		},
+		{
+			name:       "audio modality requires the audio parameter",
+			apiVersion: "2025-04-01-preview",
+			body:       `{"model":"gpt-4o","modalities":["text","audio"],"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "missing_required_parameter",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v string) { AzureOpenAIAPIVersion = v }(AzureOpenAIAPIVersion)
+			AzureOpenAIAPIVersion = tt.apiVersion
+
+			body := []byte(tt.body)
+			m, err := ApplyMultimodal(body, tt.maxSize, tt.maxSize)
+			if tt.wantCode != "" {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("ApplyMultimodal() error = %v, want %s", err, tt.wantCode)
+				}
+				if apiErr.StatusCode != tt.wantStatus || apiErr.Code != tt.wantCode {
+					t.Errorf("ApplyMultimodal() error = %d %v, want %d %s", apiErr.StatusCode, apiErr.Code, tt.wantStatus, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyMultimodal() error = %v", err)
+			}
+			if m.APIVersion != tt.wantAPIVersion {
+				t.Errorf("APIVersion = %q, want %q", m.APIVersion, tt.wantAPIVersion)
+			}
+			if len(m.Warnings) != tt.wantWarnings {
+				t.Errorf("Warnings = %q, want %d", m.Warnings, tt.wantWarnings)
+			}
+			if tt.wantModalities == "" {
+				if !bytes.Equal(m.Body, body) {
+					t.Errorf("Body = %s, want it unchanged", m.Body)
+				}
+			} else if got := gjson.GetBytes(m.Body, "modalities").Raw; got != tt.wantModalities {
+				t.Errorf("modalities = %s, want %s", got, tt.wantModalities)
+			}
+		})
+	}
+}
+
+func TestBase64Size(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 4, 1000} {
+		data := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", n)))
+		if got := base64Size(data); got != int64(n) {
+			t.Errorf("base64Size(%q) = %d, want %d", data, got, n)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package azure
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// legacyDataSourceTypes maps the data source types of the extensions API to
+// the ones of the data_sources field of chat completions.
+var legacyDataSourceTypes = map[string]string{
+	"AzureCognitiveSearch": "azure_search",
+	"AzureCosmosDB":        "azure_cosmos_db",
+	"AzureMLIndex":         "azure_ml_index",
+	"Elasticsearch":        "elasticsearch",
+	"Pinecone":             "pinecone",
+}
+
+// TranslateExtensionsRequest converts the body of a legacy On Your Data
+// /extensions/chat/completions request, with camelCase dataSources, into a
+// chat completions request with data_sources. Bodies that already use
+// data_sources are returned unchanged, so are fields the proxy does not know.
+func TranslateExtensionsRequest(body []byte) ([]byte, error) {
+	legacy := gjson.GetBytes(body, "dataSources")
+	if !legacy.Exists() {
+		return body, nil
+	}
+	var sources []any
+	for _, source := range legacy.Array() {
+		sources = append(sources, translateDataSource(source))
+	}
+	body, err := sjson.SetBytes(body, "data_sources", sources)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.DeleteBytes(body, "dataSources")
+}
+
+func translateDataSource(source gjson.Result) map[string]any {
+	kind := source.Get("type").String()
+	if t, ok := legacyDataSourceTypes[kind]; ok {
+		kind = t
+	}
+	params := map[string]any{}
+	source.Get("parameters").ForEach(func(key, value gjson.Result) bool {
+		switch key.String() {
+		case "key":
+			params["authentication"] = map[string]any{"type": "api_key", "key": value.String()}
+		case "connectionString":
+			params["authentication"] = map[string]any{"type": "connection_string", "connection_string": value.String()}
+		case "embeddingDeploymentName":
+			params["embedding_dependency"] = map[string]any{"type": "deployment_name", "deployment_name": value.String()}
+		case "queryType":
+			params["query_type"] = snakeCase(value.String())
+		default:
+			params[snakeCase(key.String())] = snakeCaseKeys(value.Value())
+		}
+		return true
+	})
+	return map[string]any{"type": kind, "parameters": params}
+}
+
+// snakeCaseKeys converts the keys of the objects in v to snake case.
+func snakeCaseKeys(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			out[snakeCase(key)] = snakeCaseKeys(value)
+		}
+		return out
+	case []any:
+		for i, value := range v {
+			v[i] = snakeCaseKeys(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// snakeCase converts a camelCase identifier, e.g. topNDocuments becomes
+// top_n_documents.
+func snakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && !unicode.IsUpper(runes[i-1])
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if i > 0 && runes[i-1] != '_' && (prevLower || nextLower) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// hasDataSources reports whether a chat completions request uses On Your
+// Data, whose answers depend on the content of the index.
+func hasDataSources(body []byte) bool {
+	return gjson.GetBytes(body, "data_sources").Exists()
+}
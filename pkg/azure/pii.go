@@ -0,0 +1,201 @@
+package azure
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// PIIPattern masks the matches of Regexp with "[NAME]".
+type PIIPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+	// Valid, if set, rejects matches that only look like the data, e.g.
+	// digit runs that fail the credit card checksum.
+	Valid func(match string) bool
+}
+
+// builtinPIIPatterns can be enabled by name in AZURE_OPENAI_PII_PATTERNS.
+var builtinPIIPatterns = map[string]PIIPattern{
+	"email": {Regexp: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	"credit_card": {
+		Regexp: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		Valid:  luhnValid,
+	},
+	"phone": {Regexp: regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{2,4}\)|\b\d{2,4})[ .-]?\d{3,4}[ .-]?\d{3,4}\b`)},
+}
+
+var (
+	// AzureOpenAIPIIPatterns are applied in order to outgoing prompts.
+	AzureOpenAIPIIPatterns []PIIPattern
+	// AzureOpenAIPIIScrubModels and AzureOpenAIPIIScrubKeys select the
+	// requests whose prompts are scrubbed, by model or by virtual key name.
+	// "*" selects every request.
+	AzureOpenAIPIIScrubModels = map[string]bool{}
+	AzureOpenAIPIIScrubKeys   = map[string]bool{}
+	// AzureOpenAIPIIScrubLogs also masks the patterns in the proxy's logs.
+	AzureOpenAIPIIScrubLogs bool
+
+	piiRedactions = metrics.NewCounter("azure_oai_proxy_pii_redactions_total",
+		"Matches masked in prompts and logs, by pattern.", "pattern")
+)
+
+func init() {
+	for _, model := range SplitList(os.Getenv("AZURE_OPENAI_PII_SCRUB_MODELS")) {
+		AzureOpenAIPIIScrubModels[model] = true
+	}
+	for _, key := range SplitList(os.Getenv("AZURE_OPENAI_PII_SCRUB_KEYS")) {
+		AzureOpenAIPIIScrubKeys[key] = true
+	}
+	AzureOpenAIPIIScrubLogs = envBool("AZURE_OPENAI_PII_SCRUB_LOGS", false)
+	if len(AzureOpenAIPIIScrubModels) == 0 && len(AzureOpenAIPIIScrubKeys) == 0 && !AzureOpenAIPIIScrubLogs {
+		return
+	}
+
+	names := SplitList(os.Getenv("AZURE_OPENAI_PII_PATTERNS"))
+	if len(names) == 0 {
+		names = []string{"email", "credit_card", "phone"}
+	}
+	for _, name := range names {
+		pattern, ok := builtinPIIPatterns[name]
+		// A custom pattern may also replace a built-in one.
+		if expr := os.Getenv("AZURE_OPENAI_PII_PATTERN_" + strings.ToUpper(name)); expr != "" {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				log.Printf("error parsing AZURE_OPENAI_PII_PATTERN_%s: %v", strings.ToUpper(name), err)
+				os.Exit(1)
+			}
+			pattern, ok = PIIPattern{Regexp: re}, true
+		}
+		if !ok {
+			log.Printf("error parsing AZURE_OPENAI_PII_PATTERNS, unknown pattern %s, set AZURE_OPENAI_PII_PATTERN_%s", name, strings.ToUpper(name))
+			os.Exit(1)
+		}
+		pattern.Name = name
+		AzureOpenAIPIIPatterns = append(AzureOpenAIPIIPatterns, pattern)
+	}
+	log.Printf("loading azure pii scrubbing: patterns %s, models %s, keys %s, logs %t", strings.Join(names, ","),
+		os.Getenv("AZURE_OPENAI_PII_SCRUB_MODELS"), os.Getenv("AZURE_OPENAI_PII_SCRUB_KEYS"), AzureOpenAIPIIScrubLogs)
+	if AzureOpenAIPIIScrubLogs {
+		log.SetOutput(NewPIIWriter(log.Writer()))
+	}
+}
+
+// ScrubsPII reports whether the prompts of requests for model by the
+// virtual key keyName are scrubbed.
+func ScrubsPII(model, keyName string) bool {
+	if len(AzureOpenAIPIIPatterns) == 0 {
+		return false
+	}
+	return AzureOpenAIPIIScrubModels["*"] || AzureOpenAIPIIScrubModels[model] ||
+		AzureOpenAIPIIScrubModels[GetDeploymentByModel(model)] ||
+		AzureOpenAIPIIScrubKeys["*"] || (keyName != "" && AzureOpenAIPIIScrubKeys[keyName])
+}
+
+// ScrubPII masks every match of the configured patterns in s and returns
+// the result and the number of matches.
+func ScrubPII(s string) (string, int) {
+	count := 0
+	for _, p := range AzureOpenAIPIIPatterns {
+		s = p.Regexp.ReplaceAllStringFunc(s, func(match string) string {
+			if p.Valid != nil && !p.Valid(match) {
+				return match
+			}
+			count++
+			piiRedactions.Inc(p.Name)
+			return "[" + strings.ToUpper(p.Name) + "]"
+		})
+	}
+	return s, count
+}
+
+// ScrubRequestPII masks the configured patterns in the prompt of a chat
+// completions, completions or embeddings request body: the text of the
+// messages, prompt and input. It returns the body and whether it changed.
+func ScrubRequestPII(body []byte) ([]byte, bool) {
+	var paths []string
+	gjson.GetBytes(body, "messages").ForEach(func(i, message gjson.Result) bool {
+		content := message.Get("content")
+		if content.Type == gjson.String {
+			paths = append(paths, "messages."+i.String()+".content")
+		}
+		content.ForEach(func(j, part gjson.Result) bool {
+			if part.Get("type").String() == "text" {
+				paths = append(paths, "messages."+i.String()+".content."+j.String()+".text")
+			}
+			return true
+		})
+		return true
+	})
+	for _, field := range []string{"prompt", "input"} {
+		value := gjson.GetBytes(body, field)
+		if value.Type == gjson.String {
+			paths = append(paths, field)
+		}
+		value.ForEach(func(i, item gjson.Result) bool {
+			if item.Type == gjson.String {
+				paths = append(paths, field+"."+i.String())
+			}
+			return true
+		})
+	}
+
+	changed := false
+	for _, path := range paths {
+		scrubbed, n := ScrubPII(gjson.GetBytes(body, path).String())
+		if n == 0 {
+			continue
+		}
+		if next, err := sjson.SetBytes(body, path, scrubbed); err == nil {
+			body, changed = next, true
+		}
+	}
+	return body, changed
+}
+
+// NewPIIWriter returns a writer that masks the configured patterns in
+// everything written to w. It is meant for loggers, which write whole lines.
+func NewPIIWriter(w io.Writer) io.Writer {
+	return piiWriter{w}
+}
+
+type piiWriter struct {
+	w io.Writer
+}
+
+func (pw piiWriter) Write(p []byte) (int, error) {
+	scrubbed, n := ScrubPII(string(p))
+	if n == 0 {
+		return pw.w.Write(p)
+	}
+	if _, err := io.WriteString(pw.w, scrubbed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// luhnValid reports whether the digits of s pass the Luhn checksum of card
+// numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
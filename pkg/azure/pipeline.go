@@ -0,0 +1,198 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// StreamStage is a step of the pipeline the events of an SSE response are
+// relayed through: each event is parsed, passed through the stages in order
+// and written back to the client. A stage serves a single response and may
+// keep state across its events.
+type StreamStage interface {
+	// Event receives the JSON data of an event and returns the data of the
+	// events to send in its place, none to drop it.
+	Event(data []byte) [][]byte
+	// End is called once when the stream ends, at [DONE], at the end of the
+	// body or when the client goes away. It returns the data of the events
+	// to send before the stream is closed.
+	End() [][]byte
+}
+
+// StreamStageFunc is a StreamStage that rewrites every event and adds none.
+type StreamStageFunc func(data []byte) []byte
+
+func (f StreamStageFunc) Event(data []byte) [][]byte { return [][]byte{f(data)} }
+
+func (f StreamStageFunc) End() [][]byte { return nil }
+
+var streamStageFactories []func(res *http.Response) StreamStage
+
+// RegisterStreamStage has newStage called for every successful SSE response
+// to create a stage for it, or return nil to leave the response alone.
+// Registered stages run after the proxy's own, in the order they were
+// registered. It must be called before the proxy serves requests.
+func RegisterStreamStage(newStage func(res *http.Response) StreamStage) {
+	streamStageFactories = append(streamStageFactories, newStage)
+}
+
+// applyStreamStages adds the registered stages to an SSE response.
+func applyStreamStages(res *http.Response) {
+	if res.StatusCode != http.StatusOK || !isEventStream(res) {
+		return
+	}
+	for _, newStage := range streamStageFactories {
+		if stage := newStage(res); stage != nil {
+			AddStreamStage(res, stage)
+		}
+	}
+}
+
+// AddStreamStage appends stage to the pipeline of the SSE response res,
+// which is set up by the first stage. A stage sees the events as the stages
+// added before it left them.
+func AddStreamStage(res *http.Response, stage StreamStage) {
+	if p, ok := res.Body.(*streamPipeline); ok {
+		p.stages = append(p.stages, stage)
+		return
+	}
+	res.Body = &streamPipeline{
+		ReadCloser: res.Body,
+		reader:     bufio.NewReader(res.Body),
+		stages:     []StreamStage{stage},
+	}
+}
+
+func isEventStream(res *http.Response) bool {
+	return strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// streamPipeline reads an SSE stream one event at a time and passes the
+// JSON data of each event through its stages.
+type streamPipeline struct {
+	io.ReadCloser
+	reader  *bufio.Reader
+	stages  []StreamStage
+	lines   [][]byte
+	pending []byte
+	err     error
+	endOnce sync.Once
+}
+
+func (p *streamPipeline) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		line, err := p.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if trimmed := bytes.TrimRight(line, "\r\n"); len(trimmed) > 0 {
+				p.lines = append(p.lines, trimmed)
+			} else {
+				p.flushEvent()
+			}
+		}
+		if err != nil {
+			// An unterminated last event is still relayed, terminated.
+			p.flushEvent()
+			if err == io.EOF {
+				p.end()
+			}
+			p.err = err
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// Close ends the stages of a stream the client stopped reading.
+func (p *streamPipeline) Close() error {
+	p.endOnce.Do(func() {
+		for _, stage := range p.stages {
+			stage.End()
+		}
+	})
+	return p.ReadCloser.Close()
+}
+
+// flushEvent processes the lines read since the last blank line.
+func (p *streamPipeline) flushEvent() {
+	if len(p.lines) == 0 {
+		return
+	}
+	var fields, data [][]byte
+	for _, line := range p.lines {
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	p.lines = nil
+
+	joined := bytes.Join(data, []byte("\n"))
+	switch {
+	case len(data) == 0 || len(bytes.TrimSpace(joined)) == 0:
+		// Comments and events without data are kept as they are.
+		p.emit(fields, nil)
+	case bytes.Equal(bytes.TrimSpace(joined), []byte("[DONE]")):
+		p.end()
+		p.emit(fields, [][]byte{[]byte("[DONE]")})
+	case bytes.TrimSpace(joined)[0] != '{':
+		p.emit(fields, [][]byte{joined})
+	default:
+		events := p.run(0, [][]byte{bytes.TrimSpace(joined)})
+		if len(events) > 0 {
+			p.emit(fields, events)
+		}
+	}
+}
+
+// run passes events through the stages from the one at index from on.
+func (p *streamPipeline) run(from int, events [][]byte) [][]byte {
+	for _, stage := range p.stages[from:] {
+		var out [][]byte
+		for _, data := range events {
+			out = append(out, stage.Event(data)...)
+		}
+		events = out
+	}
+	return events
+}
+
+// end ends every stage and sends the events they add through the stages
+// after them.
+func (p *streamPipeline) end() {
+	p.endOnce.Do(func() {
+		for i, stage := range p.stages {
+			if events := p.run(i+1, stage.End()); len(events) > 0 {
+				p.emit(nil, events)
+			}
+		}
+	})
+}
+
+// emit queues events, the first with the non-data fields of the event they
+// came from.
+func (p *streamPipeline) emit(fields [][]byte, events [][]byte) {
+	for _, field := range fields {
+		p.pending = append(p.pending, field...)
+		p.pending = append(p.pending, '\n')
+	}
+	for i, data := range events {
+		if i > 0 {
+			p.pending = append(p.pending, '\n')
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			p.pending = append(p.pending, "data: "...)
+			p.pending = append(p.pending, line...)
+			p.pending = append(p.pending, '\n')
+		}
+	}
+	p.pending = append(p.pending, '\n')
+}
@@ -0,0 +1,69 @@
+package azure
+
+import (
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// Priority classes of virtual keys. When capacity is constrained, batch
+// requests wait behind interactive ones and are shed first.
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+var (
+	// AzureOpenAIKeyPriorities maps virtual key names to their priority
+	// class, "*" applies to every other key. Keys default to interactive.
+	AzureOpenAIKeyPriorities = map[string]string{}
+	// AzureOpenAIBatchQuotaReserve is the fraction of every deployment quota
+	// that batch requests leave to interactive ones.
+	AzureOpenAIBatchQuotaReserve = 0.2
+
+	shedRequests = metrics.NewCounter("azure_oai_proxy_shed_total",
+		"Batch requests answered with a 429 while capacity was constrained, by reason.", "priority", "reason")
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_KEY_PRIORITIES"); v != "" {
+		for key, priority := range parseKeyValueList("AZURE_OPENAI_PROXY_KEY_PRIORITIES", v) {
+			if priority != PriorityInteractive && priority != PriorityBatch {
+				log.Printf("error parsing AZURE_OPENAI_PROXY_KEY_PRIORITIES, invalid value %s=%s", key, priority)
+				os.Exit(1)
+			}
+			AzureOpenAIKeyPriorities[key] = priority
+			log.Printf("loading azure key priority: %s -> %s", key, priority)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_BATCH_QUOTA_RESERVE"); v != "" {
+		reserve, err := strconv.ParseFloat(v, 64)
+		if err != nil || reserve < 0 || reserve >= 1 {
+			log.Printf("error parsing AZURE_OPENAI_BATCH_QUOTA_RESERVE, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAIBatchQuotaReserve = reserve
+	}
+}
+
+// KeyPriority returns the priority class of the virtual key named key.
+func KeyPriority(key string) string {
+	if priority, ok := AzureOpenAIKeyPriorities[key]; ok && key != "" {
+		return priority
+	}
+	if priority, ok := AzureOpenAIKeyPriorities["*"]; ok {
+		return priority
+	}
+	return PriorityInteractive
+}
+
+// quotaReserve returns the fraction of a deployment quota requests of
+// priority must leave untouched.
+func quotaReserve(priority string) float64 {
+	if priority == PriorityBatch {
+		return AzureOpenAIBatchQuotaReserve
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ProbeResult is the outcome of a minimal chat completion sent to a backend.
+type ProbeResult struct {
+	Backend    string
+	Model      string
+	Deployment string
+	// Status is the HTTP status Azure answered with, zero when it could not
+	// be reached.
+	Status  int
+	Latency time.Duration
+	// Detail is the model version that answered, or what went wrong.
+	Detail string
+}
+
+// OK reports whether the backend served the chat completion.
+func (r ProbeResult) OK() bool {
+	return r.Status == http.StatusOK
+}
+
+// nonChatModels are the prefixes of models that do not serve chat
+// completions, and so are not probed.
+var nonChatModels = []string{"babbage-", "dall-e-", "davinci-", "gpt-3.5-turbo-instruct", "text-embedding-", "tts-", "whisper-"}
+
+// ProbeModels returns the models to probe on b: the chat models it serves,
+// else the chat models mapped by it or the proxy.
+func ProbeModels(b *Backend) []string {
+	models := b.Models
+	if len(models) == 0 {
+		models = map[string]bool{}
+		for model := range b.ModelMapper {
+			models[model] = true
+		}
+		for model := range ModelMapper() {
+			models[model] = true
+		}
+	}
+	var chat []string
+	for _, model := range SortedKeys(models) {
+		if !slices.ContainsFunc(nonChatModels, func(prefix string) bool { return strings.HasPrefix(model, prefix) }) {
+			chat = append(chat, model)
+		}
+	}
+	return chat
+}
+
+// Probe sends a chat completion of a single token for model to b, with key
+// when the backend has no API key of its own. It goes straight to the
+// backend, without the retries, failover or circuit breaker of proxied
+// requests.
+func Probe(ctx context.Context, b *Backend, model, key string) ProbeResult {
+	result := ProbeResult{Backend: b.Name, Model: model, Deployment: b.Deployment(model)}
+	if b.HasAPIKey() {
+		key = b.apiKeys().current()
+	}
+	if key == "" {
+		result.Detail = "no API key, the backend uses the client's"
+		return result
+	}
+
+	body, _ := sjson.SetBytes([]byte(`{"messages":[{"role":"user","content":"ping"}],"max_tokens":1}`), "model", model)
+	body, _ = ApplyReasoningShims(body)
+	u := *b.Endpoint
+	u.Path = path.Join("/openai/deployments", result.Deployment, "chat/completions")
+	u.RawQuery = "api-version=" + AzureOpenAIAPIVersion
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("api-key", key)
+
+	start := time.Now()
+	resp, err := (&http.Client{Transport: Transport}).Do(req)
+	result.Latency = time.Since(start)
+	if err != nil {
+		result.Detail = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	result.Status = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		result.Detail = gjson.GetBytes(respBody, "model").String()
+	case gjson.GetBytes(respBody, "error.message").Exists():
+		result.Detail = gjson.GetBytes(respBody, "error.code").String() + ": " + gjson.GetBytes(respBody, "error.message").String()
+	default:
+		result.Detail = http.StatusText(resp.StatusCode)
+	}
+	return result
+}
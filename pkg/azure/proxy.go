@@ -2,14 +2,15 @@ package azure
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
-	"path"
 	"regexp"
 	"strings"
 
@@ -48,129 +49,291 @@ var (
 		"text-embedding-3-large":      "text-embedding-3-large-1",
 	}
 	fallbackModelMapper = regexp.MustCompile(`[.:]`)
+	// AzureOpenAIUploadsAPIVersion is the api-version used for the Uploads API,
+	// which is not available in older api versions.
+	AzureOpenAIUploadsAPIVersion = "2025-04-01-preview"
+	// AzureOpenAIAllowDeploymentOverride lets clients pick the deployment with
+	// the DeploymentOverrideHeader, regardless of the model mapping, among the
+	// deployments the proxy knows of.
+	AzureOpenAIAllowDeploymentOverride = false
+
+	// deploymentName matches the names Azure allows for deployments.
+	deploymentName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
 )
 
+// DeploymentOverrideHeader forces a specific deployment for a request.
+const DeploymentOverrideHeader = "X-Azure-Deployment"
+
 func init() {
+	AzureOpenAIAllowDeploymentOverride = envBool("AZURE_OPENAI_ALLOW_DEPLOYMENT_OVERRIDE", AzureOpenAIAllowDeploymentOverride)
 	if v := os.Getenv("AZURE_OPENAI_APIVERSION"); v != "" {
 		AzureOpenAIAPIVersion = v
 	}
+	if v := os.Getenv("AZURE_OPENAI_UPLOADS_APIVERSION"); v != "" {
+		AzureOpenAIUploadsAPIVersion = v
+	}
 	if v := os.Getenv("AZURE_OPENAI_ENDPOINT"); v != "" {
 		AzureOpenAIEndpoint = v
 	}
 	if v := os.Getenv("AZURE_OPENAI_MODEL_MAPPER"); v != "" {
-		for _, pair := range strings.Split(v, ",") {
-			info := strings.Split(pair, "=")
-			if len(info) != 2 {
-				log.Printf("error parsing AZURE_OPENAI_MODEL_MAPPER, invalid value %s", pair)
-				os.Exit(1)
-			}
-			AzureOpenAIModelMapper[info[0]] = info[1]
+		for model, deployment := range parseKeyValueList("AZURE_OPENAI_MODEL_MAPPER", v) {
+			AzureOpenAIModelMapper[model] = deployment
 		}
 	}
-	if v := os.Getenv("AZURE_OPENAI_TOKEN"); v != "" {
-		AzureOpenAIToken = v
-		log.Printf("loading azure api token from env")
-	}
 
 	log.Printf("loading azure api endpoint: %s", AzureOpenAIEndpoint)
 	log.Printf("loading azure api version: %s", AzureOpenAIAPIVersion)
 	for k, v := range AzureOpenAIModelMapper {
 		log.Printf("loading azure model mapper: %s -> %s", k, v)
 	}
+	loadBackends()
+	loadMirrors()
 }
 
+// NewOpenAIReverseProxy returns a reverse proxy to the configured Backends. It
+// is safe for concurrent use and meant to be built once at startup, after any
+// transport middleware has been registered with Use.
 func NewOpenAIReverseProxy() *httputil.ReverseProxy {
-	remote, err := url.Parse(AzureOpenAIEndpoint)
-	if err != nil {
-		log.Printf("error parse endpoint: %s\n", AzureOpenAIEndpoint)
-		os.Exit(1)
-	}
-
 	return &httputil.ReverseProxy{
-		Director:       makeDirector(remote),
+		Director:       director,
+		Transport:      Client.Transport,
 		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		// Relay every chunk as soon as it arrives, so that clients play
+		// speech while it is being synthesized.
+		FlushInterval: -1,
 	}
 }
 
-func makeDirector(remote *url.URL) func(*http.Request) {
-	return func(req *http.Request) {
-		// Get model and map it to deployment
-		model := getModelFromRequest(req)
-		deployment := GetDeploymentByModel(model)
-
-		// Handle token
-		handleToken(req)
-
-		// Set the Host, Scheme, Path, and RawPath of the request
-		originURL := req.URL.String()
-		req.Host = remote.Host
-		req.URL.Scheme = remote.Scheme
-		req.URL.Host = remote.Host
-
-		// Handle different endpoints
-		switch {
-		case strings.HasPrefix(req.URL.Path, "/v1/chat/completions"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "chat/completions")
-		case strings.HasPrefix(req.URL.Path, "/v1/completions"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "completions")
-		case strings.HasPrefix(req.URL.Path, "/v1/embeddings"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "embeddings")
-		case strings.HasPrefix(req.URL.Path, "/v1/images/generations"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "images/generations")
-		case strings.HasPrefix(req.URL.Path, "/v1/fine_tunes"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "fine-tunes")
-		case strings.HasPrefix(req.URL.Path, "/v1/files"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "files")
-		case strings.HasPrefix(req.URL.Path, "/v1/audio/speech"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "audio/speech")
-		case strings.HasPrefix(req.URL.Path, "/v1/audio/transcriptions"):
-			// TEMP: no deployment for whisper-1, force using whisper
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", "whisper"), "audio/transcriptions")
-		case strings.HasPrefix(req.URL.Path, "/v1/audio/translations"):
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), "translations")
-		default:
-			req.URL.Path = path.Join(fmt.Sprintf("/openai/deployments/%s", deployment), strings.TrimPrefix(req.URL.Path, "/v1/"))
+// errorHandler reports upstream failures in the OpenAI error format.
+func errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		WriteError(w, NewRequestTooLargeError(maxBytesErr.Limit))
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	WriteError(w, newServerError(http.StatusBadGateway, "The proxy failed to reach Azure OpenAI."))
+}
+
+// CheckDeploymentOverride checks the deployment a client forces with the
+// DeploymentOverrideHeader: it must be a deployment name the proxy maps a
+// model to or discovered on a backend of tenant, so that clients cannot
+// reach other paths of the resource or deployments the tenant has no access
+// to.
+func CheckDeploymentOverride(deployment string, tenant *Tenant) *APIError {
+	if deployment == "" || !AzureOpenAIAllowDeploymentOverride {
+		return nil
+	}
+	if !deploymentName.MatchString(deployment) {
+		return NewInvalidRequestError(DeploymentOverrideHeader, "invalid_deployment", fmt.Sprintf("Invalid deployment name %q.", deployment))
+	}
+	if !knownDeployment(deployment, tenant) {
+		return &APIError{
+			StatusCode: http.StatusForbidden,
+			Message:    fmt.Sprintf("The deployment %s is not available to this client.", deployment),
+			Type:       "invalid_request_error",
+			Param:      DeploymentOverrideHeader,
+			Code:       "deployment_not_allowed",
 		}
+	}
+	return nil
+}
+
+// knownDeployment reports whether deployment is mapped to a model for
+// tenant, globally or by one of its backends, is a canary deployment, or was
+// discovered on one of its backends.
+func knownDeployment(deployment string, tenant *Tenant) bool {
+	if tenant != nil {
+		for _, d := range tenant.ModelMapper {
+			if d == deployment {
+				return true
+			}
+		}
+	}
+	for _, d := range ModelMapper() {
+		if d == deployment {
+			return true
+		}
+	}
+	for _, route := range AzureOpenAICanaries {
+		if route.Deployment == deployment {
+			return true
+		}
+	}
+	for _, b := range tenant.backends() {
+		for _, d := range b.ModelMapper {
+			if d == deployment {
+				return true
+			}
+		}
+		b.discovery.mu.RLock()
+		_, ok := b.discovery.deployments[deployment]
+		b.discovery.mu.RUnlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func director(req *http.Request) {
+	// Get model and map it to deployment. Uploads are streamed, not read.
+	var body []byte
+	if !isStreamedUpload(req) {
+		body = readRequestBody(req)
+	}
+	model := gjson.GetBytes(body, "model").String()
+	info := RequestInfoFromContext(req.Context())
+	if info == nil {
+		info = &RequestInfo{}
+	}
+	info.Model = model
+	info.Session = sessionKey(req, body)
+	info.Deployment = ""
+	if deployment := req.Header.Get(DeploymentOverrideHeader); AzureOpenAIAllowDeploymentOverride && deploymentName.MatchString(deployment) {
+		info.Deployment = deployment
+	}
+	override := info.Deployment != ""
+	req.Header.Del(DeploymentOverrideHeader)
+	if !override {
+		info.Deployment, _ = pickCanary(model, info.Session)
+	}
+	if deployment, ok := info.Tenant.deployment(model); ok && info.Deployment == "" {
+		info.Deployment = deployment
+	}
+
+	// Handle token
+	info.ClientKey = ClientKey(req.Header)
+	handleToken(req)
 
-		req.URL.RawPath = req.URL.EscapedPath()
+	originURL := req.URL.String()
 
-		// Add the api-version query parameter
-		query := req.URL.Query()
+	// Handle different endpoints
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/chat/completions"):
+		info.Operation = "chat/completions"
+	case strings.HasPrefix(req.URL.Path, "/v1/completions"):
+		info.Operation = "completions"
+	case strings.HasPrefix(req.URL.Path, "/v1/embeddings"):
+		info.Operation = "embeddings"
+	case strings.HasPrefix(req.URL.Path, "/v1/images/generations"):
+		info.Operation = "images/generations"
+	case strings.HasPrefix(req.URL.Path, "/v1/fine_tunes"):
+		info.Operation = "fine-tunes"
+	case strings.HasPrefix(req.URL.Path, "/v1/files"),
+		strings.HasPrefix(req.URL.Path, "/v1/vector_stores"),
+		strings.HasPrefix(req.URL.Path, "/v1/uploads"),
+		strings.HasPrefix(req.URL.Path, "/v1/fine_tuning/"):
+		// Resource level operations, not tied to a deployment
+		info.Operation = strings.TrimPrefix(req.URL.Path, "/v1/")
+		info.ResourceScoped = true
+	case strings.HasPrefix(req.URL.Path, "/v1/audio/speech"):
+		info.Operation = "audio/speech"
+	case strings.HasPrefix(req.URL.Path, "/v1/audio/transcriptions"):
+		// TEMP: no deployment for whisper-1, force using whisper
+		if !override {
+			info.Deployment = "whisper"
+		}
+		info.Operation = "audio/transcriptions"
+	case strings.HasPrefix(req.URL.Path, "/v1/audio/translations"):
+		info.Operation = "translations"
+	default:
+		info.Operation = strings.TrimPrefix(req.URL.Path, "/v1/")
+	}
+
+	// Set the Host, Scheme, Path, and RawPath of the request
+	info.Candidates = candidateBackends(model, info.Tenant)
+	if info.PinnedBackend != nil {
+		info.Candidates = []*Backend{info.PinnedBackend}
+	} else {
+		// Session and latency orders are kept, only the backends without
+		// quota left for the request move to the end.
+		reorder := false
+		if info.Session != "" {
+			info.Candidates = orderBySession(info.Candidates, info.Session)
+		} else if latencySensitive(info, body) {
+			info.Candidates = orderByLatency(info.Candidates)
+		} else {
+			reorder = true
+		}
+		if !info.ResourceScoped {
+			tokens, _ := quotaTokens(body)
+			info.Candidates = orderByCapacity(info.Candidates, info, tokens, reorder)
+		}
+	}
+	info.Candidates[0].apply(req, info)
+
+	// Add the api-version query parameter
+	query := req.URL.Query()
+	if strings.HasPrefix(info.Operation, "uploads") {
+		query.Add("api-version", AzureOpenAIUploadsAPIVersion)
+	} else if info.APIVersion != "" {
+		query.Add("api-version", info.APIVersion)
+	} else {
 		query.Add("api-version", AzureOpenAIAPIVersion)
-		req.URL.RawQuery = query.Encode()
+	}
+	req.URL.RawQuery = query.Encode()
 
+	if override {
+		log.Printf("proxying request [%s] %s -> %s (deployment override)", model, originURL, req.URL.String())
+	} else {
 		log.Printf("proxying request [%s] %s -> %s", model, originURL, req.URL.String())
 	}
 }
 
-func getModelFromRequest(req *http.Request) string {
+func readRequestBody(req *http.Request) []byte {
 	if req.Body == nil {
-		return ""
+		return nil
+	}
+	body, err := ReadRequestBody(req.Body)
+	if err != nil {
+		// Fail the upstream request with the read error, e.g. a body over the
+		// size limit, instead of silently sending it truncated.
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return body
+	}
+	req.Body = NewRequestBody(body)
+	return body
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// ClientKey returns the key a client sent, from the Authorization bearer
+// token or else the api-key header Azure clients use.
+func ClientKey(header http.Header) string {
+	if auth := header.Get("Authorization"); auth != "" {
+		return strings.TrimPrefix(auth, "Bearer ")
 	}
-	body, _ := ioutil.ReadAll(req.Body)
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	return gjson.GetBytes(body, "model").String()
+	return header.Get("api-key")
 }
 
 func handleToken(req *http.Request) {
-	token := ""
-	if AzureOpenAIToken != "" {
-		token = AzureOpenAIToken
-	} else {
-		token = strings.ReplaceAll(req.Header.Get("Authorization"), "Bearer ", "")
+	token := apiToken()
+	if token == "" {
+		token = ClientKey(req.Header)
 	}
 	req.Header.Set("api-key", token)
 	req.Header.Del("Authorization")
 }
 
 func HandleToken(req *http.Request) {
-	token := ""
-	if AzureOpenAIToken != "" {
-		token = AzureOpenAIToken
-	} else if authHeader := req.Header.Get("Authorization"); authHeader != "" {
-		token = strings.TrimPrefix(authHeader, "Bearer ")
-	} else if apiKey := os.Getenv("AZURE_OPENAI_API_KEY"); apiKey != "" {
-		token = apiKey
+	token := apiToken()
+	if token == "" {
+		if clientKey := ClientKey(req.Header); clientKey != "" {
+			token = clientKey
+		} else if apiKey := os.Getenv("AZURE_OPENAI_API_KEY"); apiKey != "" {
+			token = apiKey
+		}
 	}
 
 	if token != "" {
@@ -180,21 +343,67 @@ func HandleToken(req *http.Request) {
 }
 
 func modifyResponse(res *http.Response) error {
+	if err := handleStreamFallback(res); err != nil {
+		return err
+	}
+	guardStream(res)
+
 	// Handle rate limiting headers
 	if res.StatusCode == http.StatusTooManyRequests {
 		log.Printf("Rate limit exceeded: %s", res.Header.Get("Retry-After"))
 	}
 
+	// Tell the client which deployment served the request
+	if deployment := deploymentFromPath(res.Request.URL.Path); deployment != "" {
+		res.Header.Set("X-Proxy-Deployment", deployment)
+	}
+	if info := RequestInfoFromContext(res.Request.Context()); info != nil {
+		WriteQuotaHeaders(res.Header, info)
+	}
+
+	if err := recordResponseSchema(res); err != nil {
+		return err
+	}
+	if err := validateToolCalls(res); err != nil {
+		return err
+	}
+	if err := rewriteResponseModel(res); err != nil {
+		return err
+	}
+	if err := normalizeLogprobs(res); err != nil {
+		return err
+	}
+	if err := fillSemanticCache(res); err != nil {
+		return err
+	}
+	if err := captureConversation(res); err != nil {
+		return err
+	}
+	if err := translateCompletionsResponse(res); err != nil {
+		return err
+	}
+	streamSpeechEvents(res)
+	applyStreamStages(res)
+	if err := observeUsage(res); err != nil {
+		return err
+	}
+
 	// Handle streaming responses
 	if res.Header.Get("Content-Type") == "text/event-stream" {
 		res.Header.Set("X-Accel-Buffering", "no")
+		trackStream(res)
+	} else if err := compressResponse(res, res.Request.Header.Get("Accept-Encoding")); err != nil {
+		return err
 	}
 
 	return nil
 }
 
 func GetDeploymentByModel(model string) string {
-	if v, ok := AzureOpenAIModelMapper[model]; ok {
+	configMu.RLock()
+	v, ok := AzureOpenAIModelMapper[model]
+	configMu.RUnlock()
+	if ok {
 		return v
 	}
 	return fallbackModelMapper.ReplaceAllString(model, "")
@@ -0,0 +1,371 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// AzureOpenAIDeploymentQuotas maps deployments, or backend/deployment for
+	// a single backend, to the requests and tokens per minute Azure allows
+	// them. Requests are held back until they fit in the quota instead of
+	// being sent to be throttled.
+	AzureOpenAIDeploymentQuotas = map[string]RateLimit{}
+	// AzureOpenAIQuotaMaxWait is the longest a request is held back. A request
+	// that would have to wait longer is answered with a 429 right away, or
+	// spills over to the next backend.
+	AzureOpenAIQuotaMaxWait = 30 * time.Second
+
+	quotaMu      sync.Mutex
+	quotaBuckets = map[string]*rateBucket{}
+	quotaQueues  = map[string]*quotaQueue{}
+
+	quotaWait = metrics.NewHistogram("azure_oai_proxy_quota_wait_seconds",
+		"Time requests were held back to stay within the deployment quota.", metrics.DefaultBuckets, "backend", "deployment")
+	quotaRejected = metrics.NewCounter("azure_oai_proxy_quota_rejected_total",
+		"Requests that did not fit in the deployment quota within the maximum wait.", "backend", "deployment")
+)
+
+func init() {
+	v := os.Getenv("AZURE_OPENAI_DEPLOYMENT_QUOTAS")
+	if v == "" {
+		return
+	}
+	for deployment, value := range parseKeyValueList("AZURE_OPENAI_DEPLOYMENT_QUOTAS", v) {
+		limit, ok := parseRateLimit(value)
+		if !ok {
+			log.Printf("error parsing AZURE_OPENAI_DEPLOYMENT_QUOTAS, invalid value %s=%s", deployment, value)
+			os.Exit(1)
+		}
+		AzureOpenAIDeploymentQuotas[deployment] = limit
+		log.Printf("loading azure deployment quota: %s -> %d requests, %d tokens per minute", deployment, limit.RequestsPerMinute, limit.TokensPerMinute)
+	}
+	AzureOpenAIQuotaMaxWait = envDuration("AZURE_OPENAI_QUOTA_MAX_WAIT", AzureOpenAIQuotaMaxWait)
+	onUsage(chargeQuotaCompletion)
+}
+
+func lookupDeploymentQuota(backend, deployment string) (string, RateLimit, bool) {
+	key := backend + "/" + deployment
+	if limit, ok := AzureOpenAIDeploymentQuotas[key]; ok {
+		return key, limit, true
+	}
+	limit, ok := AzureOpenAIDeploymentQuotas[deployment]
+	return key, limit, ok
+}
+
+// quotaQueue holds the requests waiting for the quota of a deployment:
+// interactive ones first, then batch ones, each in the order they came.
+type quotaQueue struct {
+	key      string
+	capacity [2]float64
+	waiters  []*quotaWaiter
+	// timer dispatches the queue once its first waiter fits in the quota.
+	timer *time.Timer
+}
+
+type quotaWaiter struct {
+	cost    [2]float64
+	reserve float64
+	batch   bool
+	granted chan struct{}
+}
+
+// quotaDeficit returns how long it takes the bucket b to hold cost plus the
+// reserve fraction of capacity. Costs larger than the whole quota wait for a
+// full bucket.
+func quotaDeficit(b *rateBucket, capacity, cost [2]float64, reserve float64) time.Duration {
+	var wait time.Duration
+	for i := range cost {
+		if capacity[i] == 0 {
+			continue
+		}
+		if deficit := math.Min(cost[i]+reserve*capacity[i], capacity[i]) - b.levels[i]; deficit > 0 {
+			wait = max(wait, time.Duration(deficit/capacity[i]*float64(time.Minute)))
+		}
+	}
+	return wait
+}
+
+// add queues w behind the waiters of its class, and of the interactive class
+// for a batch waiter, and returns how long they take to be served before it.
+func (q *quotaQueue) add(w *quotaWaiter) time.Duration {
+	i := len(q.waiters)
+	if !w.batch {
+		for i > 0 && q.waiters[i-1].batch {
+			i--
+		}
+	}
+	var ahead [2]float64
+	for _, v := range q.waiters[:i] {
+		ahead[0] += v.cost[0]
+		ahead[1] += v.cost[1]
+	}
+	q.waiters = append(q.waiters, nil)
+	copy(q.waiters[i+1:], q.waiters[i:])
+	q.waiters[i] = w
+	var wait time.Duration
+	for i := range ahead {
+		if q.capacity[i] > 0 {
+			wait = max(wait, time.Duration(ahead[i]/q.capacity[i]*float64(time.Minute)))
+		}
+	}
+	return wait
+}
+
+// remove takes w out of the queue, if it is still waiting.
+func (q *quotaQueue) remove(w *quotaWaiter) {
+	for i, v := range q.waiters {
+		if v == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch grants the quota to the waiters at the head of the queue while
+// it has room for them, and sets the timer for the first one that does not
+// fit yet. Batch waiters are only served once no interactive one is left.
+// quotaMu must be held.
+func (q *quotaQueue) dispatch() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	for len(q.waiters) > 0 {
+		w := q.waiters[0]
+		b := refillQuota(q.key, q.capacity)
+		if wait := quotaDeficit(b, q.capacity, w.cost, w.reserve); wait > 0 {
+			q.timer = time.AfterFunc(wait, func() {
+				quotaMu.Lock()
+				defer quotaMu.Unlock()
+				q.dispatch()
+			})
+			return
+		}
+		b.levels[0] -= w.cost[0]
+		b.levels[1] -= w.cost[1]
+		q.waiters = q.waiters[1:]
+		close(w.granted)
+	}
+}
+
+// acquireQuota takes requests and tokens from the quota bucket key, waiting
+// in its queue by priority until they are available and leaving the
+// quotaReserve of the priority untouched. It returns how long the caller
+// waited and a release func that gives the quota back if the request is not
+// made after all. Nothing is taken, and ok is false, when the request would
+// wait longer than maxWait; wait is then the time it would have taken.
+func acquireQuota(ctx context.Context, key string, limit RateLimit, requests, tokens float64, maxWait time.Duration, priority string) (release func(), wait time.Duration, ok bool, err error) {
+	capacity := [2]float64{float64(limit.RequestsPerMinute), float64(limit.TokensPerMinute)}
+	w := &quotaWaiter{
+		cost:    [2]float64{requests, tokens},
+		reserve: quotaReserve(priority),
+		batch:   priority == PriorityBatch,
+		granted: make(chan struct{}),
+	}
+	release = sync.OnceFunc(func() {
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+		b := refillQuota(key, capacity)
+		for i := range w.cost {
+			b.levels[i] = math.Min(capacity[i], b.levels[i]+w.cost[i])
+		}
+		if q := quotaQueues[key]; q != nil {
+			q.dispatch()
+		}
+	})
+
+	quotaMu.Lock()
+	q, found := quotaQueues[key]
+	if !found {
+		q = &quotaQueue{key: key}
+		quotaQueues[key] = q
+	}
+	q.capacity = capacity
+	wait = q.add(w) + quotaDeficit(refillQuota(key, capacity), capacity, w.cost, w.reserve)
+	if wait > maxWait {
+		q.remove(w)
+		quotaMu.Unlock()
+		return nil, wait, false, nil
+	}
+	q.dispatch()
+	quotaMu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-w.granted:
+		return release, time.Since(start), true, nil
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	quotaMu.Lock()
+	select {
+	case <-w.granted:
+		// The quota was granted as the wait ended.
+		quotaMu.Unlock()
+		if err != nil {
+			release()
+			return nil, time.Since(start), false, err
+		}
+		return release, time.Since(start), true, nil
+	default:
+	}
+	q.remove(w)
+	// The waiters behind it may fit now.
+	q.dispatch()
+	wait = quotaDeficit(refillQuota(key, capacity), capacity, w.cost, w.reserve)
+	quotaMu.Unlock()
+	return nil, wait, false, err
+}
+
+// refillQuota returns the quota bucket key, refilled for the time since it
+// was last used. quotaMu must be held.
+func refillQuota(key string, capacity [2]float64) *rateBucket {
+	now := time.Now()
+	b, ok := quotaBuckets[key]
+	if !ok {
+		b = &rateBucket{levels: capacity, updated: now}
+		quotaBuckets[key] = b
+	}
+	minutes := now.Sub(b.updated).Minutes()
+	for i := range b.levels {
+		b.levels[i] = math.Min(capacity[i], b.levels[i]+minutes*capacity[i])
+	}
+	b.updated = now
+	return b
+}
+
+// quotaCharge is the deployment quota the completion tokens of a request
+// are taken from once they are known.
+type quotaCharge struct {
+	key   string
+	limit RateLimit
+}
+
+// chargeQuotaCompletion takes the completion tokens of requests that did
+// not set a maximum from the quota of their deployment, since they could not
+// be reserved up front.
+func chargeQuotaCompletion(info *RequestInfo, usage Usage) {
+	if info.quotaCharge == nil {
+		return
+	}
+	limit := info.quotaCharge.limit
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	b := refillQuota(info.quotaCharge.key, [2]float64{float64(limit.RequestsPerMinute), float64(limit.TokensPerMinute)})
+	b.levels[1] -= float64(usage.CompletionTokens)
+}
+
+// smoothQuota holds requests to deployments with a known quota back until
+// they fit in it, the way Azure counts them: the estimated prompt tokens plus
+// max_tokens. This avoids the 429s and retry delays of bursts that exceed the
+// quota. Waiting requests are queued by priority: interactive ones are served
+// first, and batch ones only when no interactive request is waiting and
+// AzureOpenAIBatchQuotaReserve of the quota is left. Requests that would wait
+// longer than AzureOpenAIQuotaMaxWait get a 429 from the proxy, which
+// spillover retries on the next backend.
+func smoothQuota(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		info := RequestInfoFromContext(req.Context())
+		deployment := deploymentFromPath(req.URL.Path)
+		if len(AzureOpenAIDeploymentQuotas) == 0 || info == nil || info.Backend == nil || deployment == "" {
+			return next.RoundTrip(req)
+		}
+		// A previous attempt may have been charged to another backend.
+		info.quotaCharge = nil
+		key, limit, ok := lookupDeploymentQuota(info.Backend.Name, deployment)
+		if !ok {
+			return next.RoundTrip(req)
+		}
+
+		var tokens float64
+		uncapped := false
+		if _, err := bufferBody(req); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body := replayBody(req)
+			var capped bool
+			tokens, capped = quotaTokens(body)
+			uncapped = !capped && info.Operation != "embeddings"
+		}
+
+		release, wait, ok, err := acquireQuota(req.Context(), key, limit, 1, tokens, AzureOpenAIQuotaMaxWait, info.Priority)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			quotaRejected.Inc(info.Backend.Name, deployment)
+			if info.Priority == PriorityBatch {
+				shedRequests.Inc(info.Priority, "quota")
+			}
+			return quotaExceededResponse(req, deployment, wait), nil
+		}
+		if uncapped {
+			info.quotaCharge = &quotaCharge{key: key, limit: limit}
+		}
+		quotaWait.Observe(wait.Seconds(), info.Backend.Name, deployment)
+		// Requests Azure does not answer, or answers with an error, do not
+		// use its quota.
+		resp, err := next.RoundTrip(req)
+		if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+			release()
+			info.quotaCharge = nil
+		}
+		return resp, err
+	})
+}
+
+// quotaTokens returns the tokens Azure counts against the quota of a
+// deployment for a request: its estimated prompt tokens plus max_tokens, and
+// whether it sets max_tokens.
+func quotaTokens(body []byte) (float64, bool) {
+	maxTokens := gjson.GetBytes(body, "max_completion_tokens")
+	if !maxTokens.Exists() {
+		maxTokens = gjson.GetBytes(body, "max_tokens")
+	}
+	return float64(EstimateRequestTokens(body) + int(maxTokens.Int())), maxTokens.Exists()
+}
+
+// quotaExceededResponse is the 429 the proxy answers for Azure when a
+// request would exceed the quota of deployment for longer than it may wait.
+func quotaExceededResponse(req *http.Request, deployment string, wait time.Duration) *http.Response {
+	body, _ := json.Marshal(map[string]*APIError{"error": {
+		StatusCode: http.StatusTooManyRequests,
+		Message:    fmt.Sprintf("Requests to deployment %s are over its quota. Please retry after %s.", deployment, wait.Round(time.Second)),
+		Type:       "requests",
+		Code:       "429",
+	}})
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	header.Set("Retry-After-Ms", strconv.FormatInt(wait.Milliseconds(), 10))
+	return &http.Response{
+		Status:        "429 Too Many Requests",
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,529 @@
+package azure
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/redis"
+)
+
+// RateLimit is the number of requests and tokens per minute a virtual key
+// may use. Zero means no limit.
+type RateLimit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+	// RequestBurst and TokenBurst are the size of the buckets, how much a
+	// key that was idle may use at once. Zero means a minute's worth.
+	RequestBurst int
+	TokenBurst   int
+}
+
+// rates returns the requests and tokens the buckets refill per minute.
+func (l RateLimit) rates() [2]float64 {
+	return [2]float64{float64(l.RequestsPerMinute), float64(l.TokensPerMinute)}
+}
+
+// capacity returns the size of the request and token buckets.
+func (l RateLimit) capacity() [2]float64 {
+	capacity := l.rates()
+	for i, burst := range []int{l.RequestBurst, l.TokenBurst} {
+		if burst > 0 && capacity[i] > 0 {
+			capacity[i] = float64(burst)
+		}
+	}
+	return capacity
+}
+
+// scale multiplies the limit, and its bursts, by factor.
+func (l RateLimit) scale(factor float64) RateLimit {
+	return RateLimit{
+		RequestsPerMinute: int(float64(l.RequestsPerMinute) * factor),
+		TokensPerMinute:   int(float64(l.TokensPerMinute) * factor),
+		RequestBurst:      int(float64(l.RequestBurst) * factor),
+		TokenBurst:        int(float64(l.TokenBurst) * factor),
+	}
+}
+
+// RateLimitStatus is the state of the rate limit of a key when a request was
+// admitted or rejected.
+type RateLimitStatus struct {
+	Limit             RateLimit
+	RemainingRequests int
+	RemainingTokens   int
+	// RetryAfter is set when the request was rejected.
+	RetryAfter time.Duration
+}
+
+var (
+	// AzureOpenAIRateLimits maps virtual key names to their rate limit, "*"
+	// applies to every other key and to clients without a virtual key.
+	AzureOpenAIRateLimits = map[string]RateLimit{}
+	// AzureOpenAIRateLimitExempt are the virtual keys that no key rate limit
+	// applies to, not even "*".
+	AzureOpenAIRateLimitExempt = map[string]bool{}
+
+	rateLimits rateLimitStore = newMemoryRateLimitStore()
+
+	rateLimitBoostsMu sync.Mutex
+	// rateLimitBoosts are the temporary boosts of the rate limits, by key.
+	rateLimitBoosts = map[string]RateLimitBoost{}
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_RATE_LIMIT_EXEMPT"); v != "" {
+		for _, key := range SplitList(v) {
+			AzureOpenAIRateLimitExempt[key] = true
+		}
+		log.Printf("loading azure rate limit exemptions: %s", strings.Join(SortedKeys(AzureOpenAIRateLimitExempt), ","))
+	}
+	v := os.Getenv("AZURE_OPENAI_PROXY_RATE_LIMITS")
+	if v == "" {
+		return
+	}
+	for key, value := range parseKeyValueList("AZURE_OPENAI_PROXY_RATE_LIMITS", v) {
+		limit, ok := parseRateLimit(value)
+		if !ok {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_RATE_LIMITS, invalid value %s=%s", key, value)
+			os.Exit(1)
+		}
+		AzureOpenAIRateLimits[key] = limit
+		log.Printf("loading azure rate limit: %s -> %d requests, %d tokens per minute", key, limit.RequestsPerMinute, limit.TokensPerMinute)
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_RATE_LIMIT_BURSTS"); v != "" {
+		for key, value := range parseKeyValueList("AZURE_OPENAI_PROXY_RATE_LIMIT_BURSTS", v) {
+			burst, ok := parseRateLimit(value)
+			limit, limited := AzureOpenAIRateLimits[key]
+			if !ok || !limited {
+				log.Printf("error parsing AZURE_OPENAI_PROXY_RATE_LIMIT_BURSTS, invalid value %s=%s", key, value)
+				os.Exit(1)
+			}
+			limit.RequestBurst, limit.TokenBurst = burst.RequestsPerMinute, burst.TokensPerMinute
+			AzureOpenAIRateLimits[key] = limit
+			log.Printf("loading azure rate limit burst: %s -> %d requests, %d tokens", key, burst.RequestsPerMinute, burst.TokensPerMinute)
+		}
+	}
+
+	store := os.Getenv("AZURE_OPENAI_PROXY_RATE_LIMIT_STORE")
+	switch {
+	case store == "" || store == "memory":
+		store = "memory"
+	case strings.HasPrefix(store, "redis://") || strings.HasPrefix(store, "rediss://"):
+		client, err := redis.Open(store)
+		if err != nil {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_RATE_LIMIT_STORE: %v", err)
+			os.Exit(1)
+		}
+		rateLimits = &redisRateLimitStore{client: client, fallback: newMemoryRateLimitStore()}
+		store = "redis"
+	default:
+		log.Printf("error parsing AZURE_OPENAI_PROXY_RATE_LIMIT_STORE, invalid value %s", store)
+		os.Exit(1)
+	}
+	log.Printf("loading azure rate limit store: %s", store)
+	onUsage(chargeRateLimit)
+}
+
+// parseRateLimit parses a limit written as requests:tokens per minute, where
+// the tokens are optional.
+func parseRateLimit(value string) (RateLimit, bool) {
+	rpm, tpm, _ := strings.Cut(value, ":")
+	requests, err1 := strconv.Atoi(rpm)
+	tokens, err2 := strconv.Atoi(tpm)
+	if tpm == "" {
+		tokens, err2 = 0, nil
+	}
+	if err1 != nil || err2 != nil || requests < 0 || tokens < 0 {
+		return RateLimit{}, false
+	}
+	return RateLimit{RequestsPerMinute: requests, TokensPerMinute: tokens}, true
+}
+
+// rateLimitStore keeps a pair of token buckets per key, for requests and
+// tokens, that refill at their limit per minute up to their burst size.
+type rateLimitStore interface {
+	// Take refills the buckets of key and takes requests and tokens from
+	// them. With check set nothing is taken, and admitted is false, when
+	// either bucket that has a limit holds less than one unit. The levels
+	// after the call are returned.
+	Take(key string, limit RateLimit, requests, tokens float64, check bool) (levels [2]float64, admitted bool, err error)
+}
+
+// lookupRateLimit returns the rate limit of the virtual key, boosted when
+// it or, for keys under "*", "*" has a boost. It returns false when the key
+// has no limit or is exempt.
+func lookupRateLimit(key string) (RateLimit, bool) {
+	if AzureOpenAIRateLimitExempt[key] {
+		return RateLimit{}, false
+	}
+	limit, ok := AzureOpenAIRateLimits[key]
+	boost, boosted := lookupRateLimitBoost(key)
+	if !ok || key == "" {
+		if limit, ok = AzureOpenAIRateLimits["*"]; !ok {
+			return limit, false
+		}
+		if !boosted {
+			boost, boosted = lookupRateLimitBoost("*")
+		}
+	}
+	if boosted {
+		limit = limit.scale(boost.Factor)
+	}
+	return limit, true
+}
+
+// untilAvailable returns how long a bucket at level takes to reach one unit
+// at perMinute.
+func untilAvailable(level float64, perMinute int) time.Duration {
+	return time.Duration((1 - level) / float64(perMinute) * float64(time.Minute))
+}
+
+// CheckRateLimit takes one request from the rate limit of the client of
+// info and returns a 429 error when it has no requests or tokens left. The
+// state of the limit is kept in info.RateLimit for the response headers.
+func CheckRateLimit(info *RequestInfo) *APIError {
+	limit, ok := lookupRateLimit(info.KeyName)
+	if !ok {
+		return nil
+	}
+	key := info.KeyName
+	if key == "" {
+		key = "anonymous"
+	}
+	status, err := takeRateLimit(info.KeyName, key, limit)
+	if status != nil {
+		info.RateLimit = status
+	}
+	return err
+}
+
+// takeRateLimit takes one request from the rate limit bucket key, named
+// name in errors. It returns the state of the limit, nil when it could not be
+// read, and a 429 error when it has no requests or tokens left.
+func takeRateLimit(key, name string, limit RateLimit) (*RateLimitStatus, *APIError) {
+	levels, admitted, err := rateLimits.Take(key, limit, 1, 0, true)
+	if err != nil {
+		log.Printf("error checking the rate limit of %s, letting the request through: %v", name, err)
+		return nil, nil
+	}
+	status := &RateLimitStatus{
+		Limit:             limit,
+		RemainingRequests: max(int(levels[0]), 0),
+		RemainingTokens:   max(int(levels[1]), 0),
+	}
+	if admitted {
+		return status, nil
+	}
+
+	kind := "requests"
+	status.RetryAfter = untilAvailable(levels[0], limit.RequestsPerMinute)
+	if limit.RequestsPerMinute == 0 || levels[0] >= 1 {
+		kind = "tokens"
+		status.RetryAfter = untilAvailable(levels[1], limit.TokensPerMinute)
+	}
+	return status, &APIError{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    fmt.Sprintf("Rate limit reached for %s on %s per minute. Please try again in %s.", name, kind, status.RetryAfter.Round(time.Millisecond)),
+		Type:       kind,
+		Code:       "rate_limit_exceeded",
+	}
+}
+
+// chargeRateLimit takes the tokens a request used from the rate limit of its
+// client.
+func chargeRateLimit(info *RequestInfo, usage Usage) {
+	limit, ok := lookupRateLimit(info.KeyName)
+	if !ok || limit.TokensPerMinute == 0 {
+		return
+	}
+	if _, _, err := rateLimits.Take(info.KeyName, limit, 0, float64(usage.TotalTokens), false); err != nil {
+		log.Printf("error charging the rate limit of key %s: %v", info.KeyName, err)
+	}
+}
+
+// WriteQuotaHeaders sets the x-ratelimit headers of h from the rate limit
+// state of info. Azure's own remaining request and token counts are kept
+// when they are lower than the proxy's.
+func WriteQuotaHeaders(h http.Header, info *RequestInfo) {
+	if info.UpstreamLatency > 0 {
+		h.Set("X-Upstream-Latency-Ms", strconv.FormatInt(info.UpstreamLatency.Milliseconds(), 10))
+	}
+	status := info.RateLimit
+	if status == nil {
+		return
+	}
+	setRemaining := func(kind string, limit, remaining int) {
+		if limit == 0 {
+			return
+		}
+		if upstream, err := strconv.Atoi(h.Get("x-ratelimit-remaining-" + kind)); err == nil && upstream < remaining {
+			return
+		}
+		h.Set("x-ratelimit-limit-"+kind, strconv.Itoa(limit))
+		h.Set("x-ratelimit-remaining-"+kind, strconv.Itoa(remaining))
+	}
+	setRemaining("requests", status.Limit.RequestsPerMinute, status.RemainingRequests)
+	setRemaining("tokens", status.Limit.TokensPerMinute, status.RemainingTokens)
+	if status.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+		h.Set("Retry-After-Ms", strconv.FormatInt(status.RetryAfter.Milliseconds(), 10))
+	}
+}
+
+// RateLimitBoost temporarily multiplies the rate limit of a key, e.g. to
+// get a team through an incident without changing the configuration.
+type RateLimitBoost struct {
+	Key       string    `json:"key"`
+	Factor    float64   `json:"factor"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func lookupRateLimitBoost(key string) (RateLimitBoost, bool) {
+	rateLimitBoostsMu.Lock()
+	defer rateLimitBoostsMu.Unlock()
+	boost, ok := rateLimitBoosts[key]
+	if ok && !time.Now().Before(boost.ExpiresAt) {
+		delete(rateLimitBoosts, key)
+		log.Printf("rate limit boost of key %s expired", key)
+		return boost, false
+	}
+	return boost, ok
+}
+
+// BoostRateLimit multiplies the rate limit of key by factor for duration,
+// replacing any boost it has. Boosts are kept in memory by each proxy
+// instance and lost on restart.
+func BoostRateLimit(key string, factor float64, duration time.Duration) (RateLimitBoost, error) {
+	if factor <= 0 {
+		return RateLimitBoost{}, NewInvalidRequestError("factor", "invalid_value", "Invalid factor, expected a positive number.")
+	}
+	if duration <= 0 {
+		return RateLimitBoost{}, NewInvalidRequestError("duration", "invalid_value", "Invalid duration, expected a positive duration such as 1h.")
+	}
+	if _, ok := lookupRateLimit(key); !ok {
+		return RateLimitBoost{}, NewInvalidRequestError("key", "invalid_value", fmt.Sprintf("Key %s has no rate limit to boost.", key))
+	}
+	boost := RateLimitBoost{Key: key, Factor: factor, ExpiresAt: time.Now().Add(duration).UTC()}
+	rateLimitBoostsMu.Lock()
+	rateLimitBoosts[key] = boost
+	rateLimitBoostsMu.Unlock()
+	log.Printf("boosted rate limit of key %s %gx until %s", key, factor, boost.ExpiresAt.Format(time.RFC3339))
+	return boost, nil
+}
+
+// CancelRateLimitBoost ends the boost of key, if it has one.
+func CancelRateLimitBoost(key string) bool {
+	rateLimitBoostsMu.Lock()
+	defer rateLimitBoostsMu.Unlock()
+	_, ok := rateLimitBoosts[key]
+	delete(rateLimitBoosts, key)
+	if ok {
+		log.Printf("cancelled rate limit boost of key %s", key)
+	}
+	return ok
+}
+
+// KeyRateLimit is the configured rate limit of a key, with its boost.
+type KeyRateLimit struct {
+	Key               string          `json:"key"`
+	RequestsPerMinute int             `json:"requests_per_minute"`
+	TokensPerMinute   int             `json:"tokens_per_minute"`
+	RequestBurst      int             `json:"request_burst,omitempty"`
+	TokenBurst        int             `json:"token_burst,omitempty"`
+	Exempt            bool            `json:"exempt,omitempty"`
+	Boost             *RateLimitBoost `json:"boost,omitempty"`
+}
+
+// RateLimits returns the rate limits of every configured, exempt and
+// boosted key.
+func RateLimits() []KeyRateLimit {
+	keys := map[string]bool{}
+	for key := range AzureOpenAIRateLimits {
+		keys[key] = true
+	}
+	for key := range AzureOpenAIRateLimitExempt {
+		keys[key] = true
+	}
+	rateLimitBoostsMu.Lock()
+	for key, boost := range rateLimitBoosts {
+		if time.Now().Before(boost.ExpiresAt) {
+			keys[key] = true
+		}
+	}
+	rateLimitBoostsMu.Unlock()
+
+	list := make([]KeyRateLimit, 0, len(keys))
+	for _, key := range SortedKeys(keys) {
+		limit, ok := AzureOpenAIRateLimits[key]
+		if !ok && key != "*" && !AzureOpenAIRateLimitExempt[key] {
+			limit = AzureOpenAIRateLimits["*"]
+		}
+		l := KeyRateLimit{
+			Key:               key,
+			RequestsPerMinute: limit.RequestsPerMinute,
+			TokensPerMinute:   limit.TokensPerMinute,
+			RequestBurst:      limit.RequestBurst,
+			TokenBurst:        limit.TokenBurst,
+			Exempt:            AzureOpenAIRateLimitExempt[key],
+		}
+		if boost, ok := lookupRateLimitBoost(key); ok && !l.Exempt {
+			l.Boost = &boost
+		}
+		list = append(list, l)
+	}
+	return list
+}
+
+// memoryRateLimitStore keeps the buckets of a single proxy instance.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	levels  [2]float64
+	updated time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*rateBucket{}}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit RateLimit, requests, tokens float64, check bool) ([2]float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	rates, capacity := limit.rates(), limit.capacity()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &rateBucket{levels: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	minutes := now.Sub(b.updated).Minutes()
+	for i := range b.levels {
+		b.levels[i] = math.Min(capacity[i], b.levels[i]+minutes*rates[i])
+	}
+	b.updated = now
+
+	if check && ((capacity[0] > 0 && b.levels[0] < 1) || (capacity[1] > 0 && b.levels[1] < 1)) {
+		return b.levels, false, nil
+	}
+	b.levels[0] -= requests
+	b.levels[1] -= tokens
+	return b.levels, true, nil
+}
+
+// redisTakeScript is the Redis version of memoryRateLimitStore.Take, atomic
+// across proxy instances. It uses the Redis clock so that instances agree on
+// the refill.
+const redisTakeScript = `
+local rpm, tpm = tonumber(ARGV[1]), tonumber(ARGV[2])
+local take_requests, take_tokens, check = tonumber(ARGV[3]), tonumber(ARGV[4]), ARGV[5] == "1"
+local request_burst, token_burst = tonumber(ARGV[6]), tonumber(ARGV[7])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call("HMGET", KEYS[1], "requests", "tokens", "updated")
+local requests, tokens, updated = tonumber(bucket[1]), tonumber(bucket[2]), tonumber(bucket[3])
+if not updated then
+  requests, tokens, updated = request_burst, token_burst, now
+end
+local minutes = math.max(now - updated, 0) / 60000
+requests = math.min(request_burst, requests + minutes * rpm)
+tokens = math.min(token_burst, tokens + minutes * tpm)
+local admitted = 1
+if check and ((rpm > 0 and requests < 1) or (tpm > 0 and tokens < 1)) then
+  admitted = 0
+else
+  requests = requests - take_requests
+  tokens = tokens - take_tokens
+end
+redis.call("HSET", KEYS[1], "requests", tostring(requests), "tokens", tostring(tokens), "updated", tostring(now))
+-- Keep the bucket until it would have refilled.
+local ttl = 120000
+if rpm > 0 then ttl = math.max(ttl, math.ceil(request_burst / rpm * 60000)) end
+if tpm > 0 then ttl = math.max(ttl, math.ceil(token_burst / tpm * 60000)) end
+redis.call("PEXPIRE", KEYS[1], ttl)
+return {admitted, tostring(requests), tostring(tokens)}
+`
+
+// redisTakeScriptSHA is the SHA1 of redisTakeScript, by which it is run once
+// Redis has it cached.
+var redisTakeScriptSHA = fmt.Sprintf("%x", sha1.Sum([]byte(redisTakeScript)))
+
+// redisRetryInterval is how long the fallback is used once Redis could not be
+// reached, before a single request tries it again.
+const redisRetryInterval = 10 * time.Second
+
+// redisRateLimitStore shares the buckets between proxy instances. While
+// Redis cannot be reached the limits are enforced per instance by fallback.
+type redisRateLimitStore struct {
+	client   *redis.Client
+	fallback *memoryRateLimitStore
+	down     atomic.Bool
+	// retryAt is when, in Unix nanoseconds, Redis is next tried while down.
+	retryAt atomic.Int64
+}
+
+func (s *redisRateLimitStore) Take(key string, limit RateLimit, requests, tokens float64, check bool) ([2]float64, bool, error) {
+	if s.down.Load() {
+		// Only the request that moves retryAt on tries Redis, the others
+		// do not wait for it.
+		retryAt := s.retryAt.Load()
+		if time.Now().UnixNano() < retryAt || !s.retryAt.CompareAndSwap(retryAt, time.Now().Add(redisRetryInterval).UnixNano()) {
+			return s.fallback.Take(key, limit, requests, tokens, check)
+		}
+	}
+
+	checkArg := "0"
+	if check {
+		checkArg = "1"
+	}
+	capacity := limit.capacity()
+	args := []any{1, "azure-oai-proxy:rate-limit:" + key,
+		limit.RequestsPerMinute, limit.TokensPerMinute, requests, tokens, checkArg, capacity[0], capacity[1]}
+	reply, err := s.client.Do(append([]any{"EVALSHA", redisTakeScriptSHA}, args...)...)
+	if redisErr, ok := err.(redis.Error); ok && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		reply, err = s.client.Do(append([]any{"EVAL", redisTakeScript}, args...)...)
+	}
+	levels, admitted, err := parseTakeReply(reply, err)
+	if err != nil {
+		if !s.down.Load() {
+			s.retryAt.Store(time.Now().Add(redisRetryInterval).UnixNano())
+		}
+		if !s.down.Swap(true) {
+			log.Printf("error reaching the rate limit store, enforcing rate limits per instance for %s: %v", redisRetryInterval, err)
+		}
+		return s.fallback.Take(key, limit, requests, tokens, check)
+	}
+	if s.down.Swap(false) {
+		log.Printf("rate limit store is reachable again")
+	}
+	return levels, admitted, nil
+}
+
+func parseTakeReply(reply any, err error) ([2]float64, bool, error) {
+	var levels [2]float64
+	if err != nil {
+		return levels, false, err
+	}
+	items, ok := reply.([]any)
+	if !ok || len(items) != 3 {
+		return levels, false, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	admitted, _ := items[0].(int64)
+	for i := range levels {
+		s, _ := items[i+1].(string)
+		if levels[i], err = strconv.ParseFloat(s, 64); err != nil {
+			return levels, false, fmt.Errorf("unexpected rate limit script reply %v", reply)
+		}
+	}
+	return levels, admitted == 1, nil
+}
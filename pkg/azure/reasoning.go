@@ -0,0 +1,112 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// How system messages are sent to a reasoning model.
+const (
+	SystemRoleKeep      = "system"
+	SystemRoleDeveloper = "developer"
+	SystemRoleUser      = "user"
+)
+
+var (
+	// AzureOpenAIReasoningModels maps reasoning (o-series) models to how
+	// their system messages are sent. A key also matches the dated versions
+	// of the model, e.g. "o3-mini" matches "o3-mini-2025-01-31".
+	AzureOpenAIReasoningModels = map[string]string{
+		"o1":         SystemRoleDeveloper,
+		"o1-mini":    SystemRoleUser,
+		"o1-preview": SystemRoleUser,
+		"o3":         SystemRoleDeveloper,
+		"o3-mini":    SystemRoleDeveloper,
+		"o3-pro":     SystemRoleDeveloper,
+		"o4-mini":    SystemRoleDeveloper,
+	}
+
+	// reasoningUnsupportedParams are rejected by reasoning models.
+	reasoningUnsupportedParams = []string{
+		"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs", "logit_bias",
+	}
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_REASONING_MODELS"); v != "" {
+		for model, role := range parseKeyValueList("AZURE_OPENAI_REASONING_MODELS", v) {
+			switch role {
+			case SystemRoleKeep, SystemRoleDeveloper, SystemRoleUser:
+			case "off":
+				delete(AzureOpenAIReasoningModels, model)
+				continue
+			default:
+				log.Printf("error parsing AZURE_OPENAI_REASONING_MODELS, invalid system role %s=%s", model, role)
+				os.Exit(1)
+			}
+			AzureOpenAIReasoningModels[model] = role
+			log.Printf("loading azure reasoning model: %s (system role %s)", model, role)
+		}
+	}
+}
+
+// reasoningSystemRole returns how system messages are sent to model, and
+// whether it is a reasoning model at all. The longest matching key wins.
+func reasoningSystemRole(model string) (string, bool) {
+	role, match := "", ""
+	for _, name := range []string{model, GetDeploymentByModel(model)} {
+		for key, r := range AzureOpenAIReasoningModels {
+			if (name == key || strings.HasPrefix(name, key+"-")) && len(key) > len(match) {
+				role, match = r, key
+			}
+		}
+	}
+	return role, match != ""
+}
+
+// ApplyReasoningShims rewrites a chat completions request for a reasoning
+// model so that unmodified OpenAI clients work: max_tokens becomes
+// max_completion_tokens, sampling parameters the model rejects are dropped
+// and system messages are sent with the role the model accepts. It returns
+// a warning for every parameter dropped.
+func ApplyReasoningShims(body []byte) ([]byte, []string) {
+	model := gjson.GetBytes(body, "model").String()
+	role, ok := reasoningSystemRole(model)
+	if !ok {
+		return body, nil
+	}
+
+	var warnings []string
+	if maxTokens := gjson.GetBytes(body, "max_tokens"); maxTokens.Exists() {
+		if !gjson.GetBytes(body, "max_completion_tokens").Exists() {
+			body, _ = sjson.SetRawBytes(body, "max_completion_tokens", []byte(maxTokens.Raw))
+		} else {
+			warnings = append(warnings, "max_tokens was removed, max_completion_tokens is set")
+		}
+		body, _ = sjson.DeleteBytes(body, "max_tokens")
+	}
+	for _, param := range reasoningUnsupportedParams {
+		if gjson.GetBytes(body, param).Exists() {
+			body, _ = sjson.DeleteBytes(body, param)
+			warnings = append(warnings, fmt.Sprintf("%s was removed, reasoning model %s does not support it", param, model))
+		}
+	}
+
+	if role == SystemRoleKeep {
+		return body, warnings
+	}
+	for i, message := range gjson.GetBytes(body, "messages").Array() {
+		current := message.Get("role").String()
+		if (current != SystemRoleKeep && current != SystemRoleDeveloper) || current == role {
+			continue
+		}
+		body, _ = sjson.SetBytes(body, "messages."+strconv.Itoa(i)+".role", role)
+	}
+	return body, warnings
+}
@@ -0,0 +1,287 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/envfile"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+var (
+	// AzureOpenAIConfigPollInterval is how often the config file is checked
+	// for changes, zero only reloads it on SIGHUP.
+	AzureOpenAIConfigPollInterval = 10 * time.Second
+
+	// defaultModelMapper is the built-in model mapping, which
+	// AZURE_OPENAI_MODEL_MAPPER is merged into.
+	defaultModelMapper = maps.Clone(AzureOpenAIModelMapper)
+
+	reloadMu sync.Mutex
+	// configFileHash is the hash of the config file last loaded.
+	configFileHash string
+
+	configReloads = metrics.NewCounter("azure_oai_proxy_config_reloads_total",
+		"Configuration reloads, by trigger and result.", "trigger", "result")
+)
+
+func init() {
+	AzureOpenAIConfigPollInterval = envDuration("AZURE_OPENAI_PROXY_CONFIG_POLL_INTERVAL", AzureOpenAIConfigPollInterval)
+	if path := os.Getenv(envfile.PathVariable); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			configFileHash = hashConfigFile(data)
+		}
+	}
+}
+
+// StartConfigReload reloads the configuration on SIGHUP and, when there is a
+// config file, whenever its content changes. The returned func stops it.
+func StartConfigReload() (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	// Without a config file to watch, ticks stays nil and only SIGHUP
+	// reloads.
+	var ticker *time.Ticker
+	var ticks <-chan time.Time
+	path := os.Getenv(envfile.PathVariable)
+	if path != "" && AzureOpenAIConfigPollInterval > 0 {
+		log.Printf("loading azure openai proxy config file watch: %s every %s", path, AzureOpenAIConfigPollInterval)
+		ticker = time.NewTicker(AzureOpenAIConfigPollInterval)
+		ticks = ticker.C
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				ReloadConfig("signal")
+			case <-ticks:
+				reloadChangedConfigFile(path)
+			}
+		}
+	}()
+	return sync.OnceFunc(func() {
+		signal.Stop(hup)
+		if ticker != nil {
+			ticker.Stop()
+		}
+		close(done)
+	})
+}
+
+// reloadChangedConfigFile reloads the configuration when the content of the
+// config file at path changed since it was last loaded.
+func reloadChangedConfigFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// A ConfigMap update briefly swaps the file, try again later.
+		return
+	}
+	reloadMu.Lock()
+	changed := hashConfigFile(data) != configFileHash
+	reloadMu.Unlock()
+	if changed {
+		ReloadConfig("file")
+	}
+}
+
+func hashConfigFile(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// reloadable reports whether a change of the environment variable name is
+// applied by a reload rather than on restart.
+func reloadable(name string) bool {
+	switch name {
+	case "AZURE_OPENAI_MODEL_MAPPER", "AZURE_OPENAI_ENDPOINT", "AZURE_OPENAI_CONNECT_ADDRESS", "AZURE_OPENAI_BACKENDS":
+		return true
+	}
+	return strings.HasPrefix(name, "AZURE_OPENAI_BACKEND_")
+}
+
+// ReloadConfig re-reads the config file, if any, and applies the changes to
+// the backends and the model mapping, then refreshes the secrets. The
+// changes are checked as a whole and applied at once, or not at all. Requests
+// in flight finish on the backends they started on.
+func ReloadConfig(trigger string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	err := reloadConfig()
+	if err != nil {
+		log.Printf("error reloading configuration, keeping the previous one: %v", err)
+		configReloads.Inc(trigger, "error")
+		return err
+	}
+	configReloads.Inc(trigger, "success")
+	if err := loadSecrets(); err != nil {
+		log.Printf("error refreshing secrets, keeping the previous values: %v", err)
+	}
+	return nil
+}
+
+func reloadConfig() error {
+	path := os.Getenv(envfile.PathVariable)
+	if path == "" {
+		log.Printf("reloading configuration: no %s, refreshing secrets only", envfile.PathVariable)
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// A file that fails is only tried again once it changes, or on SIGHUP.
+	configFileHash = hashConfigFile(data)
+	vars, err := envfile.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	previous := envfile.Loaded()
+	changed := envfile.Apply(vars)
+	if err := applyConfigChanges(changed, configFileHash); err != nil {
+		envfile.Apply(previous)
+		return err
+	}
+	return nil
+}
+
+// applyConfigChanges applies the environment variables changed by a reload.
+func applyConfigChanges(changed []string, hash string) error {
+	slices.Sort(changed)
+	var restart []string
+	backendsChanged, mapperChanged := false, false
+	for _, name := range changed {
+		switch {
+		case name == "AZURE_OPENAI_MODEL_MAPPER":
+			mapperChanged = true
+		case reloadable(name):
+			backendsChanged = true
+		default:
+			restart = append(restart, name)
+		}
+	}
+
+	var list []*Backend
+	if backendsChanged {
+		var err error
+		if list, err = reloadBackends(); err != nil {
+			return err
+		}
+	}
+	var mapper map[string]string
+	if mapperChanged {
+		mapper = maps.Clone(defaultModelMapper)
+		if v := os.Getenv("AZURE_OPENAI_MODEL_MAPPER"); v != "" {
+			pairs, err := parseKeyValues("AZURE_OPENAI_MODEL_MAPPER", v)
+			if err != nil {
+				return err
+			}
+			maps.Copy(mapper, pairs)
+		}
+	}
+
+	configMu.Lock()
+	if list != nil {
+		backends.Store(&list)
+	}
+	if mapper != nil {
+		AzureOpenAIModelMapper = mapper
+	}
+	if list != nil || mapper != nil {
+		configVersion = "file-" + hash
+		configUpdated = time.Now()
+	}
+	configMu.Unlock()
+
+	for _, name := range restart {
+		log.Printf("reloading configuration: %s changed, restart the proxy to apply it", name)
+	}
+	log.Printf("reloaded configuration: %d backends, model mapper changed %t, %d variables need a restart",
+		len(Backends()), mapperChanged, len(restart))
+	return nil
+}
+
+// reloadBackends parses the backends from the environment. Backends whose
+// configuration is unchanged are kept, with their keys, circuit and stats.
+// Changed or removed backends must not be used by a tenant or mirror, which
+// hold on to them until restart.
+func reloadBackends() ([]*Backend, error) {
+	list, err := parseBackends(os.Getenv("AZURE_OPENAI_ENDPOINT"))
+	if err != nil {
+		return nil, err
+	}
+	current := Backends()
+	for i, b := range list {
+		if old := BackendByName(b.Name); old != nil && sameBackend(old, b) {
+			list[i] = old
+		}
+	}
+	for _, old := range current {
+		if slices.Contains(list, old) {
+			continue
+		}
+		for _, t := range Tenants {
+			if slices.Contains(t.Backends, old) {
+				return nil, fmt.Errorf("backend %s is used by tenant %s, restart the proxy to change or remove it", old.Name, t.Name)
+			}
+		}
+		for model, route := range AzureOpenAIMirrors {
+			if route.Backend == old {
+				return nil, fmt.Errorf("backend %s is used by the mirror of %s, restart the proxy to change or remove it", old.Name, model)
+			}
+		}
+	}
+
+	dynamic := false
+	for _, b := range list {
+		if slices.Contains(current, b) || b.keys == defaultKeys {
+			continue
+		}
+		primary, err := ResolveSecret(b.tokenRef)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s token: %w", b.Name, err)
+		}
+		secondary, err := ResolveSecret(b.secondaryTokenRef)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s secondary token: %w", b.Name, err)
+		}
+		b.keys.set(primary, secondary)
+		dynamic = dynamic || isDynamicSecretRef(b.tokenRef) || isDynamicSecretRef(b.secondaryTokenRef)
+	}
+	if virtualKeysRef != "" {
+		for _, b := range list {
+			if !b.HasAPIKey() {
+				return nil, fmt.Errorf("an azure api token for backend %s is required when AZURE_OPENAI_PROXY_KEYS is set", b.Name)
+			}
+		}
+	}
+	if dynamic {
+		startSecretsRefresh()
+	}
+	return list, nil
+}
+
+// sameBackend reports whether a and b are configured the same.
+func sameBackend(a, b *Backend) bool {
+	return a.Name == b.Name &&
+		a.Endpoint.String() == b.Endpoint.String() &&
+		a.Type == b.Type &&
+		a.ConnectAddress == b.ConnectAddress &&
+		a.tokenRef == b.tokenRef &&
+		a.secondaryTokenRef == b.secondaryTokenRef &&
+		maps.Equal(a.Models, b.Models) &&
+		maps.Equal(a.ModelMapper, b.ModelMapper)
+}
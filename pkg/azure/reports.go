@@ -0,0 +1,424 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageReportRow is the usage of a virtual key and model in a day, in UTC.
+type UsageReportRow struct {
+	Day              string  `json:"day"`
+	Key              string  `json:"key"`
+	Model            string  `json:"model"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+var usageReportColumns = []string{"day", "key", "model", "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost_usd"}
+
+type usageReportKey struct {
+	day, key, model string
+}
+
+var (
+	// AzureOpenAIUsageReportsDir is the local directory usage reports are
+	// written to.
+	AzureOpenAIUsageReportsDir = ""
+	// AzureOpenAIUsageReportsBlobURL is the Azure Blob Storage container URL
+	// usage reports are uploaded to, with an optional SAS token.
+	AzureOpenAIUsageReportsBlobURL = ""
+	// AzureOpenAIUsageReportsFormats are the formats of the reports, csv and
+	// json.
+	AzureOpenAIUsageReportsFormats = []string{"csv"}
+	// AzureOpenAIUsageReportsInterval is how often the reports are written.
+	AzureOpenAIUsageReportsInterval = time.Hour
+	// AzureOpenAIProxyInstance names this proxy instance in the reports it
+	// writes, so that replicas sharing a directory or container do not
+	// overwrite each other's. It defaults to the hostname.
+	AzureOpenAIProxyInstance = ""
+
+	// usageReportLoadTimeout bounds reading the report of the day back on
+	// start.
+	usageReportLoadTimeout = 10 * time.Second
+	instanceName           = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	usageReportMu    sync.Mutex
+	usageReport      = map[usageReportKey]*UsageReportRow{}
+	usageReportDirty = map[string]bool{}
+	// usageReportPending is the day whose report written before a restart
+	// could not be read back yet. It is not written until it is.
+	usageReportPending string
+)
+
+func init() {
+	AzureOpenAIUsageReportsDir = os.Getenv("AZURE_OPENAI_PROXY_USAGE_REPORTS_DIR")
+	AzureOpenAIUsageReportsBlobURL = os.Getenv("AZURE_OPENAI_PROXY_USAGE_REPORTS_BLOB_URL")
+	if AzureOpenAIUsageReportsDir == "" && AzureOpenAIUsageReportsBlobURL == "" {
+		return
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_USAGE_REPORTS_FORMATS"); v != "" {
+		AzureOpenAIUsageReportsFormats = SplitList(v)
+		for _, format := range AzureOpenAIUsageReportsFormats {
+			if format != "csv" && format != "json" {
+				log.Printf("error parsing AZURE_OPENAI_PROXY_USAGE_REPORTS_FORMATS, invalid value %s", v)
+				os.Exit(1)
+			}
+		}
+	}
+	AzureOpenAIUsageReportsInterval = envDuration("AZURE_OPENAI_PROXY_USAGE_REPORTS_INTERVAL", AzureOpenAIUsageReportsInterval)
+	if AzureOpenAIUsageReportsInterval == 0 {
+		log.Printf("error parsing AZURE_OPENAI_PROXY_USAGE_REPORTS_INTERVAL, invalid value 0")
+		os.Exit(1)
+	}
+	if AzureOpenAIUsageReportsDir != "" {
+		if err := os.MkdirAll(AzureOpenAIUsageReportsDir, 0o755); err != nil {
+			log.Printf("error creating usage reports directory %s: %v", AzureOpenAIUsageReportsDir, err)
+			os.Exit(1)
+		}
+	}
+	if AzureOpenAIUsageReportsBlobURL != "" {
+		if u, err := url.Parse(AzureOpenAIUsageReportsBlobURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_USAGE_REPORTS_BLOB_URL, invalid value %s", redactQuery(AzureOpenAIUsageReportsBlobURL))
+			os.Exit(1)
+		}
+	}
+	AzureOpenAIProxyInstance = os.Getenv("AZURE_OPENAI_PROXY_INSTANCE")
+	if AzureOpenAIProxyInstance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("error getting hostname, set AZURE_OPENAI_PROXY_INSTANCE: %v", err)
+			os.Exit(1)
+		}
+		AzureOpenAIProxyInstance = strings.Trim(regexp.MustCompile(`[^A-Za-z0-9_.-]+`).ReplaceAllString(hostname, "-"), "-._")
+	}
+	if !instanceName.MatchString(AzureOpenAIProxyInstance) {
+		log.Printf("error parsing AZURE_OPENAI_PROXY_INSTANCE, invalid value %s", AzureOpenAIProxyInstance)
+		os.Exit(1)
+	}
+	log.Printf("loading azure usage reports: %v every %s to %s as instance %s", AzureOpenAIUsageReportsFormats, AzureOpenAIUsageReportsInterval, usageReportDestination(), AzureOpenAIProxyInstance)
+}
+
+// StartUsageReports starts counting usage for the reports and writing them.
+// It first carries on from the report of the day written before a restart,
+// so that it is not overwritten with partial totals; if that report cannot
+// be read back in time, it is retried before every write instead.
+func StartUsageReports() {
+	if AzureOpenAIUsageReportsDir == "" && AzureOpenAIUsageReportsBlobURL == "" {
+		return
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	ctx, cancel := context.WithTimeout(context.Background(), usageReportLoadTimeout)
+	defer cancel()
+	if err := loadUsageReport(ctx, day); err != nil {
+		log.Printf("error loading usage report for %s, retrying before it is written: %v", day, err)
+		usageReportPending = day
+	}
+	onUsage(countUsageReport)
+	go writeUsageReports()
+}
+
+func usageReportDestination() string {
+	if AzureOpenAIUsageReportsDir != "" && AzureOpenAIUsageReportsBlobURL != "" {
+		return AzureOpenAIUsageReportsDir + " and " + redactQuery(AzureOpenAIUsageReportsBlobURL)
+	}
+	if AzureOpenAIUsageReportsDir != "" {
+		return AzureOpenAIUsageReportsDir
+	}
+	return redactQuery(AzureOpenAIUsageReportsBlobURL)
+}
+
+// redactQuery leaves the query, such as a SAS token, out of a URL for logs.
+func redactQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid url"
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+func countUsageReport(info *RequestInfo, usage Usage) {
+	day := time.Now().UTC().Format("2006-01-02")
+	var cost float64
+	if price, ok := lookupPrice(info.Model); ok {
+		cost = price.Cost(usage)
+	}
+	usageReportMu.Lock()
+	defer usageReportMu.Unlock()
+	k := usageReportKey{day: day, key: info.KeyName, model: info.Model}
+	row, ok := usageReport[k]
+	if !ok {
+		row = &UsageReportRow{Day: day, Key: info.KeyName, Model: info.Model}
+		usageReport[k] = row
+	}
+	row.Requests++
+	row.PromptTokens += int64(usage.PromptTokens)
+	row.CompletionTokens += int64(usage.CompletionTokens)
+	row.TotalTokens += int64(usage.TotalTokens)
+	row.CostUSD += cost
+	usageReportDirty[day] = true
+}
+
+// writeUsageReports writes the report of every day with new usage each
+// interval. The reports of past days are final once written and are dropped.
+func writeUsageReports() {
+	for range time.Tick(AzureOpenAIUsageReportsInterval) {
+		today := time.Now().UTC().Format("2006-01-02")
+		usageReportMu.Lock()
+		pending := usageReportPending
+		usageReportMu.Unlock()
+		if pending != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), usageReportLoadTimeout)
+			if err := loadUsageReport(ctx, pending); err != nil {
+				log.Printf("error loading usage report for %s, not writing it: %v", pending, err)
+			} else {
+				pending = ""
+			}
+			cancel()
+		}
+
+		usageReportMu.Lock()
+		usageReportPending = pending
+		reports := map[string][]UsageReportRow{}
+		for k, row := range usageReport {
+			if usageReportDirty[k.day] && k.day != pending {
+				reports[k.day] = append(reports[k.day], *row)
+			}
+		}
+		usageReportDirty = map[string]bool{}
+		if pending != "" {
+			usageReportDirty[pending] = true
+		}
+		usageReportMu.Unlock()
+
+		for day, rows := range reports {
+			sort.Slice(rows, func(i, j int) bool {
+				if rows[i].Key != rows[j].Key {
+					return rows[i].Key < rows[j].Key
+				}
+				return rows[i].Model < rows[j].Model
+			})
+			if err := writeUsageReport(day, rows); err != nil {
+				log.Printf("error writing usage report for %s: %v", day, err)
+				usageReportMu.Lock()
+				usageReportDirty[day] = true
+				usageReportMu.Unlock()
+			}
+		}
+
+		usageReportMu.Lock()
+		for k := range usageReport {
+			if k.day < today && !usageReportDirty[k.day] && k.day != pending {
+				delete(usageReport, k)
+			}
+		}
+		usageReportMu.Unlock()
+	}
+}
+
+func usageReportName(day, format string) string {
+	return "usage-" + day + "-" + AzureOpenAIProxyInstance + "." + format
+}
+
+func writeUsageReport(day string, rows []UsageReportRow) error {
+	for _, format := range AzureOpenAIUsageReportsFormats {
+		data, err := encodeUsageReport(format, rows)
+		if err != nil {
+			return err
+		}
+		name := usageReportName(day, format)
+		if AzureOpenAIUsageReportsDir != "" {
+			file := filepath.Join(AzureOpenAIUsageReportsDir, name)
+			tmp := file + ".tmp"
+			if err := os.WriteFile(tmp, data, 0o644); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, file); err != nil {
+				return err
+			}
+		}
+		if AzureOpenAIUsageReportsBlobURL != "" {
+			if err := putBlob(context.Background(), name, format, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func encodeUsageReport(format string, rows []UsageReportRow) ([]byte, error) {
+	if format == "json" {
+		return json.MarshalIndent(rows, "", "  ")
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(usageReportColumns)
+	for _, row := range rows {
+		w.Write([]string{
+			row.Day,
+			row.Key,
+			row.Model,
+			strconv.FormatInt(row.Requests, 10),
+			strconv.FormatInt(row.PromptTokens, 10),
+			strconv.FormatInt(row.CompletionTokens, 10),
+			strconv.FormatInt(row.TotalTokens, 10),
+			strconv.FormatFloat(row.CostUSD, 'f', 6, 64),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func decodeUsageReport(format string, data []byte) ([]UsageReportRow, error) {
+	var rows []UsageReportRow
+	if format == "json" {
+		err := json.Unmarshal(data, &rows)
+		return rows, err
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		if i == 0 || len(record) != len(usageReportColumns) {
+			continue
+		}
+		row := UsageReportRow{Day: record[0], Key: record[1], Model: record[2]}
+		row.Requests, _ = strconv.ParseInt(record[3], 10, 64)
+		row.PromptTokens, _ = strconv.ParseInt(record[4], 10, 64)
+		row.CompletionTokens, _ = strconv.ParseInt(record[5], 10, 64)
+		row.TotalTokens, _ = strconv.ParseInt(record[6], 10, 64)
+		row.CostUSD, _ = strconv.ParseFloat(record[7], 64)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// loadUsageReport reads the report of day back, from the local directory if
+// there is one and else from Blob Storage, and adds it to the usage counted.
+func loadUsageReport(ctx context.Context, day string) error {
+	format := AzureOpenAIUsageReportsFormats[0]
+	name := usageReportName(day, format)
+	var data []byte
+	var err error
+	if AzureOpenAIUsageReportsDir != "" {
+		data, err = os.ReadFile(filepath.Join(AzureOpenAIUsageReportsDir, name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+	} else {
+		data, err = getBlob(ctx, name)
+	}
+	if err != nil || data == nil {
+		return err
+	}
+	rows, err := decodeUsageReport(format, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	usageReportMu.Lock()
+	defer usageReportMu.Unlock()
+	for i := range rows {
+		row := rows[i]
+		k := usageReportKey{day: row.Day, key: row.Key, model: row.Model}
+		if counted, ok := usageReport[k]; ok {
+			counted.Requests += row.Requests
+			counted.PromptTokens += row.PromptTokens
+			counted.CompletionTokens += row.CompletionTokens
+			counted.TotalTokens += row.TotalTokens
+			counted.CostUSD += row.CostUSD
+			continue
+		}
+		usageReport[k] = &row
+	}
+	if len(rows) > 0 {
+		usageReportDirty[day] = true
+	}
+	return nil
+}
+
+// blobRequest returns a request for the blob name in the reports container,
+// authorized by the SAS token of the URL or else a Microsoft Entra ID token.
+func blobRequest(ctx context.Context, method, name string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(AzureOpenAIUsageReportsBlobURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, name)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", "2021-08-06")
+	if u.RawQuery == "" {
+		token, err := GetAccessToken("https://storage.azure.com/")
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+func putBlob(ctx context.Context, name, format string, data []byte) error {
+	req, err := blobRequest(ctx, http.MethodPut, name, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	if format == "json" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "text/csv")
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to upload blob %s: %s", name, string(body))
+	}
+	return nil
+}
+
+// getBlob returns the content of the blob name, or nil if it does not exist.
+func getBlob(ctx context.Context, name string) ([]byte, error) {
+	req, err := blobRequest(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get blob %s: %s", name, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,47 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// requestBody is a request body held in memory. Reading it with
+// RequestBodyBytes returns the bytes it was made from instead of a copy, so
+// that the steps a request goes through share one buffer however large its
+// base64 audio and images are.
+type requestBody struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (requestBody) Close() error { return nil }
+
+// NewRequestBody returns a request body reading data. data must not be
+// changed afterwards.
+func NewRequestBody(data []byte) io.ReadCloser {
+	return requestBody{Reader: bytes.NewReader(data), data: data}
+}
+
+// ReadRequestBody reads all of body. A body made by NewRequestBody that was
+// not read yet is not copied.
+func ReadRequestBody(body io.Reader) ([]byte, error) {
+	if b, ok := body.(requestBody); ok && b.Len() == len(b.data) {
+		b.Seek(0, io.SeekEnd)
+		return b.data, nil
+	}
+	return io.ReadAll(body)
+}
+
+// replayBody returns the body of a request buffered by bufferBody.
+func replayBody(req *http.Request) []byte {
+	if req.GetBody == nil {
+		return nil
+	}
+	rc, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	body, _ := ReadRequestBody(rc)
+	return body
+}
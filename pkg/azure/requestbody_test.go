@@ -0,0 +1,68 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadRequestBody(t *testing.T) {
+	data := []byte(`{"model":"gpt-4o","messages":[]}`)
+
+	t.Run("unread body is shared", func(t *testing.T) {
+		body := NewRequestBody(data)
+		got, err := ReadRequestBody(body)
+		if err != nil {
+			t.Fatalf("ReadRequestBody() error = %v", err)
+		}
+		if &got[0] != &data[0] || len(got) != len(data) {
+			t.Errorf("ReadRequestBody() returned a copy, want the buffer of NewRequestBody")
+		}
+		if n, err := body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Read() after ReadRequestBody() = %d, %v, want 0, EOF", n, err)
+		}
+	})
+
+	t.Run("partly read body is copied", func(t *testing.T) {
+		body := NewRequestBody(data)
+		if _, err := io.ReadFull(body, make([]byte, 3)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadRequestBody(body)
+		if err != nil {
+			t.Fatalf("ReadRequestBody() error = %v", err)
+		}
+		if !bytes.Equal(got, data[3:]) {
+			t.Errorf("ReadRequestBody() = %s, want %s", got, data[3:])
+		}
+		if &got[0] == &data[3] {
+			t.Errorf("ReadRequestBody() shared the buffer of a partly read body")
+		}
+	})
+
+	t.Run("other readers are read", func(t *testing.T) {
+		got, err := ReadRequestBody(io.NopCloser(strings.NewReader(string(data))))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("ReadRequestBody() = %s, %v, want %s", got, err, data)
+		}
+	})
+}
+
+func TestReplayBody(t *testing.T) {
+	data := []byte(`{"model":"gpt-4o"}`)
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", NewRequestBody(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replayBody(req); got != nil {
+		t.Errorf("replayBody() without GetBody = %s, want nil", got)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return NewRequestBody(data), nil }
+	for i := 0; i < 2; i++ {
+		if got := replayBody(req); !bytes.Equal(got, data) {
+			t.Errorf("replayBody() = %s, want %s", got, data)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package azure
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// schemaMaxDepth and schemaMaxFields bound the fields recorded per route,
+	// whatever the clients send.
+	schemaMaxDepth  = 8
+	schemaMaxFields = 1000
+)
+
+var (
+	// AzureOpenAISchemaSampling maps routes, such as chat/completions, to the
+	// percentage of their requests whose fields are recorded. "*" applies to
+	// every other route.
+	AzureOpenAISchemaSampling = map[string]float64{}
+
+	// schemaOpaqueFields hold objects whose keys are chosen by clients, such
+	// as JSON schemas and token ids. Their content is not recorded.
+	schemaOpaqueFields = map[string]bool{
+		"logit_bias":                               true,
+		"metadata":                                 true,
+		"tools[].function.parameters":              true,
+		"functions[].parameters":                   true,
+		"response_format.json_schema.schema":       true,
+		"data_sources[].parameters.fields_mapping": true,
+	}
+
+	schemaMu sync.Mutex
+	// schemaRoutes are the fields recorded so far, by route.
+	schemaRoutes = map[string]*schemaRoute{}
+	schemaSince  = time.Now()
+)
+
+func init() {
+	v := os.Getenv("AZURE_OPENAI_PROXY_SCHEMA_SAMPLING")
+	if v == "" {
+		return
+	}
+	for route, percent := range parseKeyValueList("AZURE_OPENAI_PROXY_SCHEMA_SAMPLING", v) {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_SCHEMA_SAMPLING, invalid value %s=%s", route, percent)
+			os.Exit(1)
+		}
+		AzureOpenAISchemaSampling[strings.Trim(route, "/")] = p
+		log.Printf("loading azure schema sampling: %s -> %g%%", route, p)
+	}
+}
+
+// SchemaRoute returns the route of a request path for the schema report:
+// the path without /v1/, with the ids of resources replaced by {id}.
+func SchemaRoute(path string) string {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(path, "/v1/"), "/"), "/")
+	for i, segment := range segments {
+		if i > 0 && strings.Trim(segment, "abcdefghijklmnopqrstuvwxyz_") != "" {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// SampleSchema reports whether the fields of a request to route are to be
+// recorded, rolling its sampling percentage.
+func SampleSchema(route string) bool {
+	percent, ok := AzureOpenAISchemaSampling[route]
+	if !ok {
+		percent = AzureOpenAISchemaSampling["*"]
+	}
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// schemaRoute holds the fields recorded for a route.
+type schemaRoute struct {
+	requests     int
+	responses    int
+	streams      int
+	apiVersions  map[string]int
+	request      schemaFields
+	response     schemaFields
+	streamEvents schemaFields
+}
+
+// schemaFields counts, for every field path, the samples that had it and
+// the JSON types it had.
+type schemaFields map[string]*schemaField
+
+type schemaField struct {
+	count int
+	types map[string]bool
+}
+
+func lookupSchemaRoute(route string) *schemaRoute {
+	r, ok := schemaRoutes[route]
+	if !ok {
+		r = &schemaRoute{apiVersions: map[string]int{}, request: schemaFields{}, response: schemaFields{}, streamEvents: schemaFields{}}
+		schemaRoutes[route] = r
+	}
+	return r
+}
+
+// collectSchemaFields adds the paths of the fields of value to paths, with
+// their types. Array elements share the path of their array followed by [].
+func collectSchemaFields(paths map[string]map[string]bool, path string, value gjson.Result, depth int) {
+	kind := jsonType(value)
+	if path != "" {
+		if paths[path] == nil {
+			paths[path] = map[string]bool{}
+		}
+		paths[path][kind] = true
+	}
+	if depth >= schemaMaxDepth || schemaOpaqueFields[path] {
+		return
+	}
+	switch kind {
+	case "object":
+		value.ForEach(func(key, v gjson.Result) bool {
+			name := key.String()
+			if path != "" {
+				name = path + "." + name
+			}
+			collectSchemaFields(paths, name, v, depth+1)
+			return true
+		})
+	case "array":
+		value.ForEach(func(_, v gjson.Result) bool {
+			collectSchemaFields(paths, path+"[]", v, depth+1)
+			return true
+		})
+	}
+}
+
+// add counts one sample with the given field paths.
+func (f schemaFields) add(paths map[string]map[string]bool) {
+	for path, types := range paths {
+		field, ok := f[path]
+		if !ok {
+			if len(f) >= schemaMaxFields {
+				continue
+			}
+			field = &schemaField{types: map[string]bool{}}
+			f[path] = field
+		}
+		field.count++
+		for kind := range types {
+			field.types[kind] = true
+		}
+	}
+}
+
+// RecordRequestSchema records the fields of a sampled JSON request body sent
+// by a client to route.
+func RecordRequestSchema(route string, body []byte) {
+	paths := map[string]map[string]bool{}
+	if gjson.ValidBytes(body) {
+		collectSchemaFields(paths, "", gjson.ParseBytes(body), 0)
+	}
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	r := lookupSchemaRoute(route)
+	r.requests++
+	r.request.add(paths)
+}
+
+// recordResponseSchema records the fields of the successful response to a
+// sampled request: of its JSON body, or of the events of its stream.
+func recordResponseSchema(res *http.Response) error {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || info.SchemaRoute == "" || info.DryRun != "" || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	route := info.SchemaRoute
+	apiVersion := res.Request.URL.Query().Get("api-version")
+	if isEventStream(res) {
+		AddStreamStage(res, &schemaStage{route: route, apiVersion: apiVersion, paths: map[string]map[string]bool{}})
+		return nil
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	return rewriteResponseEvents(res, func(body []byte) []byte {
+		paths := map[string]map[string]bool{}
+		collectSchemaFields(paths, "", gjson.ParseBytes(body), 0)
+		schemaMu.Lock()
+		defer schemaMu.Unlock()
+		r := lookupSchemaRoute(route)
+		r.responses++
+		r.apiVersions[apiVersion]++
+		r.response.add(paths)
+		return body
+	})
+}
+
+// schemaStage collects the fields of the events of a sampled stream, and
+// records them once it ends.
+type schemaStage struct {
+	route      string
+	apiVersion string
+	paths      map[string]map[string]bool
+}
+
+func (s *schemaStage) Event(data []byte) [][]byte {
+	collectSchemaFields(s.paths, "", gjson.ParseBytes(data), 0)
+	return [][]byte{data}
+}
+
+func (s *schemaStage) End() [][]byte {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	r := lookupSchemaRoute(s.route)
+	r.streams++
+	r.apiVersions[s.apiVersion]++
+	r.streamEvents.add(s.paths)
+	return nil
+}
+
+// SchemaReport is the fields recorded for a route.
+type SchemaReport struct {
+	Route string `json:"route"`
+	// Requests, Responses and Streams are the sampled requests, and their
+	// JSON and streamed responses.
+	Requests  int `json:"requests"`
+	Responses int `json:"responses"`
+	Streams   int `json:"streams"`
+	// APIVersions counts the responses by the api-version of their request.
+	APIVersions    map[string]int `json:"api_versions"`
+	RequestFields  []SchemaField  `json:"request_fields"`
+	ResponseFields []SchemaField  `json:"response_fields"`
+	StreamFields   []SchemaField  `json:"stream_fields"`
+}
+
+// SchemaField is a field path, such as messages[].content, with the number
+// and share of the samples that had it and the JSON types it had.
+type SchemaField struct {
+	Path    string   `json:"path"`
+	Count   int      `json:"count"`
+	Percent float64  `json:"percent"`
+	Types   []string `json:"types"`
+}
+
+func (f schemaFields) report(samples int) []SchemaField {
+	list := make([]SchemaField, 0, len(f))
+	for _, path := range SortedKeys(f) {
+		field := f[path]
+		list = append(list, SchemaField{
+			Path:    path,
+			Count:   field.count,
+			Percent: float64(int(float64(field.count)/float64(max(samples, 1))*1000)) / 10,
+			Types:   SortedKeys(field.types),
+		})
+	}
+	return list
+}
+
+// SchemaReports returns the fields recorded for every route since the
+// proxy started or the report was reset, and when that was.
+func SchemaReports() ([]SchemaReport, time.Time) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	reports := make([]SchemaReport, 0, len(schemaRoutes))
+	for _, route := range SortedKeys(schemaRoutes) {
+		r := schemaRoutes[route]
+		reports = append(reports, SchemaReport{
+			Route:          route,
+			Requests:       r.requests,
+			Responses:      r.responses,
+			Streams:        r.streams,
+			APIVersions:    r.apiVersions,
+			RequestFields:  r.request.report(r.requests),
+			ResponseFields: r.response.report(r.responses),
+			StreamFields:   r.streamEvents.report(r.streams),
+		})
+	}
+	return reports, schemaSince
+}
+
+// ResetSchemaReports clears the recorded fields.
+func ResetSchemaReports() {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	schemaRoutes = map[string]*schemaRoute{}
+	schemaSince = time.Now()
+	log.Printf("reset schema report")
+}
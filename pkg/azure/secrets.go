@@ -0,0 +1,280 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AzureOpenAISecretsRefreshInterval is how often secrets loaded from files
+	// or Key Vault are reloaded.
+	AzureOpenAISecretsRefreshInterval = 5 * time.Minute
+
+	secretsMu sync.RWMutex
+	// The configured secret references, kept so that they can be refreshed.
+	tokenRef          string
+	secondaryTokenRef string
+	virtualKeysRef    string
+	adminKeyRef       string
+	// adminKeyHash is the SHA-256 hash of the admin API key.
+	adminKeyHash string
+	// virtualKeys maps the hex encoded SHA-256 hash of each proxy virtual key
+	// to its name, so that the keys themselves are never kept in memory.
+	virtualKeys map[string]string
+	refreshOnce sync.Once
+)
+
+func init() {
+	tokenRef = secretRef("AZURE_OPENAI_TOKEN")
+	secondaryTokenRef = secretRef("AZURE_OPENAI_TOKEN_SECONDARY")
+	virtualKeysRef = secretRef("AZURE_OPENAI_PROXY_KEYS")
+	adminKeyRef = secretRef("AZURE_OPENAI_PROXY_ADMIN_KEY")
+	AzureOpenAISecretsRefreshInterval = envDuration("AZURE_OPENAI_SECRETS_REFRESH_INTERVAL", AzureOpenAISecretsRefreshInterval)
+
+	if err := loadSecrets(); err != nil {
+		log.Printf("error loading secrets: %v", err)
+		os.Exit(1)
+	}
+	if AzureOpenAIToken != "" {
+		log.Printf("loading azure api token from %s", describeSecretRef(tokenRef))
+	}
+	if secondaryTokenRef != "" {
+		log.Printf("loading azure secondary api token from %s", describeSecretRef(secondaryTokenRef))
+	}
+	for _, b := range Backends() {
+		if b.keys != defaultKeys && b.tokenRef != "" {
+			log.Printf("loading azure api token for backend %s from %s", b.Name, describeSecretRef(b.tokenRef))
+		}
+	}
+	if virtualKeysRef != "" {
+		log.Printf("loading %d proxy virtual keys from %s", len(virtualKeys), describeSecretRef(virtualKeysRef))
+		for _, b := range Backends() {
+			if b.apiKeys().current() == "" {
+				log.Printf("error loading proxy virtual keys: an azure api token for backend %s is required when AZURE_OPENAI_PROXY_KEYS is set", b.Name)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if adminKeyRef != "" {
+		log.Printf("loading proxy admin key from %s", describeSecretRef(adminKeyRef))
+	}
+
+	dynamic := isDynamicSecretRef(tokenRef) || isDynamicSecretRef(secondaryTokenRef) || isDynamicSecretRef(virtualKeysRef) || isDynamicSecretRef(adminKeyRef)
+	for _, b := range Backends() {
+		dynamic = dynamic || isDynamicSecretRef(b.tokenRef) || isDynamicSecretRef(b.secondaryTokenRef)
+	}
+	if dynamic {
+		startSecretsRefresh()
+	}
+}
+
+// secretRef returns the value of the environment variable name, or a file
+// reference when only the Docker style name_FILE variable is set.
+func secretRef(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	if v := os.Getenv(name + "_FILE"); v != "" {
+		return "file:" + v
+	}
+	return ""
+}
+
+func isDynamicSecretRef(ref string) bool {
+	return strings.HasPrefix(ref, "file:") || strings.HasPrefix(ref, "keyvault://")
+}
+
+func describeSecretRef(ref string) string {
+	if isDynamicSecretRef(ref) {
+		return ref
+	}
+	return "env"
+}
+
+// ResolveSecret returns the secret ref points to. A ref is either a literal
+// value, "file:<path>" for a mounted secret or
+// "keyvault://<vault-name>/<secret-name>" for an Azure Key Vault secret.
+func ResolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case strings.HasPrefix(ref, "keyvault://"):
+		vault, name, ok := strings.Cut(strings.TrimPrefix(ref, "keyvault://"), "/")
+		if !ok {
+			return "", fmt.Errorf("invalid key vault reference %s", ref)
+		}
+		return getKeyVaultSecret(vault, name)
+	default:
+		return ref, nil
+	}
+}
+
+func getKeyVaultSecret(vault, name string) (string, error) {
+	token, err := GetAccessToken("https://vault.azure.net")
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("https://%s.vault.azure.net/secrets/%s?api-version=7.4", vault, name)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get key vault secret %s/%s: %s", vault, name, string(body))
+	}
+
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", err
+	}
+	return secret.Value, nil
+}
+
+// HashKey returns the hex encoded SHA-256 hash of key.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseVirtualKeys parses name=key pairs separated by commas or newlines. A
+// key may be given as "sha256:<hex>" so that only its hash is configured.
+func parseVirtualKeys(value string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name, key, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid virtual key entry %q", pair)
+		}
+		hash := strings.TrimPrefix(key, "sha256:")
+		if hash == key {
+			hash = HashKey(key)
+		}
+		keys[strings.ToLower(hash)] = name
+	}
+	return keys, nil
+}
+
+func loadSecrets() error {
+	token, err := ResolveSecret(tokenRef)
+	if err != nil {
+		return fmt.Errorf("AZURE_OPENAI_TOKEN: %w", err)
+	}
+	secondary, err := ResolveSecret(secondaryTokenRef)
+	if err != nil {
+		return fmt.Errorf("AZURE_OPENAI_TOKEN_SECONDARY: %w", err)
+	}
+	backendKeys := map[*Backend][2]string{}
+	for _, b := range Backends() {
+		if b.keys == defaultKeys {
+			continue
+		}
+		primary, err := ResolveSecret(b.tokenRef)
+		if err != nil {
+			return fmt.Errorf("backend %s token: %w", b.Name, err)
+		}
+		secondary, err := ResolveSecret(b.secondaryTokenRef)
+		if err != nil {
+			return fmt.Errorf("backend %s secondary token: %w", b.Name, err)
+		}
+		backendKeys[b] = [2]string{primary, secondary}
+	}
+	var keys map[string]string
+	if virtualKeysRef != "" {
+		value, err := ResolveSecret(virtualKeysRef)
+		if err != nil {
+			return fmt.Errorf("AZURE_OPENAI_PROXY_KEYS: %w", err)
+		}
+		if keys, err = parseVirtualKeys(value); err != nil {
+			return fmt.Errorf("AZURE_OPENAI_PROXY_KEYS: %w", err)
+		}
+	}
+	adminKey, err := ResolveSecret(adminKeyRef)
+	if err != nil {
+		return fmt.Errorf("AZURE_OPENAI_PROXY_ADMIN_KEY: %w", err)
+	}
+
+	defaultKeys.set(token, secondary)
+	for b, k := range backendKeys {
+		b.keys.set(k[0], k[1])
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	AzureOpenAIToken = token
+	virtualKeys = keys
+	adminKeyHash = ""
+	if adminKey != "" {
+		adminKeyHash = HashKey(adminKey)
+	}
+	return nil
+}
+
+// startSecretsRefresh reloads the secrets every
+// AzureOpenAISecretsRefreshInterval in the background, once started.
+func startSecretsRefresh() {
+	refreshOnce.Do(func() { go refreshSecrets() })
+}
+
+func refreshSecrets() {
+	for range time.Tick(AzureOpenAISecretsRefreshInterval) {
+		if err := loadSecrets(); err != nil {
+			log.Printf("error refreshing secrets, keeping the previous values: %v", err)
+		}
+	}
+}
+
+// apiToken returns the configured Azure API token to use for the first
+// backend, if any. This is the secondary token while the primary one is stale.
+func apiToken() string {
+	return Backends()[0].apiKeys().current()
+}
+
+// VirtualKeysEnabled reports whether clients must authenticate with a proxy
+// virtual key.
+func VirtualKeysEnabled() bool {
+	return virtualKeysRef != ""
+}
+
+// LookupVirtualKey returns the name of the virtual key matching key.
+func LookupVirtualKey(key string) (string, bool) {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	name, ok := virtualKeys[HashKey(key)]
+	return name, ok
+}
+
+// AdminEnabled reports whether the admin API is enabled.
+func AdminEnabled() bool {
+	return adminKeyRef != ""
+}
+
+// IsAdminKey reports whether key is the admin API key.
+func IsAdminKey(key string) bool {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return adminKeyHash != "" && subtle.ConstantTimeCompare([]byte(HashKey(key)), []byte(adminKeyHash)) == 1
+}
@@ -0,0 +1,406 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// SemanticCacheHeader tells the client whether the response came from the
+// semantic cache.
+const SemanticCacheHeader = "X-Proxy-Cache"
+
+var (
+	// AzureOpenAISemanticCache enables the semantic cache for chat
+	// completions.
+	AzureOpenAISemanticCache = false
+	// AzureOpenAISemanticCacheEmbeddingModel is the model prompts are
+	// embedded with.
+	AzureOpenAISemanticCacheEmbeddingModel = "text-embedding-3-small"
+	// AzureOpenAISemanticCacheThreshold is the cosine similarity above which a
+	// cached completion is returned.
+	AzureOpenAISemanticCacheThreshold = 0.95
+	// AzureOpenAISemanticCacheTTL is how long completions are cached.
+	AzureOpenAISemanticCacheTTL = time.Hour
+	// AzureOpenAISemanticCacheMaxEntries bounds the entries kept per
+	// partition, the oldest ones are dropped first.
+	AzureOpenAISemanticCacheMaxEntries = 1000
+
+	semanticCache VectorStore
+
+	semanticCacheRequests = metrics.NewCounter("azure_oai_proxy_semantic_cache_requests_total",
+		"Chat completions looked up in the semantic cache, by result.", "result")
+)
+
+// VectorStore stores completions by the embedding of their prompt.
+// Partitions keep entries apart that must never match each other, such as
+// different models or virtual keys.
+type VectorStore interface {
+	// Search returns the response of the most similar entry in partition if
+	// its similarity is at least threshold.
+	Search(partition string, vector []float32, threshold float64) ([]byte, float64, bool, error)
+	// Add stores response under vector in partition for ttl.
+	Add(partition string, vector []float32, response []byte, ttl time.Duration) error
+}
+
+func init() {
+	AzureOpenAISemanticCache = envBool("AZURE_OPENAI_SEMANTIC_CACHE", AzureOpenAISemanticCache)
+	if !AzureOpenAISemanticCache {
+		return
+	}
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_EMBEDDING_MODEL"); v != "" {
+		AzureOpenAISemanticCacheEmbeddingModel = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			log.Printf("error parsing AZURE_OPENAI_SEMANTIC_CACHE_THRESHOLD, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAISemanticCacheThreshold = threshold
+	}
+	AzureOpenAISemanticCacheTTL = envDuration("AZURE_OPENAI_SEMANTIC_CACHE_TTL", AzureOpenAISemanticCacheTTL)
+	AzureOpenAISemanticCacheMaxEntries = envInt("AZURE_OPENAI_SEMANTIC_CACHE_MAX_ENTRIES", AzureOpenAISemanticCacheMaxEntries)
+
+	store := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_STORE")
+	switch {
+	case store == "" || store == "memory":
+		semanticCache = newMemoryVectorStore(AzureOpenAISemanticCacheMaxEntries)
+		store = "memory"
+	case strings.HasPrefix(store, "redis://") || strings.HasPrefix(store, "rediss://"):
+		client, err := redis.Open(store)
+		if err != nil {
+			log.Printf("error parsing AZURE_OPENAI_SEMANTIC_CACHE_STORE: %v", err)
+			os.Exit(1)
+		}
+		semanticCache = &redisVectorStore{client: client, maxEntries: AzureOpenAISemanticCacheMaxEntries}
+		store = "redis"
+	default:
+		log.Printf("error parsing AZURE_OPENAI_SEMANTIC_CACHE_STORE, invalid value %s", store)
+		os.Exit(1)
+	}
+	log.Printf("loading azure semantic cache: %s store, embedding model %s, threshold %g, ttl %s",
+		store, AzureOpenAISemanticCacheEmbeddingModel, AzureOpenAISemanticCacheThreshold, AzureOpenAISemanticCacheTTL)
+}
+
+// semanticCacheFill is kept in the request context on a cache miss so that
+// the response can be added to the cache.
+type semanticCacheFill struct {
+	partition string
+	vector    []float32
+}
+
+// ServeSemanticCache answers a chat completions request from the semantic
+// cache and reports whether it did. On a miss it returns req prepared for
+// the response to be cached. Requests asking for "Cache-Control: no-cache"
+// skip the lookup, "no-store" also skips caching the response.
+func ServeSemanticCache(w http.ResponseWriter, req *http.Request, body []byte) (*http.Request, bool) {
+	if !AzureOpenAISemanticCache {
+		return req, false
+	}
+	cacheControl := req.Header.Get("Cache-Control")
+	if strings.Contains(cacheControl, "no-store") {
+		return req, false
+	}
+	prompt := semanticCachePrompt(body)
+	// Audio answers are only kept by Azure for a while, and referred to by
+	// their id in later turns.
+	if prompt == "" || hasDataSources(body) || RequestsAudio(body) {
+		return req, false
+	}
+
+	vector, err := embed(req, prompt)
+	if err != nil {
+		log.Printf("error embedding prompt for the semantic cache: %v", err)
+		return req, false
+	}
+	partition := semanticCachePartition(req, body)
+	fill := &semanticCacheFill{partition: partition, vector: vector}
+	next := req.WithContext(context.WithValue(req.Context(), semanticCacheKey, fill))
+	if strings.Contains(cacheControl, "no-cache") {
+		return next, false
+	}
+
+	cached, similarity, ok, err := semanticCache.Search(partition, vector, AzureOpenAISemanticCacheThreshold)
+	if err != nil {
+		log.Printf("error searching the semantic cache: %v", err)
+		return next, false
+	}
+	if !ok {
+		semanticCacheRequests.Inc("miss")
+		w.Header().Set(SemanticCacheHeader, "MISS")
+		return next, false
+	}
+	semanticCacheRequests.Inc("hit")
+	log.Printf("semantic cache hit for [%s] with similarity %.4f", gjson.GetBytes(body, "model").String(), similarity)
+
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		info.Model = gjson.GetBytes(body, "model").String()
+	}
+	w.Header().Set(SemanticCacheHeader, "HIT")
+	w.Header().Set(SemanticCacheHeader+"-Similarity", strconv.FormatFloat(similarity, 'f', 4, 64))
+	if gjson.GetBytes(body, "stream").Bool() {
+		stream, err := completionToSSE(cached, gjson.GetBytes(body, "stream_options.include_usage").Bool())
+		if err == nil {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			w.Write(stream)
+			return req, true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(cached)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(cached)
+	return req, true
+}
+
+// semanticCachePrompt is the text of the conversation that gets embedded.
+func semanticCachePrompt(body []byte) string {
+	var b strings.Builder
+	for _, message := range gjson.GetBytes(body, "messages").Array() {
+		b.WriteString(message.Get("role").String())
+		b.WriteString(": ")
+		content := message.Get("content")
+		if content.IsArray() {
+			for _, part := range content.Array() {
+				if part.Get("type").String() != "text" {
+					// Images and audio cannot be compared by their text.
+					return ""
+				}
+				b.WriteString(part.Get("text").String())
+			}
+		} else {
+			b.WriteString(content.String())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// semanticCachePartition hashes everything but the messages that changes the
+// completion, plus the virtual key and tenant so that tenants never share
+// entries. Requests without a virtual key are partitioned by the key or
+// token the client sent.
+func semanticCachePartition(req *http.Request, body []byte) string {
+	params := body
+	for _, field := range []string{"messages", "stream", "stream_options", "user"} {
+		params, _ = sjson.DeleteBytes(params, field)
+	}
+	key, tenant := "", ""
+	if info := RequestInfoFromContext(req.Context()); info != nil {
+		key = info.KeyName
+		if info.Tenant != nil {
+			tenant = info.Tenant.Name
+		}
+	}
+	if key == "" {
+		key = "client:" + ClientKey(req.Header)
+	}
+	sum := sha256.Sum256(append([]byte(key+"\xff"+tenant+"\xff"), params...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// embed returns the embedding of text, sent with the credentials of req.
+func embed(req *http.Request, text string) ([]float32, error) {
+	body, _ := json.Marshal(map[string]string{"model": AzureOpenAISemanticCacheEmbeddingModel, "input": text})
+	ereq, err := http.NewRequestWithContext(NewRequestContext(req.Context()), http.MethodPost, "/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ereq.Header.Set("Content-Type", "application/json")
+	for _, name := range []string{"Authorization", "api-key"} {
+		if v := req.Header.Get(name); v != "" {
+			ereq.Header.Set(name, v)
+		}
+	}
+	director(ereq)
+
+	resp, err := Client.Do(ereq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings returned %d: %s", resp.StatusCode, data)
+	}
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("embeddings returned no data")
+	}
+	return result.Data[0].Embedding, nil
+}
+
+// fillSemanticCache adds a successful non-streaming completion to the cache
+// when the request missed it.
+func fillSemanticCache(res *http.Response) error {
+	fill, ok := res.Request.Context().Value(semanticCacheKey).(*semanticCacheFill)
+	if !ok || res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if gjson.GetBytes(body, "choices.0.finish_reason").String() == "stop" {
+		if err := semanticCache.Add(fill.partition, fill.vector, body, AzureOpenAISemanticCacheTTL); err != nil {
+			log.Printf("error adding to the semantic cache: %v", err)
+		}
+	}
+	return nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+type vectorEntry struct {
+	Vector   []float32       `json:"vector"`
+	Response json.RawMessage `json:"response"`
+	Expires  time.Time       `json:"expires"`
+}
+
+// searchEntries returns the most similar live entry.
+func searchEntries(entries []vectorEntry, vector []float32, threshold float64) ([]byte, float64, bool) {
+	var best []byte
+	bestSimilarity := -1.0
+	now := time.Now()
+	for _, e := range entries {
+		if now.After(e.Expires) {
+			continue
+		}
+		if s := cosineSimilarity(vector, e.Vector); s > bestSimilarity {
+			best, bestSimilarity = e.Response, s
+		}
+	}
+	if best == nil || bestSimilarity < threshold {
+		return nil, bestSimilarity, false
+	}
+	return best, bestSimilarity, true
+}
+
+// memoryVectorStore keeps entries in process, which is enough for a single
+// proxy instance.
+type memoryVectorStore struct {
+	mu         sync.Mutex
+	partitions map[string][]vectorEntry
+	maxEntries int
+}
+
+func newMemoryVectorStore(maxEntries int) *memoryVectorStore {
+	return &memoryVectorStore{partitions: map[string][]vectorEntry{}, maxEntries: maxEntries}
+}
+
+func (s *memoryVectorStore) Search(partition string, vector []float32, threshold float64) ([]byte, float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response, similarity, ok := searchEntries(s.partitions[partition], vector, threshold)
+	return response, similarity, ok, nil
+}
+
+func (s *memoryVectorStore) Add(partition string, vector []float32, response []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	entries := s.partitions[partition][:0:0]
+	for _, e := range s.partitions[partition] {
+		if now.Before(e.Expires) {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, vectorEntry{Vector: vector, Response: response, Expires: now.Add(ttl)})
+	if len(entries) > s.maxEntries {
+		entries = entries[len(entries)-s.maxEntries:]
+	}
+	s.partitions[partition] = entries
+	return nil
+}
+
+// redisVectorStore shares entries between proxy instances. Each partition is
+// a Redis list of JSON entries, newest first, compared in the proxy.
+type redisVectorStore struct {
+	client     *redis.Client
+	maxEntries int
+}
+
+func (s *redisVectorStore) key(partition string) string {
+	return "azure-oai-proxy:semantic-cache:" + partition
+}
+
+func (s *redisVectorStore) Search(partition string, vector []float32, threshold float64) ([]byte, float64, bool, error) {
+	items, err := redis.Strings(s.client.Do("LRANGE", s.key(partition), 0, s.maxEntries-1))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	entries := make([]vectorEntry, 0, len(items))
+	for _, item := range items {
+		var e vectorEntry
+		if json.Unmarshal([]byte(item), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	response, similarity, ok := searchEntries(entries, vector, threshold)
+	return response, similarity, ok, nil
+}
+
+func (s *redisVectorStore) Add(partition string, vector []float32, response []byte, ttl time.Duration) error {
+	entry, err := json.Marshal(vectorEntry{Vector: vector, Response: response, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	key := s.key(partition)
+	if _, err := s.client.Do("LPUSH", key, entry); err != nil {
+		return err
+	}
+	if _, err := s.client.Do("LTRIM", key, 0, s.maxEntries-1); err != nil {
+		return err
+	}
+	_, err = s.client.Do("PEXPIRE", key, ttl.Milliseconds())
+	return err
+}
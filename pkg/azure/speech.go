@@ -0,0 +1,76 @@
+package azure
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Values of the stream_format parameter of speech requests.
+const (
+	SpeechStreamAudio = "audio"
+	SpeechStreamSSE   = "sse"
+)
+
+// speechChunkSize is the most audio sent in one speech.audio.delta event.
+const speechChunkSize = 16 << 10
+
+// ApplySpeechStreamFormat removes the stream_format parameter, which Azure
+// does not accept, from a speech request body. It returns the body and
+// whether the client asked for the audio as server-sent events.
+func ApplySpeechStreamFormat(body []byte) ([]byte, bool, error) {
+	format := gjson.GetBytes(body, "stream_format")
+	if !format.Exists() {
+		return body, false, nil
+	}
+	switch format.String() {
+	case SpeechStreamAudio, SpeechStreamSSE:
+	default:
+		return nil, false, NewInvalidRequestError("stream_format", "invalid_value",
+			fmt.Sprintf("Invalid value: '%s'. Supported values are: '%s' and '%s'.", format.String(), SpeechStreamAudio, SpeechStreamSSE))
+	}
+	body, _ = sjson.DeleteBytes(body, "stream_format")
+	return body, format.String() == SpeechStreamSSE, nil
+}
+
+// streamSpeechEvents turns the audio of a speech response into the
+// speech.audio.delta and speech.audio.done events of stream_format sse,
+// sending each chunk as soon as Azure does.
+func streamSpeechEvents(res *http.Response) {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || !info.SpeechSSE || res.StatusCode != http.StatusOK || isEventStream(res) {
+		return
+	}
+	pr, pw := io.Pipe()
+	go func(audio io.ReadCloser) {
+		defer audio.Close()
+		buf := make([]byte, speechChunkSize)
+		for {
+			n, err := audio.Read(buf)
+			if n > 0 {
+				event := fmt.Sprintf("data: {\"type\":\"speech.audio.delta\",\"audio\":\"%s\"}\n\n", base64.StdEncoding.EncodeToString(buf[:n]))
+				if _, werr := io.WriteString(pw, event); werr != nil {
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		io.WriteString(pw, "data: {\"type\":\"speech.audio.done\"}\n\n")
+		pw.Close()
+	}(res.Body)
+
+	res.Body = pr
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	res.Header.Set("Content-Type", "text/event-stream")
+}
@@ -0,0 +1,77 @@
+package azure
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// AzureOpenAIStickySessions routes requests of the same session to the
+	// same backend and canary variant.
+	AzureOpenAIStickySessions = false
+	// AzureOpenAISessionHeader is the request header identifying a session. The
+	// "user" field of the request body is used when it is absent.
+	AzureOpenAISessionHeader = "X-Session-ID"
+)
+
+func init() {
+	AzureOpenAIStickySessions = envBool("AZURE_OPENAI_STICKY_SESSIONS", AzureOpenAIStickySessions)
+	if v := os.Getenv("AZURE_OPENAI_SESSION_HEADER"); v != "" {
+		AzureOpenAISessionHeader = v
+	}
+	if AzureOpenAIStickySessions {
+		log.Printf("loading azure sticky sessions keyed on %s or the user field", AzureOpenAISessionHeader)
+	}
+}
+
+// sessionKey returns the session a request belongs to, if sticky sessions are
+// enabled and the client identified one.
+func sessionKey(req *http.Request, body []byte) string {
+	if !AzureOpenAIStickySessions {
+		return ""
+	}
+	return requestSession(req, body)
+}
+
+// requestSession returns the session a request belongs to: the session
+// header, or else the user of the body.
+func requestSession(req *http.Request, body []byte) string {
+	if v := req.Header.Get(AzureOpenAISessionHeader); v != "" {
+		return v
+	}
+	return gjson.GetBytes(body, "user").String()
+}
+
+func hash64(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// sessionFraction maps a session and model to a stable value in [0, 1).
+func sessionFraction(session, model string) float64 {
+	return float64(hash64(session, model)>>11) / (1 << 53)
+}
+
+// orderBySession orders backends of the same type by rendezvous hashing on
+// session, so that a session keeps landing on the same backend while the
+// set of backends only changes for the sessions of a removed backend.
+// Provisioned backends still come first.
+func orderBySession(backends []*Backend, session string) []*Backend {
+	ordered := append([]*Backend(nil), backends...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Type != ordered[j].Type {
+			return ordered[i].Type == BackendProvisioned
+		}
+		return hash64(session, ordered[i].Name) > hash64(session, ordered[j].Name)
+	})
+	return ordered
+}
@@ -0,0 +1,241 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// AzureOpenAIStreamRetry retries once a chat or completions stream that
+	// Azure ended with an error before any of the answer reached the client.
+	AzureOpenAIStreamRetry = false
+
+	streamErrors = metrics.NewCounter("azure_oai_proxy_stream_errors_total",
+		"Streams Azure ended with an error after they started, by deployment and error code.", "deployment", "code")
+	streamRetries = metrics.NewCounter("azure_oai_proxy_stream_retries_total",
+		"Streams retried after Azure ended them before any of the answer was sent, by deployment.", "deployment")
+)
+
+func init() {
+	AzureOpenAIStreamRetry = envBool("AZURE_OPENAI_STREAM_RETRY", AzureOpenAIStreamRetry)
+	if AzureOpenAIStreamRetry {
+		log.Printf("loading azure stream retry: streams cut before any output are retried once")
+	}
+}
+
+// guardStream makes a chat or completions stream end cleanly when Azure
+// breaks it off, with a 429 or a containerfault error event or by dropping
+// the connection: the client gets a final error event in the OpenAI format
+// instead of a truncated stream.
+func guardStream(res *http.Response) {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || res.StatusCode != http.StatusOK || !isEventStream(res) ||
+		(info.Operation != "chat/completions" && info.Operation != "completions") {
+		return
+	}
+	res.Body = &streamGuard{ReadCloser: res.Body, reader: bufio.NewReader(res.Body), req: res.Request}
+}
+
+// streamGuard relays an SSE stream one event at a time, watching for the
+// end of the stream.
+type streamGuard struct {
+	io.ReadCloser
+	reader *bufio.Reader
+	req    *http.Request
+	// event holds the lines of the event being read.
+	event []byte
+	// output is set once part of the answer was relayed, done at [DONE].
+	output, done bool
+	retried      bool
+	pending      []byte
+	err          error
+}
+
+func (g *streamGuard) Read(b []byte) (int, error) {
+	for len(g.pending) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		reader := g.reader
+		line, err := reader.ReadBytes('\n')
+		g.event = append(g.event, line...)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 && len(line) > 0 {
+			g.flushEvent()
+		}
+		if err == io.EOF && len(g.event) > 0 {
+			g.flushEvent()
+		}
+		// The error is not the retried stream's, if an error event retried it.
+		if err != nil && g.err == nil && g.reader == reader {
+			g.fail(err, nil)
+		}
+	}
+	n := copy(b, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+// flushEvent relays the event read, unless it is an error from Azure.
+func (g *streamGuard) flushEvent() {
+	event := g.event
+	g.event = nil
+	if g.done {
+		g.pending = append(g.pending, event...)
+		return
+	}
+	var data [][]byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		if value, ok := bytes.CutPrefix(bytes.TrimRight(line, "\r"), []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
+		}
+	}
+	joined := bytes.TrimSpace(bytes.Join(data, []byte("\n")))
+	if !bytes.HasSuffix(event, []byte("\n\n")) && !bytes.HasSuffix(event, []byte("\n\r\n")) {
+		// An unterminated last event is relayed, terminated, only when its
+		// data is complete.
+		if !bytes.Equal(joined, []byte("[DONE]")) && !gjson.ValidBytes(joined) {
+			return
+		}
+		if !bytes.HasSuffix(event, []byte("\n")) {
+			event = append(event, '\n')
+		}
+		event = append(event, '\n')
+	}
+	switch {
+	case bytes.Equal(joined, []byte("[DONE]")):
+		g.done = true
+	case gjson.GetBytes(joined, "error").IsObject():
+		g.fail(nil, upstreamStreamError(gjson.GetBytes(joined, "error")))
+		return
+	case streamEventHasOutput(joined):
+		g.output = true
+	}
+	g.pending = append(g.pending, event...)
+}
+
+// fail ends a stream that broke off with the read error err or the error
+// event apiErr from Azure: it is retried when it can be, or else ended with
+// an error event.
+func (g *streamGuard) fail(err error, apiErr *APIError) {
+	// A partly read event is dropped.
+	g.event = nil
+	if g.done || (err != nil && isClientCancel(g.req, err)) {
+		g.err = err
+		if g.done {
+			g.err = io.EOF
+		}
+		return
+	}
+	if apiErr == nil {
+		apiErr = &APIError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "The stream from Azure OpenAI ended before the response was complete.",
+			Type:       "server_error",
+			Code:       "stream_interrupted",
+		}
+	}
+	deployment := deploymentFromPath(g.req.URL.Path)
+	code, _ := apiErr.Code.(string)
+	streamErrors.Inc(deployment, code)
+	if err != nil && err != io.EOF {
+		log.Printf("stream of deployment %s broke off: %v", deployment, err)
+	} else {
+		log.Printf("stream of deployment %s broke off: %s: %s", deployment, code, apiErr.Message)
+	}
+
+	if AzureOpenAIStreamRetry && !g.output && !g.retried {
+		g.retried = true
+		retryErr := g.retry()
+		if retryErr == nil {
+			streamRetries.Inc(deployment)
+			return
+		}
+		apiErr = retryErr
+	}
+	data, _ := json.Marshal(map[string]*APIError{"error": apiErr})
+	g.pending = append(g.pending, "data: "...)
+	g.pending = append(g.pending, data...)
+	g.pending = append(g.pending, "\n\n"...)
+	g.err = io.EOF
+}
+
+// retry sends the request again and continues the stream with the answer.
+// Events without output, such as the role, may be sent twice. It returns the
+// error to end the stream with when the retry fails.
+func (g *streamGuard) retry() *APIError {
+	ctx := g.req.Context()
+	body := requestBodyFromContext(ctx)
+	retry := g.req.Clone(ctx)
+	retry.RequestURI = ""
+	retry.Body = NewRequestBody(body)
+	retry.ContentLength = int64(len(body))
+	retry.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	res, err := Client.Do(retry)
+	if err != nil {
+		log.Printf("error retrying stream: %v", err)
+		return newServerError(http.StatusBadGateway, "Retrying the stream failed: "+err.Error())
+	}
+	if res.StatusCode != http.StatusOK || !isEventStream(res) {
+		defer res.Body.Close()
+		if err := decodeResponseBody(res); err == nil {
+			errBody, _ := io.ReadAll(res.Body)
+			if e := gjson.GetBytes(errBody, "error"); e.IsObject() {
+				apiErr := upstreamStreamError(e)
+				apiErr.StatusCode = res.StatusCode
+				return apiErr
+			}
+		}
+		return &APIError{StatusCode: res.StatusCode, Message: "Retrying the stream failed with " + res.Status + ".", Type: "server_error"}
+	}
+	log.Printf("retried stream of deployment %s", deploymentFromPath(g.req.URL.Path))
+	g.ReadCloser.Close()
+	g.ReadCloser = res.Body
+	g.reader = bufio.NewReader(res.Body)
+	return nil
+}
+
+// upstreamStreamError converts an error event from Azure to the OpenAI
+// format. Azure reports throttling with the code "429".
+func upstreamStreamError(e gjson.Result) *APIError {
+	apiErr := &APIError{
+		StatusCode: http.StatusInternalServerError,
+		Message:    e.Get("message").String(),
+		Type:       e.Get("type").String(),
+		Param:      e.Get("param").Value(),
+		Code:       e.Get("code").Value(),
+	}
+	if code := e.Get("code").String(); code == "429" || code == "rate_limit_exceeded" {
+		apiErr.StatusCode = http.StatusTooManyRequests
+		apiErr.Code = "rate_limit_exceeded"
+	}
+	if apiErr.Type == "" {
+		apiErr.Type = "server_error"
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = "The stream from Azure OpenAI ended with an error."
+	}
+	return apiErr
+}
+
+// streamEventHasOutput reports whether a chat or completions chunk carries
+// part of the answer, more than the role or content filter results.
+func streamEventHasOutput(data []byte) bool {
+	output := false
+	gjson.GetBytes(data, "choices").ForEach(func(_, choice gjson.Result) bool {
+		output = choice.Get("text").String() != "" || choice.Get("finish_reason").String() != ""
+		choice.Get("delta").ForEach(func(key, value gjson.Result) bool {
+			output = output || (key.String() != "role" && value.Type != gjson.Null && value.String() != "")
+			return !output
+		})
+		return !output
+	})
+	return output
+}
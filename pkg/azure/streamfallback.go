@@ -0,0 +1,227 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var (
+	// AzureOpenAIStreamFallbackModels lists models or deployments that are
+	// always called without streaming, "*" applies to every model. Streaming
+	// clients get the result re-chunked into SSE.
+	AzureOpenAIStreamFallbackModels = map[string]bool{}
+
+	// streamRejected remembers deployments that answered a streaming request
+	// with a 400 for the stream parameter.
+	streamRejected sync.Map
+)
+
+// streamChunkSize is the number of characters of content per re-chunked event.
+const streamChunkSize = 64
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_STREAM_FALLBACK_MODELS"); v != "" {
+		for _, model := range SplitList(v) {
+			AzureOpenAIStreamFallbackModels[model] = true
+			log.Printf("loading azure stream fallback model: %s", model)
+		}
+	}
+}
+
+// NeedsStreamFallback reports whether streaming requests for model have to be
+// sent upstream without streaming.
+func NeedsStreamFallback(model string) bool {
+	deployment := GetDeploymentByModel(model)
+	if AzureOpenAIStreamFallbackModels["*"] || AzureOpenAIStreamFallbackModels[model] || AzureOpenAIStreamFallbackModels[deployment] {
+		return true
+	}
+	_, rejected := streamRejected.Load(deployment)
+	return rejected
+}
+
+// PrepareStreamFallback turns a streaming request into a non-streaming one and
+// marks it so that the upstream completion is re-chunked into SSE.
+func PrepareStreamFallback(req *http.Request, body []byte) (*http.Request, []byte) {
+	ctx := context.WithValue(req.Context(), streamFallbackKey, gjson.GetBytes(body, "stream_options.include_usage").Bool())
+	return req.WithContext(ctx), disableStream(body)
+}
+
+func disableStream(body []byte) []byte {
+	body, _ = sjson.SetBytes(body, "stream", false)
+	body, _ = sjson.DeleteBytes(body, "stream_options")
+	return body
+}
+
+// handleStreamFallback re-chunks a non-streaming completion into SSE when the
+// request was prepared with PrepareStreamFallback, and retries streaming
+// requests that the deployment rejected without streaming.
+func handleStreamFallback(res *http.Response) error {
+	ctx := res.Request.Context()
+	if includeUsage, ok := ctx.Value(streamFallbackKey).(bool); ok {
+		if res.StatusCode != http.StatusOK {
+			return nil
+		}
+		return rechunkResponse(res, includeUsage)
+	}
+
+	body := requestBodyFromContext(ctx)
+	if res.StatusCode != http.StatusBadRequest || !gjson.GetBytes(body, "stream").Bool() {
+		return nil
+	}
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	errBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(errBody))
+	if !isStreamRejection(errBody) {
+		return nil
+	}
+
+	deployment := GetDeploymentByModel(gjson.GetBytes(body, "model").String())
+	streamRejected.Store(deployment, true)
+	log.Printf("deployment %s rejected streaming, retrying without stream", deployment)
+
+	retryBody := disableStream(body)
+	retry := res.Request.Clone(ctx)
+	retry.RequestURI = ""
+	retry.Body = io.NopCloser(bytes.NewReader(retryBody))
+	retry.ContentLength = int64(len(retryBody))
+	retry.Header.Set("Content-Length", strconv.Itoa(len(retryBody)))
+	retry.Header.Del("Accept-Encoding")
+	retryRes, err := Client.Do(retry)
+	if err != nil {
+		return err
+	}
+	*res = *retryRes
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+	return rechunkResponse(res, gjson.GetBytes(body, "stream_options.include_usage").Bool())
+}
+
+func isStreamRejection(errBody []byte) bool {
+	if gjson.GetBytes(errBody, "error.param").String() == "stream" {
+		return true
+	}
+	message := gjson.GetBytes(errBody, "error.message").String()
+	return strings.Contains(message, "'stream'")
+}
+
+// rechunkResponse replaces a non-streaming completion response with the
+// equivalent SSE stream.
+func rechunkResponse(res *http.Response, includeUsage bool) error {
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	stream, err := completionToSSE(body, includeUsage)
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(stream))
+	// Streams have no declared length, clients read until [DONE].
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	res.Header.Set("Content-Type", "text/event-stream")
+	return nil
+}
+
+// completionToSSE converts a chat.completion or text_completion object into
+// the chunks a streaming request would have produced.
+func completionToSSE(body []byte, includeUsage bool) ([]byte, error) {
+	completion := gjson.ParseBytes(body)
+	if !completion.Get("choices").IsArray() {
+		return nil, fmt.Errorf("unexpected completion response: %s", body)
+	}
+	chat := completion.Get("object").String() != "text_completion"
+	object := "text_completion"
+	if chat {
+		object = "chat.completion.chunk"
+	}
+
+	var buf bytes.Buffer
+	emit := func(choices []any, usage any) {
+		chunk := map[string]any{
+			"id":      completion.Get("id").Value(),
+			"object":  object,
+			"created": completion.Get("created").Value(),
+			"model":   completion.Get("model").Value(),
+			"choices": choices,
+		}
+		if fingerprint := completion.Get("system_fingerprint"); fingerprint.Exists() {
+			chunk["system_fingerprint"] = fingerprint.Value()
+		}
+		if usage != nil {
+			chunk["usage"] = usage
+		}
+		data, _ := json.Marshal(chunk)
+		buf.WriteString("data: ")
+		buf.Write(data)
+		buf.WriteString("\n\n")
+	}
+
+	for _, choice := range completion.Get("choices").Array() {
+		index := choice.Get("index").Int()
+		if !chat {
+			for _, text := range splitContent(choice.Get("text").String()) {
+				emit([]any{map[string]any{"index": index, "text": text, "logprobs": nil, "finish_reason": nil}}, nil)
+			}
+			emit([]any{map[string]any{"index": index, "text": "", "logprobs": nil, "finish_reason": choice.Get("finish_reason").Value()}}, nil)
+			continue
+		}
+
+		message := choice.Get("message")
+		emit([]any{map[string]any{"index": index, "delta": map[string]any{"role": message.Get("role").Value(), "content": ""}, "finish_reason": nil}}, nil)
+		for _, text := range splitContent(message.Get("content").String()) {
+			emit([]any{map[string]any{"index": index, "delta": map[string]any{"content": text}, "finish_reason": nil}}, nil)
+		}
+		for i, call := range message.Get("tool_calls").Array() {
+			delta := map[string]any{"tool_calls": []any{map[string]any{
+				"index":    i,
+				"id":       call.Get("id").Value(),
+				"type":     call.Get("type").Value(),
+				"function": call.Get("function").Value(),
+			}}}
+			emit([]any{map[string]any{"index": index, "delta": delta, "finish_reason": nil}}, nil)
+		}
+		final := map[string]any{"index": index, "delta": map[string]any{}, "finish_reason": choice.Get("finish_reason").Value()}
+		if filter := choice.Get("content_filter_results"); filter.Exists() {
+			final["content_filter_results"] = filter.Value()
+		}
+		emit([]any{final}, nil)
+	}
+	if includeUsage {
+		emit([]any{}, completion.Get("usage").Value())
+	}
+	buf.WriteString("data: [DONE]\n\n")
+	return buf.Bytes(), nil
+}
+
+func splitContent(content string) []string {
+	var parts []string
+	runes := []rune(content)
+	for start := 0; start < len(runes); start += streamChunkSize {
+		parts = append(parts, string(runes[start:min(start+streamChunkSize, len(runes))]))
+	}
+	return parts
+}
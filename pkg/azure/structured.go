@@ -0,0 +1,104 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// StructuredOutputHeader tells the client how a json_schema
+	// response_format was sent to Azure: StructuredOutputJSONSchema or
+	// StructuredOutputJSONObject.
+	StructuredOutputHeader     = "X-Proxy-Structured-Output"
+	StructuredOutputJSONSchema = "json_schema"
+	StructuredOutputJSONObject = "json_object"
+
+	// jsonSchemaAPIVersion is the first api-version that accepts a
+	// json_schema response_format.
+	jsonSchemaAPIVersion = "2024-08-01-preview"
+)
+
+// AzureOpenAIJSONSchemaModels tells whether models support a json_schema
+// response_format. A key also matches the dated versions of the model, the
+// longest matching key wins, and models without one support it.
+var AzureOpenAIJSONSchemaModels = map[string]bool{
+	"gpt-35-turbo":      false,
+	"gpt-3.5-turbo":     false,
+	"gpt-4":             false,
+	"gpt-4o-2024-05-13": false,
+	"o1-mini":           false,
+	"o1-preview":        false,
+}
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_JSON_SCHEMA_MODELS"); v != "" {
+		for model, support := range parseKeyValueList("AZURE_OPENAI_JSON_SCHEMA_MODELS", v) {
+			switch support {
+			case "on", "off":
+			default:
+				log.Printf("error parsing AZURE_OPENAI_JSON_SCHEMA_MODELS, invalid value %s=%s", model, support)
+				os.Exit(1)
+			}
+			AzureOpenAIJSONSchemaModels[model] = support == "on"
+			log.Printf("loading azure json_schema support: %s -> %s", model, support)
+		}
+	}
+}
+
+// supportsJSONSchema reports whether model, or the deployment it is mapped
+// to, accepts a json_schema response_format.
+func supportsJSONSchema(model string) bool {
+	support, match := true, ""
+	for _, name := range []string{model, GetDeploymentByModel(model)} {
+		for key, s := range AzureOpenAIJSONSchemaModels {
+			if (name == key || strings.HasPrefix(name, key+"-")) && len(key) > len(match) {
+				support, match = s, key
+			}
+		}
+	}
+	return support
+}
+
+// ApplyStructuredOutputs makes a chat completions request with a
+// json_schema response_format work on every deployment. It is sent as is
+// when the api-version and model support it, and otherwise downgraded to a
+// json_object response_format with the schema in a system message. It
+// returns the body and the StructuredOutputHeader value, empty when the
+// request has no json_schema response_format.
+func ApplyStructuredOutputs(body []byte) ([]byte, string) {
+	if gjson.GetBytes(body, "response_format.type").String() != StructuredOutputJSONSchema {
+		return body, ""
+	}
+	if !apiVersionBefore(AzureOpenAIAPIVersion, jsonSchemaAPIVersion) && supportsJSONSchema(gjson.GetBytes(body, "model").String()) {
+		return body, StructuredOutputJSONSchema
+	}
+
+	jsonSchema := gjson.GetBytes(body, "response_format.json_schema")
+	prompt := "Respond only with a JSON object"
+	if name := jsonSchema.Get("name").String(); name != "" {
+		prompt += fmt.Sprintf(" named %q", name)
+	}
+	if description := jsonSchema.Get("description").String(); description != "" {
+		prompt += fmt.Sprintf(" (%s)", description)
+	}
+	if schema := jsonSchema.Get("schema"); schema.Exists() {
+		prompt += " that conforms to this JSON schema:\n" + schema.Raw
+	} else {
+		prompt += "."
+	}
+	message, _ := sjson.SetBytes([]byte(`{"role":"system"}`), "content", prompt)
+	messages := []byte("[" + string(message))
+	for _, m := range gjson.GetBytes(body, "messages").Array() {
+		messages = append(append(messages, ','), m.Raw...)
+	}
+	messages = append(messages, ']')
+
+	body, _ = sjson.SetRawBytes(body, "messages", messages)
+	body, _ = sjson.SetRawBytes(body, "response_format", []byte(`{"type":"json_object"}`))
+	return body, StructuredOutputJSONObject
+}
@@ -0,0 +1,140 @@
+package azure
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// How pinned system prompts are combined with the client's system messages.
+const (
+	// SystemPromptPrepend puts the pinned prompts before the client's
+	// messages, which are kept.
+	SystemPromptPrepend = "prepend"
+	// SystemPromptOverride drops the client's system and developer messages.
+	SystemPromptOverride = "override"
+)
+
+// SystemPrompts are the system prompts pinned to chat completions, by model
+// and by virtual key name. "*" applies to models or keys without their own.
+type SystemPrompts struct {
+	Models map[string]string `json:"models"`
+	Keys   map[string]string `json:"keys"`
+}
+
+var (
+	// AzureOpenAISystemPrompts are pinned to every chat completions request.
+	AzureOpenAISystemPrompts = SystemPrompts{Models: map[string]string{}, Keys: map[string]string{}}
+	// AzureOpenAISystemPromptMode is SystemPromptPrepend or
+	// SystemPromptOverride.
+	AzureOpenAISystemPromptMode = SystemPromptPrepend
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_SYSTEM_PROMPTS_FILE"); v != "" {
+		data, err := os.ReadFile(v)
+		if err == nil {
+			err = json.Unmarshal(data, &AzureOpenAISystemPrompts)
+		}
+		if err != nil {
+			log.Printf("error loading system prompts from %s: %v", v, err)
+			os.Exit(1)
+		}
+		if AzureOpenAISystemPrompts.Models == nil {
+			AzureOpenAISystemPrompts.Models = map[string]string{}
+		}
+		if AzureOpenAISystemPrompts.Keys == nil {
+			AzureOpenAISystemPrompts.Keys = map[string]string{}
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_SYSTEM_PROMPT"); v != "" {
+		AzureOpenAISystemPrompts.Models["*"] = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_SYSTEM_PROMPT_MODE"); v != "" {
+		if v != SystemPromptPrepend && v != SystemPromptOverride {
+			log.Printf("error parsing AZURE_OPENAI_SYSTEM_PROMPT_MODE, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAISystemPromptMode = v
+	}
+
+	for model := range AzureOpenAISystemPrompts.Models {
+		log.Printf("loading azure system prompt for model %s (%s)", model, AzureOpenAISystemPromptMode)
+	}
+	for key := range AzureOpenAISystemPrompts.Keys {
+		log.Printf("loading azure system prompt for key %s (%s)", key, AzureOpenAISystemPromptMode)
+	}
+}
+
+// SystemPromptsEnabled reports whether any system prompt is pinned.
+func SystemPromptsEnabled() bool {
+	return len(AzureOpenAISystemPrompts.Models) > 0 || len(AzureOpenAISystemPrompts.Keys) > 0
+}
+
+// pinnedSystemPrompts returns the prompts pinned to requests for model by
+// the virtual key keyName: the model's, then the key's.
+func pinnedSystemPrompts(model, keyName string) []string {
+	var prompts []string
+	if p := lookupSystemPrompt(AzureOpenAISystemPrompts.Models, model, GetDeploymentByModel(model)); p != "" {
+		prompts = append(prompts, p)
+	}
+	if p := lookupSystemPrompt(AzureOpenAISystemPrompts.Keys, keyName); p != "" {
+		prompts = append(prompts, p)
+	}
+	return prompts
+}
+
+// lookupSystemPrompt returns the prompt of the first of names in prompts, or
+// the "*" one.
+func lookupSystemPrompt(prompts map[string]string, names ...string) string {
+	for _, name := range names {
+		if p, ok := prompts[name]; ok && name != "" {
+			return p
+		}
+	}
+	return prompts["*"]
+}
+
+// PinSystemPrompt inserts the system prompts pinned to the model and client
+// of a chat completions request as the first messages. Since they are added
+// by the proxy on every request, clients cannot remove them; with
+// SystemPromptOverride the client's own system and developer messages are
+// dropped as well. It returns the body and whether it changed.
+func PinSystemPrompt(body []byte, keyName string) ([]byte, bool) {
+	messages := gjson.GetBytes(body, "messages")
+	if !messages.IsArray() {
+		return body, false
+	}
+	prompts := pinnedSystemPrompts(gjson.GetBytes(body, "model").String(), keyName)
+	if len(prompts) == 0 {
+		return body, false
+	}
+
+	kept := make([]string, 0, len(prompts)+len(messages.Array()))
+	for _, prompt := range prompts {
+		message, err := json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{"system", prompt})
+		if err != nil {
+			return body, false
+		}
+		kept = append(kept, string(message))
+	}
+	for _, message := range messages.Array() {
+		role := message.Get("role").String()
+		if AzureOpenAISystemPromptMode == SystemPromptOverride && (role == "system" || role == "developer") {
+			continue
+		}
+		kept = append(kept, message.Raw)
+	}
+	pinned, err := sjson.SetRawBytes(body, "messages", []byte("["+strings.Join(kept, ",")+"]"))
+	if err != nil {
+		return body, false
+	}
+	return pinned, true
+}
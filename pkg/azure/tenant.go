@@ -0,0 +1,211 @@
+package azure
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// TenantHeader names the tenant of a request whose virtual key is not bound
+// to one. Only tenants without bound keys can be named.
+const TenantHeader = "X-Tenant-ID"
+
+// Tenant is a business unit served by the proxy with its own backends, model
+// mapping, rate limit and usage accounting.
+type Tenant struct {
+	Name string
+	// Backends are the backends the tenant's requests are routed to, empty
+	// means all of them.
+	Backends []*Backend
+	// ModelMapper maps models to deployments for the tenant, before the
+	// backend and global mappers.
+	ModelMapper map[string]string
+	// RateLimit applies to the requests of all the tenant's clients
+	// together. Zero means no limit.
+	RateLimit RateLimit
+	// Keys are the names of the virtual keys bound to the tenant.
+	Keys []string
+
+	requests         atomic.Int64
+	promptTokens     atomic.Int64
+	completionTokens atomic.Int64
+}
+
+// TenantUsage is the usage of a tenant since the proxy started.
+type TenantUsage struct {
+	Tenant           string   `json:"tenant"`
+	Backends         []string `json:"backends"`
+	Keys             []string `json:"keys"`
+	Requests         int64    `json:"requests"`
+	PromptTokens     int64    `json:"prompt_tokens"`
+	CompletionTokens int64    `json:"completion_tokens"`
+}
+
+var (
+	// Tenants are the configured tenants by name.
+	Tenants = map[string]*Tenant{}
+
+	tenantsByKey = map[string]*Tenant{}
+
+	tenantTokensTotal = metrics.NewCounter("azure_oai_proxy_tenant_tokens_total",
+		"Tokens used by successful requests, by tenant, model and type.", "tenant", "model", "type")
+)
+
+func init() {
+	// AZURE_OPENAI_TENANTS is a comma separated list of tenant names, each
+	// configured with AZURE_OPENAI_TENANT_<NAME>_* variables.
+	v := os.Getenv("AZURE_OPENAI_TENANTS")
+	if v == "" {
+		return
+	}
+	for _, name := range SplitList(v) {
+		prefix := "AZURE_OPENAI_TENANT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		tenant := &Tenant{Name: name, ModelMapper: map[string]string{}}
+		for _, backend := range SplitList(os.Getenv(prefix + "BACKENDS")) {
+			b := BackendByName(backend)
+			if b == nil {
+				log.Printf("error parsing %sBACKENDS, unknown backend %s", prefix, backend)
+				os.Exit(1)
+			}
+			tenant.Backends = append(tenant.Backends, b)
+		}
+		if mapper := os.Getenv(prefix + "MODEL_MAPPER"); mapper != "" {
+			tenant.ModelMapper = parseKeyValueList(prefix+"MODEL_MAPPER", mapper)
+		}
+		if limit := os.Getenv(prefix + "RATE_LIMIT"); limit != "" {
+			var ok bool
+			if tenant.RateLimit, ok = parseRateLimit(limit); !ok {
+				log.Printf("error parsing %sRATE_LIMIT, invalid value %s", prefix, limit)
+				os.Exit(1)
+			}
+		}
+		for _, key := range SplitList(os.Getenv(prefix + "KEYS")) {
+			if other, ok := tenantsByKey[key]; ok {
+				log.Printf("error parsing %sKEYS, key %s is already bound to tenant %s", prefix, key, other.Name)
+				os.Exit(1)
+			}
+			tenantsByKey[key] = tenant
+			tenant.Keys = append(tenant.Keys, key)
+		}
+		Tenants[name] = tenant
+		log.Printf("loading azure tenant %s: %d backends, %d model mappings, %d keys, %d requests, %d tokens per minute",
+			name, len(tenant.Backends), len(tenant.ModelMapper), len(tenant.Keys), tenant.RateLimit.RequestsPerMinute, tenant.RateLimit.TokensPerMinute)
+	}
+	onUsage(chargeTenant)
+}
+
+// ResolveTenant returns the tenant of a request from the client's virtual key
+// keyName or else the TenantHeader value header. Keys bound to a tenant
+// cannot act for another one, and tenants with keys bound to them are only
+// served to those keys. It returns nil when there is no tenant.
+func ResolveTenant(keyName, header string) (*Tenant, *APIError) {
+	if tenant, ok := tenantsByKey[keyName]; ok && keyName != "" {
+		if header != "" && header != tenant.Name {
+			return nil, tenantNotAllowed(header)
+		}
+		return tenant, nil
+	}
+	if header == "" {
+		return nil, nil
+	}
+	tenant, ok := Tenants[header]
+	if !ok {
+		return nil, NewInvalidRequestError(TenantHeader, "invalid_tenant", fmt.Sprintf("Unknown tenant %s.", header))
+	}
+	if len(tenant.Keys) > 0 {
+		return nil, tenantNotAllowed(header)
+	}
+	return tenant, nil
+}
+
+func tenantNotAllowed(tenant string) *APIError {
+	return &APIError{
+		StatusCode: http.StatusForbidden,
+		Message:    fmt.Sprintf("The key is not allowed to make requests for tenant %s.", tenant),
+		Type:       "invalid_request_error",
+		Code:       "tenant_not_allowed",
+	}
+}
+
+// CheckTenantRateLimit takes one request from the rate limit of the tenant
+// of info, if it has one, like CheckRateLimit does for keys.
+func CheckTenantRateLimit(info *RequestInfo) *APIError {
+	tenant := info.Tenant
+	if tenant == nil || tenant.RateLimit == (RateLimit{}) {
+		return nil
+	}
+	status, err := takeRateLimit(tenantRateLimitKey(tenant), "tenant "+tenant.Name, tenant.RateLimit)
+	if status != nil && (info.RateLimit == nil || err != nil) {
+		info.RateLimit = status
+	}
+	return err
+}
+
+func tenantRateLimitKey(tenant *Tenant) string {
+	return "tenant/" + tenant.Name
+}
+
+// deployment returns the deployment the tenant maps model to, if any.
+func (t *Tenant) deployment(model string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	deployment, ok := t.ModelMapper[model]
+	return deployment, ok
+}
+
+// backends returns the backends the tenant's requests can go to.
+func (t *Tenant) backends() []*Backend {
+	if t == nil || len(t.Backends) == 0 {
+		return Backends()
+	}
+	return t.Backends
+}
+
+// chargeTenant counts the usage of a request towards its tenant and takes
+// its tokens from the tenant's rate limit.
+func chargeTenant(info *RequestInfo, usage Usage) {
+	tenant := info.Tenant
+	if tenant == nil {
+		return
+	}
+	tenant.requests.Add(1)
+	tenant.promptTokens.Add(int64(usage.PromptTokens))
+	tenant.completionTokens.Add(int64(usage.CompletionTokens))
+	tenantTokensTotal.Add(float64(usage.PromptTokens), tenant.Name, info.Model, "prompt")
+	tenantTokensTotal.Add(float64(usage.CompletionTokens), tenant.Name, info.Model, "completion")
+	if tenant.RateLimit.TokensPerMinute == 0 {
+		return
+	}
+	if _, _, err := rateLimits.Take(tenantRateLimitKey(tenant), tenant.RateLimit, 0, float64(usage.TotalTokens), false); err != nil {
+		log.Printf("error charging the rate limit of tenant %s: %v", tenant.Name, err)
+	}
+}
+
+// TenantsUsage returns the usage of every tenant since the proxy started, by
+// name.
+func TenantsUsage() []TenantUsage {
+	usage := make([]TenantUsage, 0, len(Tenants))
+	for _, t := range Tenants {
+		backends := []string{}
+		for _, b := range t.Backends {
+			backends = append(backends, b.Name)
+		}
+		usage = append(usage, TenantUsage{
+			Tenant:           t.Name,
+			Backends:         backends,
+			Keys:             append([]string{}, t.Keys...),
+			Requests:         t.requests.Load(),
+			PromptTokens:     t.promptTokens.Load(),
+			CompletionTokens: t.completionTokens.Load(),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Tenant < usage[j].Tenant })
+	return usage
+}
@@ -0,0 +1,39 @@
+package azure
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+)
+
+// upstreamTLSConfig returns the TLS configuration of the upstream transport.
+// AZURE_OPENAI_CA_BUNDLE adds the PEM certificates of a file to the system
+// roots, for TLS inspecting proxies or private endpoints with internal
+// certificates. AZURE_OPENAI_TLS_INSECURE_SKIP_VERIFY turns verification off
+// altogether, which is only meant for labs.
+func upstreamTLSConfig() *tls.Config {
+	config := &tls.Config{}
+	if path := os.Getenv("AZURE_OPENAI_CA_BUNDLE"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("error reading AZURE_OPENAI_CA_BUNDLE: %v", err)
+			os.Exit(1)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			log.Printf("error parsing AZURE_OPENAI_CA_BUNDLE, no PEM certificates in %s", path)
+			os.Exit(1)
+		}
+		config.RootCAs = roots
+		log.Printf("loading azure upstream ca bundle: %s", path)
+	}
+	if envBool("AZURE_OPENAI_TLS_INSECURE_SKIP_VERIFY", false) {
+		config.InsecureSkipVerify = true
+		log.Printf("WARNING: upstream TLS certificates are not verified, AZURE_OPENAI_TLS_INSECURE_SKIP_VERIFY must not be used in production")
+	}
+	return config
+}
@@ -0,0 +1,105 @@
+package azure
+
+import (
+	"regexp"
+
+	"github.com/tidwall/gjson"
+)
+
+// tokenPattern approximates the pre-tokenization step of the cl100k/o200k
+// tokenizers: contractions, words, numbers, punctuation runs and whitespace.
+var tokenPattern = regexp.MustCompile(`'(?:[sdmt]|ll|ve|re)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s+`)
+
+const (
+	// tokensPerMessage is the fixed overhead the chat format adds per message.
+	tokensPerMessage = 4
+	// tokensPerReply primes every reply with <|start|>assistant<|message|>.
+	tokensPerReply = 3
+	// tokensPerImage is a flat estimate for a low detail image part.
+	tokensPerImage = 85
+	// tokensPerAudioSecond is the rate audio input is counted at, and
+	// audioBytesPerSecond the size of a second of 16-bit 24 kHz wav or of
+	// 128 kbps mp3.
+	tokensPerAudioSecond = 10
+)
+
+var audioBytesPerSecond = map[string]int64{"wav": 48000, "mp3": 16000}
+
+// EstimateTokens returns an estimate of the number of tokens in text. Each
+// pre-token costs one token plus one more for every four characters past the
+// first four, which tracks the real BPE count closely for English and code.
+func EstimateTokens(text string) int {
+	count := 0
+	for _, piece := range tokenPattern.FindAllString(text, -1) {
+		count += 1 + (len([]rune(piece))-1)/4
+	}
+	return count
+}
+
+// EstimateRequestTokens estimates the prompt tokens of a chat completions,
+// completions or embeddings request body.
+func EstimateRequestTokens(body []byte) int {
+	if messages := gjson.GetBytes(body, "messages"); messages.IsArray() {
+		count := tokensPerReply
+		for _, message := range messages.Array() {
+			count += EstimateMessageTokens(message)
+		}
+		return count
+	}
+
+	count := 0
+	for _, field := range []string{"prompt", "input"} {
+		value := gjson.GetBytes(body, field)
+		if !value.IsArray() {
+			count += EstimateTokens(value.String())
+			continue
+		}
+		for _, item := range value.Array() {
+			if item.Type == gjson.Number {
+				// Pre-tokenized input, one token per id.
+				count++
+				continue
+			}
+			if item.IsArray() {
+				count += len(item.Array())
+				continue
+			}
+			count += EstimateTokens(item.String())
+		}
+	}
+	return count
+}
+
+// EstimateMessageTokens estimates the tokens a single chat message occupies,
+// including the per-message framing overhead.
+func EstimateMessageTokens(message gjson.Result) int {
+	count := tokensPerMessage
+	count += EstimateTokens(message.Get("role").String())
+	if name := message.Get("name"); name.Exists() {
+		count += EstimateTokens(name.String()) + 1
+	}
+
+	content := message.Get("content")
+	if content.IsArray() {
+		for _, part := range content.Array() {
+			switch part.Get("type").String() {
+			case "text":
+				count += EstimateTokens(part.Get("text").String())
+			case "image_url":
+				count += tokensPerImage
+			case "input_audio":
+				if rate := audioBytesPerSecond[part.Get("input_audio.format").String()]; rate > 0 {
+					count += int(base64Size(part.Get("input_audio.data").String()) / rate * tokensPerAudioSecond)
+				}
+			}
+		}
+	} else {
+		count += EstimateTokens(content.String())
+	}
+
+	for _, call := range message.Get("tool_calls").Array() {
+		count += EstimateTokens(call.Get("function.name").String())
+		count += EstimateTokens(call.Get("function.arguments").String())
+	}
+	return count
+}
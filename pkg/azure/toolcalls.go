@@ -0,0 +1,289 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// ToolCallsHeader reports the outcome of the tool call validation: "valid",
+// "repaired" or "invalid".
+const ToolCallsHeader = "X-Proxy-Tool-Calls"
+
+var (
+	// AzureOpenAIToolCallValidation is "off", "flag" to only report invalid
+	// tool call arguments, or "repair" to also fix them where possible.
+	AzureOpenAIToolCallValidation = "off"
+
+	toolCallRepairs = metrics.NewCounter("azure_oai_proxy_tool_call_repairs_total",
+		"Tool call arguments repaired by the proxy, by kind of repair.", "model", "kind")
+	toolCallFailures = metrics.NewCounter("azure_oai_proxy_tool_call_validation_failures_total",
+		"Tool call arguments that failed validation and could not be repaired.", "model")
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_TOOL_CALL_VALIDATION"); v != "" {
+		if v != "off" && v != "flag" && v != "repair" {
+			log.Printf("error parsing AZURE_OPENAI_TOOL_CALL_VALIDATION, invalid value %s", v)
+			os.Exit(1)
+		}
+		AzureOpenAIToolCallValidation = v
+		log.Printf("loading azure tool call validation: %s", v)
+	}
+}
+
+// toolSchemas returns the parameter schemas of the tools and legacy
+// functions declared in a chat completions request, by function name.
+func toolSchemas(body []byte) map[string]gjson.Result {
+	schemas := map[string]gjson.Result{}
+	for _, tool := range gjson.GetBytes(body, "tools").Array() {
+		schemas[tool.Get("function.name").String()] = tool.Get("function.parameters")
+	}
+	for _, function := range gjson.GetBytes(body, "functions").Array() {
+		schemas[function.Get("name").String()] = function.Get("parameters")
+	}
+	return schemas
+}
+
+// validateToolCalls checks the tool call arguments of a non-streaming chat
+// completion against the schemas of the request, repairing them when
+// AzureOpenAIToolCallValidation is "repair".
+func validateToolCalls(res *http.Response) error {
+	if AzureOpenAIToolCallValidation == "off" || res.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	schemas := toolSchemas(requestBodyFromContext(res.Request.Context()))
+	if len(schemas) == 0 {
+		return nil
+	}
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	outcome := ""
+	for i, choice := range gjson.GetBytes(body, "choices").Array() {
+		calls := map[string]gjson.Result{}
+		for j, call := range choice.Get("message.tool_calls").Array() {
+			calls["choices."+strconv.Itoa(i)+".message.tool_calls."+strconv.Itoa(j)+".function"] = call.Get("function")
+		}
+		if call := choice.Get("message.function_call"); call.Exists() {
+			calls["choices."+strconv.Itoa(i)+".message.function_call"] = call
+		}
+
+		for path, call := range calls {
+			name := call.Get("name").String()
+			args, result := checkToolCallArguments(model, name, call.Get("arguments").String(), schemas[name])
+			if result == "repaired" {
+				body, _ = sjson.SetBytes(body, path+".arguments", args)
+			}
+			// The header reports the worst outcome.
+			if outcome == "" || outcome == "valid" || result == "invalid" {
+				outcome = result
+			}
+		}
+	}
+	if outcome != "" {
+		res.Header.Set(ToolCallsHeader, outcome)
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// checkToolCallArguments validates args for the function name and returns
+// them, repaired if possible, with "valid", "repaired" or "invalid".
+func checkToolCallArguments(model, name, args string, schema gjson.Result) (string, string) {
+	repair := AzureOpenAIToolCallValidation == "repair"
+	result := "valid"
+	if !gjson.Valid(args) {
+		fixed, ok := repairJSON(args)
+		if !repair || !ok {
+			log.Printf("tool call %s returned invalid JSON arguments", name)
+			toolCallFailures.Inc(model)
+			return args, "invalid"
+		}
+		log.Printf("repaired invalid JSON arguments of tool call %s", name)
+		toolCallRepairs.Inc(model, "json")
+		args, result = fixed, "repaired"
+	}
+
+	errs := validateSchema(schema, gjson.Parse(args), "")
+	if len(errs) > 0 && repair {
+		var value any
+		if json.Unmarshal([]byte(args), &value) == nil {
+			coerced, _ := json.Marshal(coerceToSchema(schema, value))
+			if len(validateSchema(schema, gjson.ParseBytes(coerced), "")) == 0 {
+				log.Printf("repaired arguments of tool call %s: %s", name, strings.Join(errs, "; "))
+				toolCallRepairs.Inc(model, "schema")
+				return string(coerced), "repaired"
+			}
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("tool call %s arguments do not match the schema: %s", name, strings.Join(errs, "; "))
+		toolCallFailures.Inc(model)
+		return args, "invalid"
+	}
+	return args, result
+}
+
+// repairJSON fixes the mistakes models commonly make in tool call arguments:
+// Markdown code fences, text around the object, trailing commas and
+// truncated output with unclosed strings, objects or arrays.
+func repairJSON(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "```json")
+	s = strings.TrimPrefix(s, "```")
+	s = strings.TrimSuffix(s, "```")
+	if start := strings.IndexAny(s, "{["); start > 0 {
+		s = s[start:]
+	}
+
+	var out strings.Builder
+	var stack []byte
+	inString, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if inString {
+			out.WriteByte(ch)
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == '"':
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			if len(stack) == 0 || stack[len(stack)-1] != ch {
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			trimTrailingComma(&out)
+		}
+		out.WriteByte(ch)
+		if len(stack) == 0 && (ch == '}' || ch == ']') {
+			// Ignore anything after the top-level value.
+			break
+		}
+	}
+	if inString {
+		if escaped {
+			out.WriteByte('\\')
+		}
+		out.WriteByte('"')
+	}
+	for len(stack) > 0 {
+		trimTrailingComma(&out)
+		out.WriteByte(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+	}
+
+	repaired := out.String()
+	if !gjson.Valid(repaired) {
+		return "", false
+	}
+	return repaired, true
+}
+
+// trimTrailingComma removes a comma, and the whitespace after it, that ends
+// the output so far.
+func trimTrailingComma(out *strings.Builder) {
+	s := strings.TrimRight(out.String(), " \t\r\n")
+	if !strings.HasSuffix(s, ",") {
+		return
+	}
+	out.Reset()
+	out.WriteString(strings.TrimSuffix(s, ","))
+}
+
+// coerceToSchema converts scalars to the type the schema asks for, such as
+// "3" to 3, and drops properties the schema forbids.
+func coerceToSchema(schema gjson.Result, value any) any {
+	if !schema.IsObject() {
+		return value
+	}
+	types := schemaTypes(schema)
+	has := func(t string) bool {
+		for _, candidate := range types {
+			if candidate == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch v := value.(type) {
+	case string:
+		if has("string") {
+			return v
+		}
+		if has("integer") {
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return n
+			}
+		}
+		if has("number") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f
+			}
+		}
+		if has("boolean") {
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b
+			}
+		}
+	case float64:
+		if has("string") && !has("number") && !has("integer") {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	case bool:
+		if has("string") && !has("boolean") {
+			return strconv.FormatBool(v)
+		}
+	case map[string]any:
+		properties := schema.Get("properties")
+		for key, item := range v {
+			sub := properties.Get(gjson.Escape(key))
+			if !sub.Exists() {
+				if schema.Get("additionalProperties").Type == gjson.False {
+					delete(v, key)
+				}
+				continue
+			}
+			v[key] = coerceToSchema(sub, item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = coerceToSchema(schema.Get("items"), item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,191 @@
+package azure
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// trafficSeconds is how many seconds of traffic are kept for the
+	// dashboard.
+	trafficSeconds = 300
+	// trafficLatencySamples bounds the latencies kept per second.
+	trafficLatencySamples = 256
+	// trafficRecentErrors is how many failed requests are kept.
+	trafficRecentErrors = 50
+)
+
+// TrafficPoint is the traffic of one second.
+type TrafficPoint struct {
+	Time         int64   `json:"time"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// TrafficError is a request that failed, answered by Azure or the proxy.
+type TrafficError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Model     string    `json:"model"`
+	Key       string    `json:"key"`
+	Backend   string    `json:"backend"`
+	Status    int       `json:"status"`
+	LatencyMs int64     `json:"latency_ms"`
+}
+
+// ModelTokens is the token use of a model since the proxy started.
+type ModelTokens struct {
+	Model            string `json:"model"`
+	Requests         int64  `json:"requests"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+}
+
+// TrafficSnapshot is the recent traffic of the proxy. Rates and latency
+// percentiles are over the last minute.
+type TrafficSnapshot struct {
+	Time         time.Time      `json:"time"`
+	RPS          float64        `json:"rps"`
+	ErrorRate    float64        `json:"error_rate"`
+	LatencyP50Ms int64          `json:"latency_p50_ms"`
+	LatencyP95Ms int64          `json:"latency_p95_ms"`
+	Series       []TrafficPoint `json:"series"`
+	Models       []ModelTokens  `json:"models"`
+	Errors       []TrafficError `json:"errors"`
+}
+
+type trafficSecond struct {
+	unix      int64
+	requests  int
+	errors    int
+	latency   time.Duration
+	latencies []time.Duration
+}
+
+var traffic struct {
+	mu      sync.Mutex
+	enabled bool
+	seconds [trafficSeconds]trafficSecond
+	errors  []TrafficError
+	models  map[string]*ModelTokens
+}
+
+func init() {
+	onUsage(countModelTokens)
+}
+
+// EnableTrafficAccounting starts keeping the recent traffic and token use
+// returned by Traffic.
+func EnableTrafficAccounting() {
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+	traffic.enabled = true
+	traffic.models = map[string]*ModelTokens{}
+}
+
+// RecordTraffic adds a request the proxy answered to the recent traffic.
+func RecordTraffic(info *RequestInfo, method, path string, status int, latency time.Duration) {
+	now := time.Now()
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+	if !traffic.enabled {
+		return
+	}
+	s := &traffic.seconds[now.Unix()%trafficSeconds]
+	if s.unix != now.Unix() {
+		*s = trafficSecond{unix: now.Unix(), latencies: s.latencies[:0]}
+	}
+	s.requests++
+	s.latency += latency
+	if len(s.latencies) < trafficLatencySamples {
+		s.latencies = append(s.latencies, latency)
+	}
+	if status < 400 {
+		return
+	}
+	s.errors++
+	e := TrafficError{
+		Time:      now.Add(-latency),
+		Method:    method,
+		Path:      path,
+		Model:     info.Model,
+		Key:       info.KeyName,
+		Status:    status,
+		LatencyMs: latency.Milliseconds(),
+	}
+	if info.Backend != nil {
+		e.Backend = info.Backend.Name
+	}
+	if len(traffic.errors) == trafficRecentErrors {
+		traffic.errors = traffic.errors[1:]
+	}
+	traffic.errors = append(traffic.errors, e)
+}
+
+func countModelTokens(info *RequestInfo, usage Usage) {
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+	if !traffic.enabled {
+		return
+	}
+	m, ok := traffic.models[info.Model]
+	if !ok {
+		m = &ModelTokens{Model: info.Model}
+		traffic.models[info.Model] = m
+	}
+	m.Requests++
+	m.PromptTokens += int64(usage.PromptTokens)
+	m.CompletionTokens += int64(usage.CompletionTokens)
+}
+
+// Traffic returns the recent traffic, newest errors first.
+func Traffic() TrafficSnapshot {
+	now := time.Now()
+	traffic.mu.Lock()
+	defer traffic.mu.Unlock()
+
+	snapshot := TrafficSnapshot{
+		Time:   now,
+		Series: make([]TrafficPoint, 0, trafficSeconds),
+		Models: []ModelTokens{},
+		Errors: []TrafficError{},
+	}
+	var requests, errors int
+	var latencies []time.Duration
+	for t := now.Unix() - trafficSeconds + 1; t <= now.Unix(); t++ {
+		point := TrafficPoint{Time: t}
+		if s := &traffic.seconds[t%trafficSeconds]; s.unix == t {
+			point.Requests, point.Errors = s.requests, s.errors
+			point.AvgLatencyMs = float64(s.latency.Milliseconds()) / float64(s.requests)
+			if now.Unix()-t < 60 {
+				requests += s.requests
+				errors += s.errors
+				latencies = append(latencies, s.latencies...)
+			}
+		}
+		snapshot.Series = append(snapshot.Series, point)
+	}
+	snapshot.RPS = float64(requests) / 60
+	if requests > 0 {
+		snapshot.ErrorRate = float64(errors) / float64(requests)
+		slices.Sort(latencies)
+		snapshot.LatencyP50Ms = latencies[(len(latencies)*50-1)/100].Milliseconds()
+		snapshot.LatencyP95Ms = latencies[(len(latencies)*95-1)/100].Milliseconds()
+	}
+
+	for _, m := range traffic.models {
+		snapshot.Models = append(snapshot.Models, *m)
+	}
+	sort.Slice(snapshot.Models, func(i, j int) bool {
+		return snapshot.Models[i].PromptTokens+snapshot.Models[i].CompletionTokens >
+			snapshot.Models[j].PromptTokens+snapshot.Models[j].CompletionTokens
+	})
+	for i := len(traffic.errors) - 1; i >= 0; i-- {
+		snapshot.Errors = append(snapshot.Errors, traffic.errors[i])
+	}
+	return snapshot
+}
@@ -0,0 +1,78 @@
+package azure
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// Transport is the shared upstream transport. Every request to Azure goes
+	// through it so that connections are pooled instead of being opened per
+	// request. It is set up before any init function runs so that those can
+	// already make requests.
+	Transport = newTransport()
+	// Client is the shared upstream client for requests the proxy makes itself.
+	// Its Transport is the shared Transport wrapped by every registered
+	// TransportMiddleware.
+	Client = &http.Client{Transport: Transport}
+)
+
+// TransportMiddleware decorates the upstream round tripper, for example to
+// add retries, metrics or a circuit breaker.
+type TransportMiddleware func(http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc adapts a function to the http.RoundTripper interface.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Use wraps the upstream round tripper with middleware. The last registered
+// middleware is the outermost one. Use must be called before the reverse
+// proxy is built.
+func Use(middleware ...TransportMiddleware) {
+	for _, m := range middleware {
+		Client.Transport = m(Client.Transport)
+	}
+}
+
+func init() {
+	// Instrumentation and the circuit breaker see every attempt, key failover
+	// retries on the same backend and is wrapped by spillover, which moves on
+	// to the next backend. Quota smoothing holds back each backend attempt,
+	// before it reaches Azure. Hedging races two spillover chains on
+	// different backends. Dry runs are answered before any of them.
+	Use(instrument, breaker, keyFailover, smoothQuota, spillover, hedge, dryRun)
+}
+
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   envDuration("AZURE_OPENAI_DIAL_TIMEOUT", 30*time.Second),
+		KeepAlive: envDuration("AZURE_OPENAI_KEEP_ALIVE", 30*time.Second),
+	}
+	// Backends with a connect address are dialed there rather than at the
+	// address their endpoint host resolves to.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, connectAddress(addr))
+	}
+	transport := &http.Transport{
+		Proxy:                 egressProxy(),
+		DialContext:           dial,
+		ForceAttemptHTTP2:     envBool("AZURE_OPENAI_FORCE_HTTP2", true),
+		MaxIdleConns:          envInt("AZURE_OPENAI_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost:   envInt("AZURE_OPENAI_MAX_IDLE_CONNS_PER_HOST", 100),
+		MaxConnsPerHost:       envInt("AZURE_OPENAI_MAX_CONNS_PER_HOST", 0),
+		IdleConnTimeout:       envDuration("AZURE_OPENAI_IDLE_CONN_TIMEOUT", 90*time.Second),
+		TLSHandshakeTimeout:   envDuration("AZURE_OPENAI_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		TLSClientConfig:       upstreamTLSConfig(),
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	log.Printf("loading azure transport: max idle conns %d, max idle conns per host %d, idle timeout %s, keep-alive %s, tls handshake timeout %s, http2 %t",
+		transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout, dialer.KeepAlive, transport.TLSHandshakeTimeout, transport.ForceAttemptHTTP2)
+	return transport
+}
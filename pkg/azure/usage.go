@@ -0,0 +1,171 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// usageBufferLimit is the size up to which a JSON response is kept whole
+	// to read its usage. Past it only the tail is kept, where Azure puts it.
+	usageBufferLimit = 1 << 20
+	usageTailSize    = 64 << 10
+)
+
+var (
+	tokensTotal = metrics.NewCounter("azure_oai_proxy_tokens_total",
+		"Tokens used by successful requests, by virtual key and type.", "key", "model", "type")
+
+	usageObservers []func(info *RequestInfo, usage Usage)
+)
+
+// onUsage registers fn to be called with the usage of every successful
+// chat completions, completions and embeddings request.
+func onUsage(fn func(info *RequestInfo, usage Usage)) {
+	usageObservers = append(usageObservers, fn)
+}
+
+func recordUsage(info *RequestInfo, usage Usage) {
+	info.Usage = usage
+	if info.DryRun != "" {
+		// Mocked usage is not charged to anyone.
+		return
+	}
+	tokensTotal.Add(float64(usage.PromptTokens), info.KeyName, info.Model, "prompt")
+	tokensTotal.Add(float64(usage.CompletionTokens), info.KeyName, info.Model, "completion")
+	for _, fn := range usageObservers {
+		fn(info, usage)
+	}
+}
+
+// observeUsage records the usage of res once the client has read it: from
+// the body of a JSON response, or as a stage of an SSE stream.
+func observeUsage(res *http.Response) error {
+	info := RequestInfoFromContext(res.Request.Context())
+	if info == nil || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	switch info.Operation {
+	case "chat/completions", "completions", "embeddings":
+	default:
+		return nil
+	}
+	if isEventStream(res) {
+		AddStreamStage(res, &usageStage{
+			info:        info,
+			requestBody: requestBodyFromContext(res.Request.Context()),
+		})
+		return nil
+	}
+	if err := decodeResponseBody(res); err != nil {
+		return err
+	}
+	res.Body = &usageReader{ReadCloser: res.Body, info: info}
+	return nil
+}
+
+// usageReader finds the usage in a JSON response as it is read.
+type usageReader struct {
+	io.ReadCloser
+	info *RequestInfo
+
+	buf       bytes.Buffer
+	truncated bool
+	once      sync.Once
+}
+
+func (r *usageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	if r.buf.Len() > usageBufferLimit {
+		tail := append([]byte(nil), r.buf.Bytes()[r.buf.Len()-usageTailSize:]...)
+		r.buf.Reset()
+		r.buf.Write(tail)
+		r.truncated = true
+	}
+	if err == io.EOF {
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *usageReader) Close() error {
+	r.finish()
+	return r.ReadCloser.Close()
+}
+
+func (r *usageReader) finish() {
+	r.once.Do(func() {
+		body := r.buf.Bytes()
+		if r.truncated {
+			// Parse the usage object from its last occurrence in the tail.
+			i := bytes.LastIndex(body, []byte(`"usage"`))
+			if i < 0 {
+				return
+			}
+			body = append([]byte("{"), body[i:]...)
+		}
+		r.info.FinishReason = gjson.GetBytes(body, "choices.0.finish_reason").String()
+		usage := gjson.GetBytes(body, "usage")
+		if !usage.IsObject() {
+			return
+		}
+		recordUsage(r.info, parseUsage(usage))
+	})
+}
+
+// usageStage finds the usage in the events of an SSE stream, estimating it
+// for streams that do not report it.
+type usageStage struct {
+	info        *RequestInfo
+	requestBody []byte
+
+	usage   Usage
+	found   bool
+	content strings.Builder
+}
+
+func (s *usageStage) Event(data []byte) [][]byte {
+	chunk := gjson.ParseBytes(data)
+	if usage := chunk.Get("usage"); usage.IsObject() {
+		s.usage = parseUsage(usage)
+		s.found = true
+	}
+	for _, choice := range chunk.Get("choices").Array() {
+		if reason := choice.Get("finish_reason").String(); reason != "" {
+			s.info.FinishReason = reason
+		}
+		s.content.WriteString(choice.Get("delta.content").String())
+		s.content.WriteString(choice.Get("text").String())
+		for _, call := range choice.Get("delta.tool_calls").Array() {
+			s.content.WriteString(call.Get("function.name").String())
+			s.content.WriteString(call.Get("function.arguments").String())
+		}
+	}
+	return [][]byte{data}
+}
+
+func (s *usageStage) End() [][]byte {
+	if !s.found {
+		// Streams only report usage when asked to, count the tokens.
+		s.usage.PromptTokens = EstimateRequestTokens(s.requestBody)
+		s.usage.CompletionTokens = EstimateTokens(s.content.String())
+		s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+	}
+	recordUsage(s.info, s.usage)
+	return nil
+}
+
+func parseUsage(usage gjson.Result) Usage {
+	return Usage{
+		PromptTokens:     int(usage.Get("prompt_tokens").Int()),
+		CompletionTokens: int(usage.Get("completion_tokens").Int()),
+		TotalTokens:      int(usage.Get("total_tokens").Int()),
+	}
+}
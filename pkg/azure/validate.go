@@ -0,0 +1,63 @@
+package azure
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// deploymentNamePattern matches the names Azure accepts for deployments.
+var deploymentNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{2,64}$`)
+
+// ValidateConfig checks the loaded configuration for mistakes that parsing
+// each variable on its own cannot find, such as a mapping to a deployment
+// name Azure would reject. It returns a description of each problem.
+func ValidateConfig() []string {
+	var problems []string
+	serving := 0
+	seen := map[string]bool{}
+	for _, b := range Backends() {
+		if seen[b.Name] {
+			problems = append(problems, fmt.Sprintf("backend %s is declared more than once", b.Name))
+		}
+		seen[b.Name] = true
+		if b.Type == BackendMirror {
+			continue
+		}
+		serving++
+		if !b.HasAPIKey() && VirtualKeysEnabled() && !AzureOpenAIEntraPassthrough {
+			problems = append(problems, fmt.Sprintf("backend %s has no API key, requests would be sent to Azure with the clients' virtual keys", b.Name))
+		}
+		for _, model := range SortedKeys(b.ModelMapper) {
+			if len(b.Models) > 0 && !b.Models[model] {
+				problems = append(problems, fmt.Sprintf("backend %s maps model %s, which is not in its models", b.Name, model))
+			}
+		}
+		problems = append(problems, checkDeploymentNames("backend "+b.Name+" model mapper", b.ModelMapper)...)
+	}
+	if serving == 0 {
+		problems = append(problems, "every backend is a mirror, no backend serves requests")
+	}
+	problems = append(problems, checkDeploymentNames("model mapper", ModelMapper())...)
+	return problems
+}
+
+func checkDeploymentNames(source string, mapper map[string]string) []string {
+	var problems []string
+	for _, model := range SortedKeys(mapper) {
+		if !deploymentNamePattern.MatchString(mapper[model]) {
+			problems = append(problems, fmt.Sprintf("%s maps %s to %q, which is not a valid deployment name", source, model, mapper[model]))
+		}
+	}
+	return problems
+}
+
+// SortedKeys returns the keys of m in order.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
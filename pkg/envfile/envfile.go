@@ -0,0 +1,127 @@
+// Package envfile loads the proxy configuration from a file of environment
+// variables, such as a mounted Kubernetes ConfigMap, on top of the process
+// environment. The file is applied when the package is initialized, before
+// any package importing it reads the environment.
+package envfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PathVariable names the environment variable holding the path of the file.
+const PathVariable = "AZURE_OPENAI_PROXY_CONFIG_FILE"
+
+var (
+	mu sync.Mutex
+	// loaded are the variables set from the file by the last Apply.
+	loaded map[string]string
+	// original are the process environment values of the variables the file
+	// set, restored when the file no longer sets them.
+	original = map[string]*string{}
+)
+
+func init() {
+	path := os.Getenv(PathVariable)
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("error loading %s: %v", PathVariable, err)
+		os.Exit(1)
+	}
+	vars, err := Parse(data)
+	if err != nil {
+		log.Printf("error parsing %s %s: %v", PathVariable, path, err)
+		os.Exit(1)
+	}
+	Apply(vars)
+	log.Printf("loading azure openai proxy config file %s: %d variables", path, len(vars))
+}
+
+// Parse parses NAME=value lines. Blank lines and lines starting with # are
+// skipped, an export prefix is allowed and values may be quoted.
+func Parse(data []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: expected NAME=value", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				unquoted, err := strconv.Unquote(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		vars[name] = value
+	}
+	return vars, scanner.Err()
+}
+
+// Loaded returns the variables set from the file by the last Apply.
+func Loaded() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	vars := make(map[string]string, len(loaded))
+	for name, value := range loaded {
+		vars[name] = value
+	}
+	return vars
+}
+
+// Apply sets vars in the process environment, overriding it, and restores
+// the variables set by the previous Apply that vars no longer contains. It
+// returns the names of the variables whose value changed.
+func Apply(vars map[string]string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var changed []string
+	for name := range loaded {
+		if _, ok := vars[name]; ok {
+			continue
+		}
+		if v := original[name]; v != nil {
+			os.Setenv(name, *v)
+		} else {
+			os.Unsetenv(name)
+		}
+		delete(original, name)
+		changed = append(changed, name)
+	}
+	for name, value := range vars {
+		current, set := os.LookupEnv(name)
+		if _, ok := loaded[name]; !ok {
+			if set {
+				original[name] = &current
+			} else {
+				original[name] = nil
+			}
+		}
+		if !set || current != value {
+			os.Setenv(name, value)
+			changed = append(changed, name)
+		}
+	}
+	loaded = vars
+	return changed
+}
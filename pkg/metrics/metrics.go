@@ -0,0 +1,271 @@
+// Package metrics is a minimal registry of counters, gauges and histograms
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds suited to LLM requests.
+var DefaultBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+	sort.Slice(registry, func(i, j int) bool { return registry[i].name() < registry[j].name() })
+}
+
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d desc) name() string {
+	return d.metricName
+}
+
+func (d desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, d.help, d.metricName, kind)
+}
+
+// key joins label values into a map key.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metricName, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs renders the label set of key, plus extra pairs.
+func (d desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter for the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labelPairs(key), formatValue(c.values[key]))
+	}
+}
+
+// Gauge is a value per label set that can go up and down.
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	fn     func() float64
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, labels}, values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge without labels whose value is computed by fn
+// at collection time.
+func NewGaugeFunc(name, help string, fn func() float64) *Gauge {
+	g := &Gauge{desc: desc{name, help, nil}, fn: fn}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+// Add adds v, which may be negative, to the gauge for the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] += v
+}
+
+// Inc adds one to the gauge for the label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec subtracts one from the gauge for the label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Value returns the current value of the gauge for the label values.
+func (g *Gauge) Value(values ...string) float64 {
+	if g.fn != nil {
+		return g.fn()
+	}
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.header(w, "gauge")
+	if g.fn != nil {
+		fmt.Fprintf(w, "%s %s\n", g.metricName, formatValue(g.fn()))
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labelPairs(key), formatValue(g.values[key]))
+	}
+}
+
+// Histogram counts observations in cumulative buckets per label set.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bounds and label
+// names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	register(h)
+	return h
+}
+
+// Observe records v for the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", formatValue(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelPairs(key), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelPairs(key), hv.count)
+	}
+}
+
+// Write writes every registered metric to w in the Prometheus text format.
+func Write(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
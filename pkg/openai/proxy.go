@@ -1,10 +1,14 @@
 package openai
 
 import (
+	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func NewOpenAIReverseProxy() *httputil.ReverseProxy {
@@ -16,7 +20,74 @@ func NewOpenAIReverseProxy() *httputil.ReverseProxy {
 		req.URL.Scheme = remote.Scheme
 		req.URL.Host = remote.Host
 
+		if IsWebSocketUpgrade(req) {
+			log.Printf("proxying websocket %s -> %s", originURL, req.URL.String())
+			return
+		}
 		log.Printf("proxying request %s -> %s", originURL, req.URL.String())
 	}
-	return &httputil.ReverseProxy{Director: director}
+	return &httputil.ReverseProxy{Director: director, ModifyResponse: modifyResponse}
+}
+
+// IsWebSocketUpgrade reports whether req asks to switch to the WebSocket
+// protocol, as clients of the Realtime API do.
+func IsWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// modifyResponse watches the connection of an upgraded WebSocket, which the
+// reverse proxy then copies in both directions until either side closes it.
+func modifyResponse(res *http.Response) error {
+	if !IsWebSocketUpgrade(res.Request) {
+		return nil
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		log.Printf("websocket upgrade to %s refused: %s", res.Request.URL, res.Status)
+		return nil
+	}
+	if conn, ok := res.Body.(io.ReadWriteCloser); ok {
+		res.Body = &webSocketConn{ReadWriteCloser: conn, url: res.Request.URL.String(), start: time.Now()}
+	}
+	return nil
+}
+
+// webSocketConn counts the bytes sent each way over an upstream WebSocket
+// and logs them when it is closed.
+type webSocketConn struct {
+	io.ReadWriteCloser
+	url      string
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	closed   atomic.Bool
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *webSocketConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		log.Printf("websocket %s closed after %s, %d bytes sent, %d bytes received",
+			c.url, time.Since(c.start).Round(time.Millisecond), c.sent.Load(), c.received.Load())
+	}
+	return c.ReadWriteCloser.Close()
 }
@@ -0,0 +1,263 @@
+// Package redis is a minimal Redis client speaking RESP2, enough for the
+// proxy's shared state without pulling in a full client library.
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNil is returned for nil replies.
+var ErrNil = errors.New("redis: nil")
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client is a pool of connections to one Redis server. It is safe for
+// concurrent use.
+type Client struct {
+	addr string
+	// host is the host name of addr, which TLS verifies the server for.
+	host     string
+	password string
+	username string
+	db       int
+	tls      bool
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// maxIdle is the number of idle connections kept open.
+const maxIdle = 16
+
+// Open returns a client for a URL of the form
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS.
+func Open(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis: unsupported scheme %q", u.Scheme)
+	}
+	c := &Client{addr: u.Host, host: u.Hostname(), tls: u.Scheme == "rediss", timeout: 5 * time.Second}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			// redis://password@host
+			c.password, c.username = c.username, ""
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis: invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *Client) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		nc, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: c.host})
+	} else {
+		nc, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.password != "" {
+		args := []any{"AUTH", c.password}
+		if c.username != "" {
+			args = []any{"AUTH", c.username, c.password}
+		}
+		if _, err := cn.do(c.timeout, args...); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(c.timeout, "SELECT", c.db); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Do sends a command and returns its reply: a string for simple and bulk
+// strings, an int64 for integers and a []any for arrays. Nil replies return
+// ErrNil, error replies an Error.
+func (c *Client) Do(args ...any) (any, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(c.timeout, args...)
+	var replyErr Error
+	if err != nil && err != ErrNil && !errors.As(err, &replyErr) {
+		// The connection state is unknown after an I/O error.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (cn *conn) do(timeout time.Duration, args ...any) (any, error) {
+	cn.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			s = fmt.Sprint(v)
+		}
+		fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+func (cn *conn) read() (any, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		// Every item is read, even after an error reply, so that the
+		// connection can be reused.
+		items := make([]any, n)
+		var replyErr error
+		for i := range items {
+			items[i], err = cn.read()
+			var e Error
+			switch {
+			case err == nil || err == ErrNil:
+			case errors.As(err, &e):
+				if replyErr == nil {
+					replyErr = err
+				}
+			default:
+				return nil, err
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// Strings converts an array reply to strings, skipping nil items.
+func Strings(reply any, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply type %T", reply)
+	}
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// volatileFields differ between any two responses and are left out of
+// replay diffs.
+var volatileFields = map[string]bool{"id": true, "created": true, "system_fingerprint": true}
+
+// jsonDifference is a value that differs between the logged and the
+// replayed response, at a gjson style path.
+type jsonDifference struct {
+	Path     string `json:"path"`
+	Original any    `json:"original"`
+	Replay   any    `json:"replay"`
+}
+
+// handleReplayRequest sends a request from the request log again, to the
+// backend in the backend query parameter or else the one that served it, and
+// returns both responses with their differences. The replay goes through the
+// proxy like a request of the same virtual key.
+func handleReplayRequest(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithError(c, azure.NewInvalidRequestError("id", "invalid_value", "Invalid id, expected an integer."))
+		return
+	}
+	record, err := requestLog.Get(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("No request with id %d in the request log.", id),
+			Type:       "invalid_request_error",
+			Code:       "request_not_found",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("error reading request log: %v", err)
+		abortWithError(c, err)
+		return
+	}
+	if record.RequestBody == "" && record.Method != http.MethodGet {
+		abortWithError(c, azure.NewInvalidRequestError("id", "body_not_logged",
+			fmt.Sprintf("Request %d was logged without its body, set AZURE_OPENAI_PROXY_REQUEST_LOG_BODIES to replay requests.", id)))
+		return
+	}
+
+	backend := c.DefaultQuery("backend", record.Backend)
+	ctx := azure.NewRequestContext(c.Request.Context())
+	if backend != "" {
+		info := azure.RequestInfoFromContext(ctx)
+		if info.PinnedBackend = azure.BackendByName(backend); info.PinnedBackend == nil {
+			abortWithError(c, azure.NewInvalidRequestError("backend", "invalid_value", "Unknown backend "+backend+"."))
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, record.Method, record.Path, strings.NewReader(record.RequestBody))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if record.RequestBody != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	recorder := httptest.NewRecorder()
+	replay, _ := gin.CreateTestContext(recorder)
+	replay.Request = req
+	replay.Set(virtualKeyContextKey, record.Key)
+	handleAzureProxy(replay)
+	log.Printf("replayed request %d on backend %q: status %d, was %d", id, backend, recorder.Code, record.Status)
+
+	var diffs []jsonDifference
+	var original, replayed any
+	if json.Unmarshal([]byte(record.ResponseBody), &original) == nil && json.Unmarshal(recorder.Body.Bytes(), &replayed) == nil {
+		diffs = diffJSON("", original, replayed, nil)
+	} else if record.ResponseBody != recorder.Body.String() {
+		diffs = []jsonDifference{{Original: record.ResponseBody, Replay: recorder.Body.String()}}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":      "proxy.replay",
+		"id":          record.ID,
+		"original":    gin.H{"status": record.Status, "backend": record.Backend, "deployment": record.Deployment, "body": rawBody(record.ResponseBody)},
+		"replay":      gin.H{"status": recorder.Code, "backend": backend, "deployment": recorder.Header().Get("X-Proxy-Deployment"), "body": rawBody(recorder.Body.String())},
+		"differences": append([]jsonDifference{}, diffs...),
+	})
+}
+
+// rawBody returns a JSON body as is, and any other body as a string.
+func rawBody(body string) any {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	return body
+}
+
+// diffJSON appends the leaves that differ between original and replay to
+// diffs.
+func diffJSON(path string, original, replay any, diffs []jsonDifference) []jsonDifference {
+	switch o := original.(type) {
+	case map[string]any:
+		if r, ok := replay.(map[string]any); ok {
+			keys := make([]string, 0, len(o)+len(r))
+			for k := range o {
+				keys = append(keys, k)
+			}
+			for k := range r {
+				if _, ok := o[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if path == "" && volatileFields[k] {
+					continue
+				}
+				diffs = diffJSON(joinJSONPath(path, k), o[k], r[k], diffs)
+			}
+			return diffs
+		}
+	case []any:
+		if r, ok := replay.([]any); ok {
+			for i := range max(len(o), len(r)) {
+				var ov, rv any
+				if i < len(o) {
+					ov = o[i]
+				}
+				if i < len(r) {
+					rv = r[i]
+				}
+				diffs = diffJSON(joinJSONPath(path, strconv.Itoa(i)), ov, rv, diffs)
+			}
+			return diffs
+		}
+	}
+	if !reflect.DeepEqual(original, replay) {
+		diffs = append(diffs, jsonDifference{Path: path, Original: original, Replay: replay})
+	}
+	return diffs
+}
+
+func joinJSONPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
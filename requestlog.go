@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/requestlog"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// RequestLogRetention is how long request log records are kept, zero
+	// keeps them forever.
+	RequestLogRetention time.Duration
+	// RequestLogBodies also stores the request and response bodies, so that
+	// requests can be replayed. Bodies are scrubbed like the request when PII
+	// scrubbing applies to it.
+	RequestLogBodies bool
+
+	requestLog *requestlog.Store
+)
+
+const (
+	// requestBodyContextKey is the gin context key holding the request body
+	// kept for the request log.
+	requestBodyContextKey = "request_log_body"
+	// requestLogBodyLimit is the largest body stored in the request log,
+	// larger ones are left out rather than stored truncated.
+	requestLogBodyLimit = 1 << 20
+)
+
+func init() {
+	dsn := os.Getenv("AZURE_OPENAI_PROXY_REQUEST_LOG")
+	if dsn == "" {
+		return
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_REQUEST_LOG_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_REQUEST_LOG_RETENTION, invalid value %s", v)
+			os.Exit(1)
+		}
+		RequestLogRetention = d
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_REQUEST_LOG_BODIES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_REQUEST_LOG_BODIES, invalid value %s", v)
+			os.Exit(1)
+		}
+		RequestLogBodies = b
+	}
+
+	store, err := requestlog.Open(dsn)
+	if err != nil {
+		log.Printf("error opening request log: %v", err)
+		os.Exit(1)
+	}
+	requestLog = store
+	log.Printf("loading azure openai proxy request log, retention %s, bodies %t", RequestLogRetention, RequestLogBodies)
+	if RequestLogRetention > 0 {
+		go pruneRequestLog()
+	}
+}
+
+func pruneRequestLog() {
+	for ; ; time.Sleep(time.Hour) {
+		n, err := requestLog.Prune(time.Now().Add(-RequestLogRetention))
+		if err != nil {
+			log.Printf("error pruning request log: %v", err)
+		} else if n > 0 {
+			log.Printf("pruned %d request log records", n)
+		}
+	}
+}
+
+// logRequest adds the request to the dashboard traffic and the request log,
+// if enabled. It is deferred by the proxy handler, so it also sees requests
+// rejected by the proxy.
+func logRequest(c *gin.Context, start time.Time) {
+	info := azure.RequestInfoFromContext(c.Request.Context())
+	recordTraffic(c, info, time.Since(start))
+	if requestLog == nil {
+		return
+	}
+	record := requestlog.Record{
+		Time:             start,
+		Key:              info.KeyName,
+		Method:           c.Request.Method,
+		Path:             c.Request.URL.Path,
+		Model:            info.Model,
+		Deployment:       c.Writer.Header().Get("X-Proxy-Deployment"),
+		Status:           c.Writer.Status(),
+		LatencyMS:        time.Since(start).Milliseconds(),
+		PromptTokens:     info.Usage.PromptTokens,
+		CompletionTokens: info.Usage.CompletionTokens,
+		FinishReason:     info.FinishReason,
+	}
+	if info.Backend != nil {
+		record.Backend = info.Backend.Name
+	}
+	if recorder, ok := c.Writer.(*bodyRecorder); ok {
+		record.RequestBody = c.GetString(requestBodyContextKey)
+		if !recorder.overflow && recorder.Header().Get("Content-Encoding") == "" {
+			record.ResponseBody = recorder.body.String()
+			if azure.ScrubsPII(info.Model, info.KeyName) {
+				record.ResponseBody, _ = azure.ScrubPII(record.ResponseBody)
+			}
+		}
+	}
+	requestLog.Add(record)
+}
+
+// captureBodies keeps the JSON request body and the response for the
+// request log, if it stores bodies.
+func captureBodies(c *gin.Context) {
+	if requestLog == nil || !RequestLogBodies {
+		return
+	}
+	if c.Request.Body != nil && strings.HasPrefix(c.ContentType(), "application/json") {
+		body, err := readRequestBody(c)
+		if err != nil || len(body) > requestLogBodyLimit {
+			return
+		}
+		if azure.ScrubsPII(gjson.GetBytes(body, "model").String(), c.GetString(virtualKeyContextKey)) {
+			body, _ = azure.ScrubRequestPII(body)
+		}
+		c.Set(requestBodyContextKey, string(body))
+	}
+	c.Writer = &bodyRecorder{ResponseWriter: c.Writer}
+}
+
+// bodyRecorder keeps a copy of the response body up to requestLogBodyLimit.
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *bodyRecorder) Write(p []byte) (int, error) {
+	r.record(p)
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *bodyRecorder) WriteString(s string) (int, error) {
+	r.record([]byte(s))
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *bodyRecorder) record(p []byte) {
+	if r.body.Len()+len(p) > requestLogBodyLimit {
+		r.overflow = true
+		r.body.Reset()
+	}
+	if !r.overflow {
+		r.body.Write(p)
+	}
+}
+
+func handleGetRequests(c *gin.Context) {
+	filter := requestlog.Filter{
+		Key:   c.Query("key"),
+		Model: c.Query("model"),
+	}
+	var err error
+	for param, dst := range map[string]*int{"status": &filter.Status, "limit": &filter.Limit, "offset": &filter.Offset} {
+		if v := c.Query(param); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				abortWithError(c, azure.NewInvalidRequestError(param, "invalid_value", "Invalid "+param+", expected an integer."))
+				return
+			}
+		}
+	}
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				abortWithError(c, azure.NewInvalidRequestError(param, "invalid_value", "Invalid "+param+", expected an RFC 3339 timestamp."))
+				return
+			}
+		}
+	}
+
+	records, hasMore, err := requestLog.Query(filter)
+	if err != nil {
+		log.Printf("error querying request log: %v", err)
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": records, "has_more": hasMore})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// routeGroups maps the names accepted by AZURE_OPENAI_PROXY_DISABLED_ROUTES to
+// the path prefixes they cover.
+var routeGroups = map[string][]string{
+	"chat":          {"/v1/chat/", "/v1/extensions/chat/"},
+	"completions":   {"/v1/completions"},
+	"embeddings":    {"/v1/embeddings"},
+	"images":        {"/v1/images/"},
+	"audio":         {"/v1/audio/"},
+	"files":         {"/v1/files", "/v1/uploads"},
+	"vector-stores": {"/v1/vector_stores"},
+	"fine-tunes":    {"/v1/fine_tunes", "/v1/fine_tuning/"},
+	"models":        {"/v1/models"},
+	"deployments":   {"/deployments"},
+	"estimate":      {"/v1/proxy/estimate"},
+}
+
+// DisabledRoutes are the route groups that are rejected by the proxy.
+var DisabledRoutes = map[string]bool{}
+
+func init() {
+	v := os.Getenv("AZURE_OPENAI_PROXY_DISABLED_ROUTES")
+	if v == "" {
+		return
+	}
+	for _, group := range azure.SplitList(v) {
+		if _, ok := routeGroups[group]; !ok {
+			log.Printf("error parsing AZURE_OPENAI_PROXY_DISABLED_ROUTES, unknown route group %s, expected one of %s", group, strings.Join(azure.SortedKeys(routeGroups), ", "))
+			os.Exit(1)
+		}
+		DisabledRoutes[group] = true
+		log.Printf("loading azure openai proxy disabled routes: %s", group)
+	}
+}
+
+// disabledRouteGroup returns the disabled group path belongs to, if any.
+func disabledRouteGroup(path string) string {
+	for group := range DisabledRoutes {
+		for _, prefix := range routeGroups[group] {
+			if strings.HasPrefix(path, prefix) {
+				return group
+			}
+		}
+	}
+	return ""
+}
+
+// rejectDisabledRoutes answers requests to disabled route groups with a 403
+// in the OpenAI error format.
+func rejectDisabledRoutes(c *gin.Context) {
+	if group := disabledRouteGroup(c.Request.URL.Path); group != "" {
+		abortWithError(c, &azure.APIError{
+			StatusCode: http.StatusForbidden,
+			Message:    fmt.Sprintf("The %s API is disabled on this proxy.", group),
+			Type:       "invalid_request_error",
+			Code:       "route_disabled",
+		})
+		return
+	}
+	c.Next()
+}